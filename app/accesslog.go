@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"  // Used to format log lines
+	"io"   // Log lines go to any writer (stdout, a file)
+	"sync" // Used to keep lines from concurrent requests apart
+	"time" // Used for the request timestamp
+)
+
+// clfTimeFormat is the timestamp format of the Common Log Format,
+// e.g. "10/Oct/2000:13:55:36 -0700".
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLog returns middleware that writes one line per request to out, in
+// the Common Log Format used by Apache and nginx:
+//
+//	127.0.0.1 - alice [10/Oct/2000:13:55:36 -0700] "GET /echo/abc HTTP/1.1" 200 3
+//
+// With combined set, the Combined Log Format adds the Referer and User-Agent:
+//
+//	... 200 3 "http://example.com/" "curl/8.0.1"
+//
+// Install it first with router.Use so it also sees requests that later
+// middleware (authentication, rate limiting) refuses.
+func AccessLog(out io.Writer, combined bool) Middleware {
+	var mu sync.Mutex
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, req *HTTPRequest) {
+			start := time.Now()
+			// The request line as sent, before a rewrite changes it.
+			target := req.RawPath
+			if req.RawQuery != "" {
+				target += "?" + req.RawQuery
+			}
+			sw := &statusWriter{ResponseWriter: w}
+			next(sw, req)
+
+			// The user name of Basic credentials, unverified, as Apache logs it.
+			user := "-"
+			if name, _, ok := basicCredentials(req); ok && name != "" {
+				user = name
+			}
+			status := sw.status
+			if status == 0 {
+				status = 200 // The handler wrote nothing; finish sends an empty 200.
+			}
+			// "-" means no body was sent.
+			size := "-"
+			if sw.bytes > 0 && req.Method != "HEAD" {
+				size = fmt.Sprint(sw.bytes)
+			}
+
+			line := fmt.Sprintf("%s - %s [%s] %q %d %s",
+				clientIP(req.RemoteAddr), user, start.Format(clfTimeFormat),
+				req.Method+" "+target+" "+req.Version, status, size)
+			if combined {
+				line += fmt.Sprintf(" %q %q", orDash(req.Header("Referer")), orDash(req.Header("User-Agent")))
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprintln(out, line)
+		}
+	}
+}
+
+// orDash returns s, or "-" if it is empty, as log formats write missing fields.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
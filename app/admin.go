@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json" // The admin API speaks JSON
+	"log/slog"      // Used to adjust and log at the log level
+	"strconv"       // Used to format Content-Length
+	"strings"       // Used to report the log level in lower case
+	"sync/atomic"   // Used for the maintenance flag
+)
+
+// Admin is the admin API, served on a listener of its own (-admin-addr),
+// typically bound to localhost or a management network, to inspect and
+// change the running server:
+//
+//	GET  /routes       the routes of the default site and of each virtual host
+//	GET  /maintenance  whether maintenance mode is on
+//	PUT  /maintenance  {"enabled":true} turns it on, false off
+//	GET  /log-level    the minimum log level
+//	PUT  /log-level    {"level":"debug"} changes it
+//	GET  /connections  open connections, idle and busy
+//	GET  /reload       the outcome of the latest reload
+//	POST /reload       reloads the configuration, like SIGHUP
+//	POST /shutdown     stops the server gracefully, like SIGTERM
+//
+// When the server requires authentication, so does the admin API.
+type Admin struct {
+	Server   *Server        // The server administered
+	LogLevel *slog.LevelVar // The level of the default logger
+	Reload   func() error   // Reloads the configuration; nil disables POST /reload
+	Shutdown func()         // Starts a graceful shutdown; nil disables POST /shutdown
+}
+
+// maintenance is set while the server is in maintenance mode: every request
+// but the probes is answered 503, and /readyz fails.
+var maintenance atomic.Bool
+
+// Maintenance returns middleware that answers 503 with Retry-After while the
+// server is in maintenance mode. /healthz and /readyz go through: the
+// server is alive, and /readyz reports it is not ready.
+func Maintenance() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, req *HTTPRequest) {
+			if maintenance.Load() && req.Path != "/healthz" && req.Path != "/readyz" {
+				sendResponse(w, 503, []string{"Retry-After: 60"}, "")
+				return
+			}
+			next(w, req)
+		}
+	}
+}
+
+// Router returns the Router serving the admin API.
+func (a *Admin) Router() *Router {
+	r := NewRouter()
+	r.Use(RequestLog())
+	api := r.Group("")
+	api.Use(a.Server.requireAuth)
+	api.Get("/routes", a.routesHandler)
+	api.Get("/maintenance", a.maintenanceHandler)
+	api.Put("/maintenance", a.maintenanceHandler)
+	api.Get("/log-level", a.logLevelHandler)
+	api.Put("/log-level", a.logLevelHandler)
+	api.Get("/connections", a.connectionsHandler)
+	api.Get("/reload", reloadStatusHandler)
+	if a.Reload != nil {
+		api.Post("/reload", a.reloadHandler)
+	}
+	if a.Shutdown != nil {
+		api.Post("/shutdown", a.shutdownHandler)
+	}
+	return r
+}
+
+// sendJSON sends v encoded as JSON.
+func sendJSON(w ResponseWriter, status int, v any) {
+	body, _ := json.Marshal(v)
+	headerLines := []string{
+		"Content-Type: application/json",
+		"Content-Length: " + strconv.Itoa(len(body)),
+		"Cache-Control: no-store",
+	}
+	sendResponse(w, status, headerLines, string(body))
+}
+
+// --- ROUTES ENDPOINT ---
+// GET /routes lists the routes of the latest reload, in the order they are
+// matched on ties.
+func (a *Admin) routesHandler(w ResponseWriter, req *HTTPRequest) {
+	s := a.Server.current()
+	var routes struct {
+		Default      []RouteInfo            `json:"default"`
+		VirtualHosts map[string][]RouteInfo `json:"virtual_hosts,omitempty"`
+	}
+	routes.Default = s.Router.Routes()
+	for name, vh := range s.VirtualHosts {
+		if routes.VirtualHosts == nil {
+			routes.VirtualHosts = make(map[string][]RouteInfo)
+		}
+		routes.VirtualHosts[name] = vh.Router.Routes()
+	}
+	sendJSON(w, 200, routes)
+}
+
+// --- MAINTENANCE ENDPOINT ---
+// GET /maintenance reports whether maintenance mode is on, PUT turns it on
+// or off.
+func (a *Admin) maintenanceHandler(w ResponseWriter, req *HTTPRequest) {
+	var state struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if req.Method == "PUT" {
+		if err := json.Unmarshal([]byte(req.Body), &state); err != nil || state.Enabled == nil {
+			sendResponse(w, 400, nil, "")
+			return
+		}
+		maintenance.Store(*state.Enabled)
+		slog.Warn("maintenance mode changed", "enabled", *state.Enabled)
+	}
+	enabled := maintenance.Load()
+	state.Enabled = &enabled
+	sendJSON(w, 200, state)
+}
+
+// --- LOG LEVEL ENDPOINT ---
+// GET /log-level reports the minimum log level, PUT changes it.
+func (a *Admin) logLevelHandler(w ResponseWriter, req *HTTPRequest) {
+	var state struct {
+		Level string `json:"level"`
+	}
+	if req.Method == "PUT" {
+		if err := json.Unmarshal([]byte(req.Body), &state); err != nil {
+			sendResponse(w, 400, nil, "")
+			return
+		}
+		level, err := parseLevel(state.Level)
+		if err != nil {
+			sendResponse(w, 400, nil, "")
+			return
+		}
+		a.LogLevel.Set(level)
+		slog.Warn("log level changed", "level", level)
+	}
+	state.Level = strings.ToLower(a.LogLevel.Level().String())
+	sendJSON(w, 200, state)
+}
+
+// --- CONNECTIONS ENDPOINT ---
+// GET /connections counts the open connections: busy ones are serving a
+// request, idle ones are keep-alive connections waiting for the next.
+func (a *Admin) connectionsHandler(w ResponseWriter, req *HTTPRequest) {
+	open, idle := a.Server.conns.count()
+	sendJSON(w, 200, map[string]any{
+		"open":           open,
+		"busy":           open - idle,
+		"idle":           idle,
+		"total_requests": totalRequests.Load(),
+		"draining":       draining.Load(),
+	})
+}
+
+// --- RELOAD ENDPOINT ---
+// POST /reload reloads the configuration and reports the outcome, with 500
+// if it failed (the server then keeps its current configuration).
+func (a *Admin) reloadHandler(w ResponseWriter, req *HTTPRequest) {
+	err := a.Reload()
+	recordReload(err)
+	status := 200
+	if err != nil {
+		status = 500
+	}
+	writeReloadStatus(w, status)
+}
+
+// --- SHUTDOWN ENDPOINT ---
+// POST /shutdown answers 202 and starts a graceful shutdown.
+func (a *Admin) shutdownHandler(w ResponseWriter, req *HTTPRequest) {
+	slog.Warn("shutdown requested through the admin API", "remote_addr", req.RemoteAddr)
+	sendJSON(w, 202, map[string]string{"status": "shutting down"})
+	// The admin API is not drained: send the answer before the process
+	// may exit.
+	if f, ok := w.(Flusher); ok {
+		f.Flush()
+	}
+	a.Shutdown()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"   // Used to hold recorded bodies
+	"strconv" // Used to format the Age header
+	"strings" // Used to inspect Cache-Control
+	"sync"    // Used to guard the cache shared by all connections
+	"time"    // Used for expiry
+)
+
+// cachedResponse is a response recorded from a handler by a cacheRecorder.
+// Only what the handler produced is stored; per-request headers (Date,
+// X-Request-ID, Connection, ...) are regenerated when it is replayed.
+type cachedResponse struct {
+	status int
+	header Header
+	body   bytes.Buffer
+	stored time.Time
+
+	// uncacheable is set when the body grew past maxCachedBodyBytes, e.g. a
+	// streamed file, which is never worth holding in memory.
+	uncacheable bool
+}
+
+// cacheRecorder is the ResponseWriter a Cached handler writes to. It passes
+// everything through to the client while keeping a copy.
+//
+// The handler gets a header map of its own, so that only the headers it sets
+// are recorded: those outer middleware set for this one request (CORS's
+// Access-Control-Allow-Origin and Vary: Origin, say) must not be replayed to
+// every later client.
+type cacheRecorder struct {
+	ResponseWriter
+	header   Header
+	recorded *cachedResponse
+}
+
+// Header returns the handler's own headers, merged into the response's when
+// they are sent.
+func (c *cacheRecorder) Header() Header {
+	return c.header
+}
+
+// WriteHeader records the status and a snapshot of the handler's headers.
+func (c *cacheRecorder) WriteHeader(status int) {
+	if c.recorded.status == 0 {
+		c.recorded.status = status
+		c.recorded.header = c.header.Clone()
+		mergeHeader(c.ResponseWriter.Header(), c.header)
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the body, up to maxCachedBodyBytes.
+func (c *cacheRecorder) Write(p []byte) (int, error) {
+	if c.recorded.status == 0 {
+		c.WriteHeader(200)
+	}
+	if c.recorded.body.Len()+len(p) > maxCachedBodyBytes {
+		c.recorded.uncacheable = true
+	} else if !c.recorded.uncacheable {
+		c.recorded.body.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+// Flush passes through to the wrapped writer, so streaming handlers still
+// stream when cached.
+func (c *cacheRecorder) Flush() {
+	if f, ok := c.ResponseWriter.(Flusher); ok {
+		f.Flush()
+	}
+}
+
+// responseCache is an in-memory cache for one route.
+type responseCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*cachedResponse
+}
+
+// maxCacheEntries bounds each route's cache; expired entries are swept
+// whenever it is reached.
+const maxCacheEntries = 1024
+
+// maxCachedBodyBytes is the largest body a cache entry may hold.
+const maxCachedBodyBytes = 1 << 20
+
+// Cached wraps handler with an in-memory cache of its responses.
+// Successful (200) GET and HEAD responses are kept for ttl, keyed by method,
+// path, query and Accept-Encoding (the only request header our handlers vary on).
+// Only the handler's own headers are stored, not those outer middleware add.
+// While an entry is fresh the handler is not called at all. A request with
+// "Cache-Control: no-cache" always reaches the handler, and its response
+// refreshes the entry. A ttl of 0 disables caching.
+//
+// Example: router.Get("/echo/", Cached(time.Minute, s.echoHandler))
+func Cached(ttl time.Duration, handler HandlerFunc) HandlerFunc {
+	if ttl <= 0 {
+		return handler
+	}
+	cache := &responseCache{ttl: ttl, entries: make(map[string]*cachedResponse)}
+
+	return func(w ResponseWriter, req *HTTPRequest) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			handler(w, req)
+			return
+		}
+		key := req.Method + " " + req.Path + "?" + req.RawQuery + "\n" + req.Header("Accept-Encoding")
+
+		// 1. Serve from the cache when we can.
+		if !wantsRevalidation(req) {
+			if entry, ok := cache.get(key); ok {
+				mergeHeader(w.Header(), entry.header)
+				w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+				w.WriteHeader(entry.status)
+				w.Write(entry.body.Bytes())
+				return
+			}
+		}
+
+		// 2. Otherwise run the handler, recording what it sends.
+		recorder := &cacheRecorder{ResponseWriter: w, header: make(Header), recorded: &cachedResponse{}}
+		handler(recorder, req)
+		if recorder.recorded.status == 0 {
+			// Nothing was written: the headers go out with the implicit 200.
+			mergeHeader(w.Header(), recorder.header)
+		}
+
+		if recorder.recorded.status == 200 && !recorder.recorded.uncacheable {
+			cache.put(key, recorder.recorded)
+		}
+	}
+}
+
+// mergeHeader adds the headers in src to dst. Values are appended, not
+// replaced, so that e.g. the Vary of a cached response and the Vary: Origin
+// of the CORS middleware both reach the client.
+func mergeHeader(dst, src Header) {
+	for name, values := range src {
+		dst[name] = append(dst[name], values...)
+	}
+}
+
+// wantsRevalidation reports whether the client asked to bypass caches.
+func wantsRevalidation(req *HTTPRequest) bool {
+	return strings.Contains(req.Header("Cache-Control"), "no-cache") ||
+		strings.Contains(req.Header("Pragma"), "no-cache")
+}
+
+// get returns the entry for key if it has not expired.
+func (c *responseCache) get(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(entry.stored) > c.ttl {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry, true
+}
+
+// put stores entry under key, first sweeping expired entries if the cache is full.
+func (c *responseCache) put(key string, entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxCacheEntries {
+		for k, e := range c.entries {
+			if time.Since(e.stored) > c.ttl {
+				delete(c.entries, k)
+			}
+		}
+		// Still full of fresh entries: skip caching rather than grow unbounded.
+		if len(c.entries) >= maxCacheEntries {
+			return
+		}
+	}
+
+	entry.stored = time.Now()
+	c.entries[key] = entry
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"slices"      // Used to compare Vary values
+	"strconv"     // Used to number responses
+	"sync/atomic" // Counts handler calls across connections
+	"testing"     // The test framework
+	"time"        // Used for the TTL
+)
+
+func TestCached(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+	type step struct {
+		target  string
+		headers []string
+		sleep   time.Duration // Before the request
+		want    int           // Handler calls so far
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"repeat is a hit", []step{{"/c/a", nil, 0, 1}, {"/c/a", nil, 0, 1}}},
+		{"expired after the TTL", []step{{"/c/a", nil, 0, 1}, {"/c/a", nil, 0, 1}, {"/c/a", nil, 2 * ttl, 2}}},
+		{"no-cache bypasses", []step{{"/c/a", nil, 0, 1}, {"/c/a", []string{"Cache-Control: no-cache"}, 0, 2}, {"/c/a", nil, 0, 2}}},
+		{"Pragma: no-cache bypasses", []step{{"/c/a", nil, 0, 1}, {"/c/a", []string{"Pragma: no-cache"}, 0, 2}}},
+		{"other paths are other entries", []step{{"/c/a", nil, 0, 1}, {"/c/b", nil, 0, 2}, {"/c/a?x=1", nil, 0, 3}}},
+		{"keyed on Accept-Encoding", []step{{"/c/a", nil, 0, 1}, {"/c/a", []string{"Accept-Encoding: gzip"}, 0, 2}, {"/c/a", []string{"Accept-Encoding: gzip"}, 0, 2}}},
+		{"errors are not cached", []step{{"/c/missing", nil, 0, 1}, {"/c/missing", nil, 0, 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			var calls atomic.Int32
+			s.Router.Get("/c/{name}", Cached(ttl, func(w ResponseWriter, req *HTTPRequest) {
+				n := calls.Add(1)
+				status := 200
+				if req.Params["name"] == "missing" {
+					status = 404
+				}
+				sendResponse(w, status, []string{"Content-Type: text/plain"}, "response "+strconv.Itoa(int(n)))
+			}))
+
+			var first string
+			for i, step := range tt.steps {
+				time.Sleep(step.sleep)
+				resp := get(t, s, step.target, step.headers...)
+				if got := int(calls.Load()); got != step.want {
+					t.Fatalf("request %d: handler called %d times, want %d", i+1, got, step.want)
+				}
+				if i == 0 {
+					first = resp.body
+				}
+				// A hit replays the response, Age and all.
+				if step.want == 1 && (resp.body != first || (i > 0 && resp.header.Get("Age") == "")) {
+					t.Errorf("request %d: %q (Age %q), want a replay of %q", i+1, resp.body, resp.header.Get("Age"), first)
+				}
+			}
+		})
+	}
+}
+
+func TestCachedWithCORS(t *testing.T) {
+	s := newTestServer(t, "-cache-ttl", "1m", "-cors-origins", "https://a.example,https://b.example", "-cors-credentials")
+	steps := []struct {
+		origin    string
+		wantAllow string
+		wantVary  []string
+	}{
+		{"https://a.example", "https://a.example", []string{"Origin", "Accept-Encoding"}},
+		// A hit: the handler's headers are replayed, not those CORS added
+		// for the first origin.
+		{"https://b.example", "https://b.example", []string{"Origin", "Accept-Encoding"}},
+		{"", "", []string{"Accept-Encoding"}},
+		{"https://other.example", "", []string{"Origin", "Accept-Encoding"}},
+	}
+	for i, step := range steps {
+		var headers []string
+		if step.origin != "" {
+			headers = append(headers, "Origin: "+step.origin)
+		}
+		resp := get(t, s, "/echo/hello", headers...)
+		if resp.body != "hello" || (i > 0 && resp.header.Get("Age") == "") {
+			t.Fatalf("request %d: %q (Age %q), want a cached hello", i+1, resp.body, resp.header.Get("Age"))
+		}
+		if got := resp.header.Get("Access-Control-Allow-Origin"); got != step.wantAllow {
+			t.Errorf("request %d: Access-Control-Allow-Origin = %q, want %q", i+1, got, step.wantAllow)
+		}
+		if got := resp.header.Values("Vary"); !slices.Equal(got, step.wantVary) {
+			t.Errorf("request %d: Vary = %q, want %q", i+1, got, step.wantVary)
+		}
+		if got, want := resp.header.Get("Access-Control-Allow-Credentials"), step.wantAllow != ""; (got == "true") != want {
+			t.Errorf("request %d: Access-Control-Allow-Credentials = %q", i+1, got)
+		}
+	}
+}
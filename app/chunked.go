@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"   // Used to read the chunked stream line by line
+	"errors"  // Used to report malformed chunks
+	"io"      // Used to read the decoded body
+	"strconv" // Used to parse hexadecimal chunk sizes
+	"strings" // Used to trim chunk extensions and trailer fields
+)
+
+// A chunked body (RFC 9112 7.1) is sent as a series of chunks, each prefixed
+// with its size in hex, and ends with a zero-sized chunk. Clients use it when
+// they do not know the length up front, e.g. curl uploading from stdin:
+//
+//	5\r\n        <- size of the chunk (optionally followed by ";extensions")
+//	hello\r\n    <- chunk data
+//	0\r\n        <- last chunk
+//	Expires: 0\r\n <- optional trailer fields
+//	\r\n         <- blank line ends the body
+
+// errMalformedChunk is returned for a chunked body that does not follow the format.
+var errMalformedChunk = errors.New("malformed chunked encoding")
+
+// errTrailerTooLarge is returned once the trailer fields of a chunked body
+// take more than maxHeadBytes, the limit heads have.
+var errTrailerTooLarge = errors.New("request trailer too large")
+
+// isChunked reports whether the request body uses chunked transfer coding.
+func (req *HTTPRequest) isChunked() bool {
+	return strings.EqualFold(req.Header("Transfer-Encoding"), "chunked")
+}
+
+// decodeChunked reads a chunked body from r and returns the decoded data and
+// the trailer fields sent after the last chunk. The decoded body may be at
+// most maxBytes long (0 for no limit); beyond that errBodyTooLarge is
+// returned without reading further.
+func decodeChunked(r *bufio.Reader, maxBytes int64) (string, Header, error) {
+	var trailer Header
+	body, err := io.ReadAll(&chunkedReader{r: r, maxBytes: maxBytes, trailer: &trailer})
+	if err != nil {
+		return "", nil, err
+	}
+	return string(body), trailer, nil
+}
+
+// chunkedReader decodes a chunked body as it is read, so that a handler can
+// stream it (see Router.HandleStream) rather than get it whole. It returns
+// io.EOF after the last chunk, once the trailer fields have been stored in
+// *trailer, and errBodyTooLarge before reading a chunk that would take the
+// body past maxBytes (0 for no limit).
+type chunkedReader struct {
+	r        *bufio.Reader
+	maxBytes int64
+	trailer  *Header
+
+	total   int64 // Decoded bytes so far
+	left    int64 // Bytes left in the current chunk
+	started bool  // Whether a chunk has been read (and needs its CRLF)
+	err     error // Sticky: io.EOF at the end, or what went wrong
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for c.err == nil && c.left == 0 {
+		c.err = c.nextChunk()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF // The client hung up inside a chunk.
+	}
+	c.err = err
+	return n, err
+}
+
+// nextChunk moves on to the next chunk: it reads the CRLF that ends the
+// previous chunk's data, then the size line. After the zero-sized last chunk
+// it reads the trailer and returns io.EOF.
+func (c *chunkedReader) nextChunk() error {
+	if c.started {
+		if line, err := readChunkLine(c.r); err != nil {
+			return err
+		} else if line != "" {
+			return errMalformedChunk
+		}
+	}
+	c.started = true
+
+	// Chunk size line: "1a;name=value\r\n". Extensions are ignored.
+	line, err := readChunkLine(c.r)
+	if err != nil {
+		return err
+	}
+	sizeText, _, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeText), 16, 64)
+	if err != nil || size < 0 {
+		return errMalformedChunk
+	}
+
+	// The zero-sized chunk ends the data; trailer fields follow.
+	if size == 0 {
+		trailer, err := readTrailer(c.r)
+		if err != nil {
+			return err
+		}
+		*c.trailer = trailer
+		return io.EOF
+	}
+
+	if c.maxBytes > 0 && c.total+size > c.maxBytes {
+		return errBodyTooLarge
+	}
+	c.total += size
+	c.left = size
+	return nil
+}
+
+// readTrailer reads the trailer fields after the last chunk, up to the blank
+// line that ends the body. Like a head, the trailer may take at most
+// maxHeadBytes, however many lines that is split into.
+func readTrailer(r *bufio.Reader) (Header, error) {
+	trailer := make(Header)
+	size := 0
+	for {
+		line, err := readChunkLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return trailer, nil
+		}
+		if size += len(line) + 2; size > maxHeadBytes {
+			return nil, errTrailerTooLarge
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, errMalformedChunk
+		}
+		trailer.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+}
+
+// readChunkLine reads one CRLF-terminated line and returns it without the
+// CRLF. Lines longer than the reader's buffer (4KB) are refused, so a client
+// cannot make us buffer an endless size line.
+func readChunkLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errMalformedChunk
+	}
+	if err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errMalformedChunk
+	}
+	return string(line[:len(line)-2]), nil
+}
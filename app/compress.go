@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"   // Hijack hands out a buffered reader/writer
+	"bytes"   // Used to hold the start of the body until the decision is made
+	"io"      // Used to pass files through untouched
+	"mime"    // Used to read the media type out of Content-Type
+	"net"     // Hijack hands out the connection
+	"strconv" // Used to read Content-Length
+	"strings" // Used to match content types and inspect headers
+)
+
+// defaultCompressTypes are the content types compressed unless -compress-types
+// says otherwise: text formats, which typically shrink to a fraction of their
+// size. Images, video and archives are compressed already.
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// Compress returns middleware that compresses response bodies with the
+// encoding the client prefers (see chooseEncoder), when:
+//   - the body is larger than minSize bytes;
+//   - its Content-Type is one of types ("text/*" matches every text type);
+//   - the handler did not encode it itself (e.g. a precompressed file) and
+//     it is not a range of the body (206).
+//
+// Every response of a compressible type gets "Vary: Accept-Encoding", so
+// caches keep the compressed and uncompressed bodies apart.
+//
+// The body's size is taken from Content-Length when the handler sets it.
+// Otherwise the first minSize bytes are held back until it is clear whether
+// there are more.
+func Compress(minSize int, types []string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, req *HTTPRequest) {
+			cw := &compressWriter{ResponseWriter: w, req: req, minSize: minSize, types: types}
+			next(cw, req)
+			cw.close()
+		}
+	}
+}
+
+// compressWriter is the ResponseWriter a Compress handler writes to. It
+// starts out undecided: WriteHeader is held back, and so is the body until
+// it is larger than minSize. Then it either compresses everything through
+// encoder or passes everything through as is.
+type compressWriter struct {
+	ResponseWriter
+	req     *HTTPRequest
+	minSize int
+	types   []string
+
+	status  int
+	decided bool
+	buf     bytes.Buffer // Body written while undecided
+
+	encoder    *contentEncoder
+	compressor compressor // Set while compressing
+}
+
+// WriteHeader decides right away when the headers are enough: the response
+// is not compressible, or its Content-Length says how large it is.
+func (c *compressWriter) WriteHeader(status int) {
+	if c.status != 0 {
+		c.ResponseWriter.WriteHeader(status) // Logs the superfluous call
+		return
+	}
+	c.status = status
+
+	if !c.eligible() {
+		c.passThrough()
+		return
+	}
+	if n, err := strconv.ParseInt(c.Header().Get("Content-Length"), 10, 64); err == nil {
+		if n > int64(c.minSize) {
+			c.startCompressing()
+		} else {
+			c.passThrough()
+		}
+	}
+}
+
+// eligible reports whether the response may be compressed, and adds Vary
+// when the answer depends on Accept-Encoding.
+func (c *compressWriter) eligible() bool {
+	h := c.Header()
+	if statusHasNoBody(c.status) || c.status == 206 || h.Has("Content-Encoding") ||
+		!c.compressibleType(h.Get("Content-Type")) {
+		return false
+	}
+	if !varies(h, "Accept-Encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+
+	encoder, ok := chooseEncoder(c.req)
+	if !ok {
+		// Identity refused too: the body is sent as is rather than not at all.
+		c.req.AddWarning(299, "Content-Encoding not supported, sent uncompressed")
+	}
+	c.encoder = encoder
+	return encoder != nil
+}
+
+// compressibleType reports whether contentType is one of c.types.
+func (c *compressWriter) compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.types {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok {
+			if strings.HasPrefix(mediaType, prefix) {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// varies reports whether the Vary header in h already lists name.
+func varies(h Header, name string) bool {
+	for _, value := range h.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startCompressing sends the head of a compressed response. Its length is
+// unknown until the end, so it goes out chunked.
+func (c *compressWriter) startCompressing() {
+	c.decided = true
+	h := c.Header()
+	h.Set("Content-Encoding", c.encoder.coding)
+	h.Del("Content-Length")
+	// Ranges would refer to the compressed bytes, which are not stable.
+	h.Del("Accept-Ranges")
+	// The compressed body is not byte-for-byte the one the ETag was made
+	// for, but it is equivalent, which a weak ETag says (RFC 9110 8.8.1).
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+
+	c.compressor = c.encoder.pool.Get().(compressor)
+	c.compressor.Reset(writerOnly{c.ResponseWriter})
+	c.compressor.Write(c.buf.Bytes())
+	c.buf.Reset()
+}
+
+// passThrough sends the head unchanged, followed by what was held back.
+func (c *compressWriter) passThrough() {
+	c.decided = true
+	c.ResponseWriter.WriteHeader(c.status)
+	if c.buf.Len() > 0 {
+		c.ResponseWriter.Write(c.buf.Bytes())
+		c.buf.Reset()
+	}
+}
+
+// Write compresses p, passes it through or holds it back until the body
+// outgrows minSize.
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(200)
+	}
+	switch {
+	case c.compressor != nil:
+		return c.compressor.Write(p)
+	case c.decided:
+		return c.ResponseWriter.Write(p)
+	}
+	c.buf.Write(p)
+	if c.buf.Len() > c.minSize {
+		c.startCompressing()
+	}
+	return len(p), nil
+}
+
+// ReadFrom passes files straight through when the response is not
+// compressed, so they are still sent with sendfile.
+func (c *compressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if c.status == 0 {
+		c.WriteHeader(200)
+	}
+	if rf, ok := c.ResponseWriter.(io.ReaderFrom); ok && c.decided && c.compressor == nil {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{c}, src)
+}
+
+// Flush sends what the compressor has so far. A handler flushing before the
+// body reached minSize is streaming, and its body is compressed.
+func (c *compressWriter) Flush() {
+	if c.status == 0 {
+		c.WriteHeader(200)
+	}
+	if !c.decided {
+		c.startCompressing()
+	}
+	if c.compressor != nil {
+		c.compressor.Flush()
+	}
+	if f, ok := c.ResponseWriter.(Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack passes through to the wrapped writer: a handler switching
+// protocols sends nothing through this one.
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := hijack(c.ResponseWriter)
+	if err == nil {
+		c.status, c.decided = 101, true
+	}
+	return conn, rw, err
+}
+
+// close completes the response once the handler has returned.
+func (c *compressWriter) close() {
+	switch {
+	case c.compressor != nil:
+		c.compressor.Close() // Writes the footer; the body is incomplete without it
+		c.compressor.Reset(io.Discard)
+		c.encoder.pool.Put(c.compressor)
+		c.compressor = nil
+	case c.status != 0 && !c.decided:
+		// The whole body fit under minSize. Its length is known now, which
+		// spares it the chunked encoding.
+		c.Header().Set("Content-Length", strconv.Itoa(c.buf.Len()))
+		c.passThrough()
+	}
+}
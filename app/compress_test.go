@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing" // The test framework
+)
+
+func TestWarningHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		target      string
+		headers     []string
+		wantWarning string
+	}{
+		{"no acceptable encoding", []string{"-warnings"}, "/echo/hello", []string{"Accept-Encoding: br;q=0, gzip;q=0, identity;q=0"}, `299 my-http-server "Content-Encoding not supported, sent uncompressed"`},
+		{"invalid UTF-8 replaced", []string{"-warnings"}, "/echo/%C3", nil, `214 my-http-server "Transformation Applied: invalid UTF-8 replaced"`},
+		{"nothing degraded", []string{"-warnings"}, "/echo/hello", []string{"Accept-Encoding: gzip"}, ""},
+		{"warnings off", nil, "/echo/%C3", []string{"Accept-Encoding: identity;q=0"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.args...)
+			resp := get(t, s, tt.target, tt.headers...)
+			if resp.status != 200 {
+				t.Fatalf("status = %d, want 200", resp.status)
+			}
+			if got := resp.header.Get("Warning"); got != tt.wantWarning {
+				t.Errorf("Warning = %q, want %q", got, tt.wantWarning)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"  // Used to report invalid config files
+	"flag"    // Settings are applied to the command-line flags
+	"fmt"     // Used to format validation errors
+	"os"      // Used to read the config file
+	"strings" // Used to join list settings
+
+	"gopkg.in/yaml.v3" // Parses YAML, and JSON, which is a subset of it
+)
+
+// envPrefix starts the names of the environment variables that set flags.
+const envPrefix = "HTTP_SERVER_"
+
+// envName returns the environment variable for the flag called name, e.g.
+// HTTP_SERVER_READ_TIMEOUT for -read-timeout.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets the flags of fs not set on the command line from their
+// environment variables (see envName), and adds them to set so a config file
+// does not override them. The repeatable flags take a space-separated list.
+func applyEnv(fs *flag.FlagSet, set map[string]bool) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || set[f.Name] || err != nil {
+			return
+		}
+		set[f.Name] = true
+		if _, repeatable := f.Value.(*stringList); repeatable {
+			for _, item := range strings.Fields(value) {
+				f.Value.Set(item)
+			}
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("%s: invalid value %q: %w", envName(f.Name), value, setErr)
+		}
+	})
+	return err
+}
+
+// loadConfig applies the settings in the config file at path to the flags of
+// fs, except those set on the command line (set), which take precedence.
+//
+// The file is YAML or JSON. Its keys are the flag names, its values what the
+// flags accept; lists are given for the repeatable flags (-proxy, -vhost,
+// -mount) and joined with commas for the comma-separated ones:
+//
+//	port: 8080
+//	directory: /srv/files
+//	read-timeout: 10s
+//	compress-types: [text/*, application/json]
+//	mount: ["/static/=/srv/static", "/docs/=/srv/docs"]
+//	log-format: json
+//
+// Errors point at the line of the offending setting.
+func loadConfig(fs *flag.FlagSet, path string, set map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil // Empty file
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: expected a mapping of settings", path, root.Line)
+	}
+
+	// The content of a mapping node alternates keys and values.
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if err := applySetting(fs, key.Value, value, set, seen); err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", path, key.Line, key.Value, err)
+		}
+	}
+	return nil
+}
+
+// applySetting sets the flag called name to value.
+func applySetting(fs *flag.FlagSet, name string, value *yaml.Node, set, seen map[string]bool) error {
+	f := fs.Lookup(name)
+	if f == nil || name == "config" {
+		return errors.New("unknown setting")
+	}
+	if seen[name] {
+		return errors.New("set twice")
+	}
+	seen[name] = true
+	if set[name] {
+		return nil // The command line wins
+	}
+
+	switch value.Kind {
+	case yaml.ScalarNode:
+		if err := f.Value.Set(value.Value); err != nil {
+			return fmt.Errorf("invalid value %q: %w", value.Value, err)
+		}
+		return nil
+	case yaml.SequenceNode:
+		var items []string
+		for _, item := range value.Content {
+			if item.Kind != yaml.ScalarNode {
+				return errors.New("expected a list of values")
+			}
+			items = append(items, item.Value)
+		}
+		if _, repeatable := f.Value.(*stringList); repeatable {
+			for _, item := range items {
+				f.Value.Set(item)
+			}
+			return nil
+		}
+		if err := f.Value.Set(strings.Join(items, ",")); err != nil {
+			return fmt.Errorf("invalid value %q: %w", strings.Join(items, ","), err)
+		}
+		return nil
+	}
+	return errors.New("expected a value or a list of values")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"       // Used to copy the tunnel's traffic both ways
+	"log/slog" // Used to log tunnels that could not be opened
+	"net"      // Used to dial the target and split host:port
+	"strings"  // Used to match the allowlist
+	"sync"     // Used to wait for both directions of the tunnel
+	"time"     // Used for the dial timeout
+)
+
+// connectDialTimeout is how long a CONNECT waits for the target to accept.
+const connectDialTimeout = 10 * time.Second
+
+// ConnectProxy returns the handler for CONNECT requests (RFC 9110 9.3.6),
+// which makes the server a basic forward proxy: the client names a target
+// ("CONNECT example.com:443 HTTP/1.1"), gets "200 Connection Established",
+// and from then on the connection is a raw tunnel to the target, typically
+// carrying TLS the server cannot see into.
+//
+// Only targets on allow are reachable, anything else gets 403. An entry is
+// "host:port", where the host may be "*" (any) or "*.example.com" (any
+// subdomain) and the port "*" (any), e.g. "*.example.com:443".
+func ConnectProxy(allow []string) HandlerFunc {
+	return func(w ResponseWriter, req *HTTPRequest) {
+		// 1. Check the target. It is an authority ("host:port"), not a path.
+		host, port, err := net.SplitHostPort(req.Path)
+		if err != nil || host == "" || port == "" {
+			sendResponse(w, 400, nil, "")
+			return
+		}
+		if !connectAllowed(allow, host, port) {
+			sendResponse(w, 403, nil, "")
+			return
+		}
+
+		// 2. Reach the target before telling the client the tunnel is open.
+		target, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), connectDialTimeout)
+		if err != nil {
+			slog.Warn("connect to tunnel target failed", "request_id", req.ID, "target", req.Path, "err", err)
+			status := 502
+			if isTimeout(err) {
+				status = 504
+			}
+			sendResponse(w, status, nil, "")
+			return
+		}
+		defer target.Close()
+
+		// 3. Take over the connection and open the tunnel.
+		conn, rw, err := hijack(w)
+		if err != nil {
+			sendResponse(w, 500, nil, "")
+			return
+		}
+		rw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n")
+		if err := rw.Flush(); err != nil {
+			return
+		}
+
+		// 4. Copy both ways until both sides are done. The client's bytes
+		// are read through rw, which may already hold some (e.g. the TLS
+		// ClientHello sent right behind the request).
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			io.Copy(target, rw)
+			closeWrite(target)
+		}()
+		go func() {
+			defer wg.Done()
+			io.Copy(conn, target)
+			closeWrite(conn)
+		}()
+		wg.Wait()
+	}
+}
+
+// connectAllowed reports whether host:port matches an entry of allow.
+func connectAllowed(allow []string, host, port string) bool {
+	for _, entry := range allow {
+		h, p, err := net.SplitHostPort(entry)
+		if err != nil || (p != "*" && p != port) {
+			continue
+		}
+		switch {
+		case h == "*":
+			return true
+		case strings.HasPrefix(h, "*."):
+			if strings.HasSuffix(strings.ToLower(host), strings.ToLower(h[1:])) {
+				return true
+			}
+		case strings.EqualFold(h, host):
+			return true
+		}
+	}
+	return false
+}
+
+// closeWrite tells the other end of conn that nothing more is coming, while
+// still reading what it sends; other connections are closed outright.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
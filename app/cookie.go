@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"  // Used to refuse cookies that cannot be serialized
+	"strconv" // Used to format Max-Age
+	"strings" // Used to split and build cookie headers
+	"time"    // Used for the Expires attribute
+)
+
+// Cookies let a site keep state between otherwise independent requests
+// (RFC 6265). The server sets them with a response header:
+//
+//	Set-Cookie: session=abc123; Path=/; Max-Age=3600; HttpOnly; SameSite=Lax
+//
+// and the browser sends them back, without the attributes, on later requests:
+//
+//	Cookie: session=abc123; theme=dark
+
+// Cookie is a single cookie, as received (Name and Value only) or to be set.
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path    string    // URL path prefix the cookie is sent for, e.g. "/"
+	Domain  string    // Host the cookie is sent to; empty means this host only
+	Expires time.Time // Absolute expiry; zero means none
+
+	// MaxAge is the lifetime in seconds. Zero means no Max-Age attribute (a
+	// session cookie unless Expires is set); negative deletes the cookie now.
+	MaxAge int
+
+	Secure   bool     // Only send over HTTPS
+	HttpOnly bool     // Hide from JavaScript (document.cookie)
+	SameSite SameSite // Whether to send it on cross-site requests
+}
+
+// SameSite controls whether a cookie is sent with cross-site requests.
+type SameSite string
+
+const (
+	SameSiteDefault SameSite = ""       // No attribute: the browser decides (usually Lax)
+	SameSiteLax     SameSite = "Lax"    // Sent on top-level navigations from other sites
+	SameSiteStrict  SameSite = "Strict" // Never sent from other sites
+	SameSiteNone    SameSite = "None"   // Always sent; browsers require Secure too
+)
+
+// errInvalidCookie is returned by SetCookie for a cookie that cannot be
+// written without corrupting the header.
+var errInvalidCookie = errors.New("invalid cookie name or value")
+
+// Cookies returns the cookies sent with the request, in order. Malformed
+// pairs are skipped. If a name appears twice, both are returned; the first is
+// the one with the most specific Path (RFC 6265 5.4).
+func (req *HTTPRequest) Cookies() []Cookie {
+	var cookies []Cookie
+	for _, pair := range strings.Split(req.Header("Cookie"), ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !validCookieName(name) {
+			continue
+		}
+		// Values may be wrapped in double quotes, which are not part of the value.
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if !validCookieValue(value) {
+			continue
+		}
+		cookies = append(cookies, Cookie{Name: name, Value: value})
+	}
+	return cookies
+}
+
+// Cookie returns the value of the cookie called name and whether it was sent.
+func (req *HTTPRequest) Cookie(name string) (string, bool) {
+	for _, c := range req.Cookies() {
+		if c.Name == name {
+			return c.Value, true
+		}
+	}
+	return "", false
+}
+
+// SetCookie adds a Set-Cookie header for c to the response. Call it before
+// WriteHeader (or sendResponse), like any other header. Each call adds one
+// more cookie.
+func SetCookie(w ResponseWriter, c *Cookie) error {
+	value, err := c.headerValue()
+	if err != nil {
+		return err
+	}
+	w.Header().Add("Set-Cookie", value)
+	return nil
+}
+
+// headerValue serializes c as the value of a Set-Cookie header.
+func (c *Cookie) headerValue() (string, error) {
+	if !validCookieName(c.Name) || !validCookieValue(c.Value) {
+		return "", errInvalidCookie
+	}
+	// Attribute values must not be able to start a new attribute or header.
+	for _, attr := range []string{c.Path, c.Domain} {
+		if strings.ContainsAny(attr, ";\r\n") {
+			return "", errInvalidCookie
+		}
+	}
+
+	parts := []string{c.Name + "=" + c.Value}
+	if c.Path != "" {
+		parts = append(parts, "Path="+c.Path)
+	}
+	if c.Domain != "" {
+		parts = append(parts, "Domain="+c.Domain)
+	}
+	if !c.Expires.IsZero() {
+		parts = append(parts, "Expires="+c.Expires.UTC().Format(httpTimeFormat))
+	}
+	if c.MaxAge > 0 {
+		parts = append(parts, "Max-Age="+strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		parts = append(parts, "Max-Age=0")
+	}
+	if c.Secure {
+		parts = append(parts, "Secure")
+	}
+	if c.HttpOnly {
+		parts = append(parts, "HttpOnly")
+	}
+	if c.SameSite != SameSiteDefault {
+		parts = append(parts, "SameSite="+string(c.SameSite))
+	}
+	return strings.Join(parts, "; "), nil
+}
+
+// validCookieName reports whether name is an HTTP token (RFC 9110 5.6.2):
+// visible ASCII except separators such as "=", ";" and spaces.
+func validCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`()<>@,;:\"/[]?={}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validCookieValue reports whether value only uses the characters RFC 6265
+// allows in a cookie value: visible ASCII except '"', ',', ';' and '\'.
+func validCookieValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c <= ' ' || c >= 0x7f || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"slices"  // Used to look for the "*" origin
+	"strconv" // Used to format Access-Control-Max-Age
+	"strings" // Used to match origins and build header lists
+	"time"    // Used for the preflight Max-Age
+)
+
+// Cross-origin resource sharing (CORS, https://fetch.spec.whatwg.org/#http-cors-protocol)
+// lets scripts on other sites call the server. The browser sends the page's
+// Origin with every cross-origin request, and only lets the script see the
+// response if Access-Control-Allow-Origin names that origin (or is "*"). For
+// requests a plain form could not make (PUT, DELETE, JSON bodies, custom
+// headers) it first asks with a "preflight": an OPTIONS request carrying
+// Access-Control-Request-Method and -Headers, answered with what is allowed.
+
+// CORSConfig configures CORS.
+type CORSConfig struct {
+	// AllowedOrigins are the origins allowed to call the server:
+	// "https://example.com", "https://*.example.com" (any subdomain) or "*"
+	// (any origin).
+	AllowedOrigins []string
+	// AllowedMethods are the methods a preflight may ask for; empty allows
+	// those registered for the path, as the Router's automatic OPTIONS
+	// answer lists them (see Router.AutoOptions).
+	AllowedMethods []string
+	// AllowedHeaders are the request headers a preflight may ask for
+	// (case-insensitive); empty allows whatever it asks for.
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers scripts may read besides the
+	// basic ones (Content-Type, Cache-Control, ...), e.g. X-Request-ID.
+	ExposedHeaders []string
+	// AllowCredentials lets requests carry cookies and Authorization. The
+	// origin is then always named, never "*", as browsers require.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight's answer; zero
+	// leaves it to them (a few seconds).
+	MaxAge time.Duration
+}
+
+// CORS returns middleware applying config: it answers preflight requests
+// from allowed origins with 204 (itself, or through the Router's automatic
+// OPTIONS answer when AllowedMethods is empty), and adds the CORS headers to the
+// responses to their other requests. Requests from other origins get no
+// CORS headers, so the browser keeps their responses from the script.
+func CORS(config CORSConfig) Middleware {
+	anyOrigin := slices.Contains(config.AllowedOrigins, "*")
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, req *HTTPRequest) {
+			origin := req.Header("Origin")
+			if origin == "" {
+				next(w, req) // Same-origin, or not from a browser
+				return
+			}
+			// The answer depends on the origin, so caches must keep it apart.
+			w.Header().Add("Vary", "Origin")
+			if !config.allowsOrigin(origin) {
+				next(w, req)
+				return
+			}
+
+			h := w.Header()
+			if anyOrigin && !config.AllowCredentials {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if config.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			// A preflight is not passed to the route: it asks about the
+			// request to come, it is not that request.
+			requestMethod := req.Header("Access-Control-Request-Method")
+			if req.Method != "OPTIONS" || requestMethod == "" {
+				if len(config.ExposedHeaders) > 0 {
+					h.Set("Access-Control-Expose-Headers", strings.Join(config.ExposedHeaders, ", "))
+				}
+				next(w, req)
+				return
+			}
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			if requested := req.Header("Access-Control-Request-Headers"); requested != "" {
+				allowed := requested
+				if len(config.AllowedHeaders) > 0 {
+					allowed = strings.Join(config.AllowedHeaders, ", ")
+				}
+				h.Set("Access-Control-Allow-Headers", allowed)
+			}
+			if config.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(config.MaxAge.Seconds())))
+			}
+			if len(config.AllowedMethods) == 0 {
+				next(w, req) // The Router adds the path's methods
+				return
+			}
+			if containsFold(config.AllowedMethods, requestMethod) {
+				h.Set("Access-Control-Allow-Methods", strings.Join(config.AllowedMethods, ", "))
+			}
+			sendResponse(w, 204, nil, "") // Without Allow-Methods, refused
+		}
+	}
+}
+
+// allowsOrigin reports whether origin matches an entry of AllowedOrigins.
+func (c CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		// "https://*.example.com" matches "https://api.example.com".
+		if scheme, domain, ok := strings.Cut(allowed, "://*."); ok {
+			rest, found := strings.CutPrefix(strings.ToLower(origin), strings.ToLower(scheme)+"://")
+			if found && strings.HasSuffix(rest, "."+strings.ToLower(domain)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containsFold reports whether list contains s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
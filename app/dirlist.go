@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json" // Used for the JSON listing
+	"fmt"           // Used to build the HTML listing
+	"html"          // Used to escape file names in HTML
+	"net/url"       // Used to escape file names in links
+	"os"            // Used to read the directory
+	"path/filepath" // Used to look for index files
+	"sort"          // Used to list entries in a stable order
+	"strings"       // Used to build the HTML listing
+	"time"          // Used for modification times
+)
+
+// dirEntry is one line of a directory listing.
+type dirEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	IsDir   bool      `json:"is_dir"`
+}
+
+// serveDirectory answers a GET for a directory below /files/ with a listing
+// of its contents. Browsers get an HTML page; clients asking for JSON
+// (Accept: application/json, or ?format=json) get an array of dirEntry.
+func (s *Server) serveDirectory(w ResponseWriter, req *HTTPRequest, dir string) {
+	entries, err := s.readDirEntries(dir)
+	if err != nil {
+		sendResponse(w, 404, nil, "")
+		return
+	}
+
+	if req.Query.Get("format") == "json" || strings.Contains(req.Header("Accept"), "application/json") {
+		body, _ := json.Marshal(entries)
+		sendResponse(w, 200, []string{"Content-Type: application/json"}, string(body))
+		return
+	}
+	sendResponse(w, 200, []string{"Content-Type: text/html; charset=utf-8"}, dirListingHTML(req.Path, entries))
+}
+
+// findIndexFile returns the path and details of the first of IndexFiles
+// present in dir, or "" if there is none.
+func (s *Server) findIndexFile(dir string) (string, os.FileInfo) {
+	for _, name := range s.IndexFiles {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, info
+		}
+	}
+	return "", nil
+}
+
+// redirectToSlash sends "/files/docs" to "/files/docs/". Relative links in
+// a directory's page (its listing or index.html) only resolve below the
+// directory from a URL ending in "/", which is why file servers do this.
+func redirectToSlash(w ResponseWriter, req *HTTPRequest) {
+	redirect(w, 301, withQuery(req.RawPath+"/", req.RawQuery))
+}
+
+// readDirEntries returns the contents of dir, directories first, then by
+// name. Dotfiles are left out unless AllowDotfiles is set, since they could
+// not be downloaded anyway.
+func (s *Server) readDirEntries(dir string) ([]dirEntry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]dirEntry, 0, len(files))
+	for _, f := range files {
+		if !s.AllowDotfiles && strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue // Deleted since ReadDir
+		}
+		entry := dirEntry{Name: f.Name(), ModTime: info.ModTime().UTC(), IsDir: info.IsDir()}
+		if !entry.IsDir {
+			entry.Size = info.Size()
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// dirListingHTML renders entries as an HTML page for the directory at path.
+func dirListingHTML(path string, entries []dirEntry) string {
+	var b strings.Builder
+	title := html.EscapeString("Index of " + path)
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"><title>%s</title></head>\n<body>\n<h1>%s</h1>\n", title, title)
+	b.WriteString("<table>\n<tr><th align=\"left\">Name</th><th align=\"right\">Size</th><th align=\"left\">Modified</th></tr>\n")
+	if path != "/files/" {
+		b.WriteString("<tr><td><a href=\"../\">../</a></td><td></td><td></td></tr>\n")
+	}
+	for _, e := range entries {
+		name, size := e.Name, fmt.Sprint(e.Size)
+		if e.IsDir {
+			name, size = name+"/", "-"
+		}
+		// PathEscape also escapes "/", so add the directory slash afterwards.
+		// The "./" keeps a name like "a:b" from being read as a URL scheme.
+		href := "./" + url.PathEscape(e.Name)
+		if e.IsDir {
+			href += "/"
+		}
+		fmt.Fprintf(&b, "<tr><td><a href=\"%s\">%s</a></td><td align=\"right\">%s</td><td>%s</td></tr>\n",
+			html.EscapeString(href), html.EscapeString(name), size, e.ModTime.Format(httpTimeFormat))
+	}
+	b.WriteString("</table>\n</body>\n</html>\n")
+	return b.String()
+}
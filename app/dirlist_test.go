@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json" // Used to decode JSON listings
+	"os"            // Used to fill the served directory
+	"path/filepath" // Used to build paths in the served directory
+	"slices"        // Used to compare listings
+	"testing"       // The test framework
+)
+
+func TestDotfiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		allow      bool
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"dotfile, off", false, "/files/.env", 404, ""},
+		{"dotfile, on", true, "/files/.env", 200, "SECRET=1"},
+		{"inside a dot directory, off", false, "/files/.git/config", 404, ""},
+		{"inside a dot directory, on", true, "/files/.git/config", 200, "[core]"},
+		{"dot directory listing, off", false, "/files/.git/", 404, ""},
+		{"plain file, off", false, "/files/visible.txt", 200, "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{"-enable-dir-listing"}
+			if tt.allow {
+				args = append(args, "-allow-dotfiles")
+			}
+			s := newTestServer(t, args...)
+			os.WriteFile(filepath.Join(s.Dir, ".env"), []byte("SECRET=1"), 0644)
+			os.Mkdir(filepath.Join(s.Dir, ".git"), 0755)
+			os.WriteFile(filepath.Join(s.Dir, ".git", "config"), []byte("[core]"), 0644)
+			os.WriteFile(filepath.Join(s.Dir, "visible.txt"), []byte("hello"), 0644)
+
+			resp := get(t, s, tt.target)
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.status, tt.wantStatus)
+			}
+			if tt.wantBody != "" && resp.body != tt.wantBody {
+				t.Errorf("body = %q, want %q", resp.body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestDirListingHidesDotfiles(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		args := []string{"-enable-dir-listing"}
+		want := []string{"visible.txt"}
+		if allow {
+			args = append(args, "-allow-dotfiles")
+			want = []string{".env", "visible.txt"}
+		}
+		s := newTestServer(t, args...)
+		os.WriteFile(filepath.Join(s.Dir, ".env"), []byte("SECRET=1"), 0644)
+		os.WriteFile(filepath.Join(s.Dir, "visible.txt"), []byte("hello"), 0644)
+
+		resp := get(t, s, "/files/?format=json")
+		var entries []dirEntry
+		if err := json.Unmarshal([]byte(resp.body), &entries); err != nil {
+			t.Fatalf("-allow-dotfiles=%v: %v in %q", allow, err, resp.body)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		if !slices.Equal(names, want) {
+			t.Errorf("-allow-dotfiles=%v: listed %v, want %v", allow, names, want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io"      // Compressors are io.WriteClosers
+	"os"      // Used to look for precompressed files
+	"strconv" // Used to parse q-values
+	"strings" // Used to split the Accept-Encoding header
+	"sync"    // Each encoding has a pool of compressors
+)
+
+// compressor is what gzip.Writer, brotli.Writer and zstd.Encoder have in
+// common: Reset points one at a new destination so it can be pooled.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// contentEncoder compresses response bodies in one Content-Encoding.
+type contentEncoder struct {
+	coding string     // The Content-Encoding value, e.g. "br"
+	pool   *sync.Pool // Of compressors for it
+}
+
+// contentEncoders are the encodings responses can be compressed with, best
+// first: brotli and zstd both make smaller bodies than gzip, which is kept
+// for the clients that support nothing else.
+var contentEncoders = []*contentEncoder{
+	{"br", &brotliPool},
+	{"zstd", &zstdPool},
+	{"gzip", &gzipPool},
+}
+
+// chooseEncoder returns the encoder for the encoding the client prefers, or
+// nil if the body should be sent as is. ok is false if the client refuses
+// every encoding, identity included.
+func chooseEncoder(req *HTTPRequest) (e *contentEncoder, ok bool) {
+	offers := make([]string, 0, len(contentEncoders)+1)
+	for _, e := range contentEncoders {
+		offers = append(offers, e.coding)
+	}
+	coding := negotiateEncoding(req, append(offers, "identity"))
+	for _, e := range contentEncoders {
+		if e.coding == coding {
+			return e, true
+		}
+	}
+	return nil, coding != ""
+}
+
+// negotiateEncoding returns the coding among offers, best first, that the
+// client's Accept-Encoding header rates highest (RFC 9110 12.5.3), or "" if
+// it refuses them all. Each coding may carry a q-value from 0 to 1 (1 if
+// omitted), where 0 refuses it; ties go to the earlier offer:
+//
+//	Accept-Encoding: gzip;q=0.8, br      br
+//	Accept-Encoding: gzip, identity;q=0  gzip, never uncompressed
+//	Accept-Encoding: *;q=0.5, gzip;q=0   anything but gzip
+//
+// Without the header only "identity" is chosen: the client most likely
+// can't decode anything else, whatever the RFC allows.
+func negotiateEncoding(req *HTTPRequest, offers []string) string {
+	prefs := encodingPreferences(req.Header("Accept-Encoding"))
+	if len(req.Headers.Values("Accept-Encoding")) == 0 {
+		prefs = map[string]float64{"identity": 1}
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range offers {
+		if q := encodingQuality(prefs, coding); q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// encodingPreferences parses an Accept-Encoding value, e.g.
+// "gzip;q=0.8, br", into the q-value of each coding listed (lowercased, "*"
+// included). Entries with an invalid q-value are ignored.
+func encodingPreferences(header string) map[string]float64 {
+	prefs := make(map[string]float64)
+	for _, item := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		prefs[name] = q
+	}
+	return prefs
+}
+
+// encodingQuality returns the q-value prefs give coding: its own, else that
+// of "*". identity is acceptable unless refused by either (RFC 9110
+// 12.5.3), but as a last resort: "gzip;q=0.5" still means gzip is wanted.
+// Any other coding not listed is not acceptable.
+func encodingQuality(prefs map[string]float64, coding string) float64 {
+	if q, ok := prefs[coding]; ok {
+		return q
+	}
+	if q, ok := prefs["*"]; ok {
+		return q
+	}
+	if coding == "identity" {
+		return 0.001 // The lowest q-value that still accepts it
+	}
+	return 0
+}
+
+// precompressedVariants are the files looked for next to a requested file,
+// in order of preference: brotli compresses text better than gzip.
+var precompressedVariants = []struct {
+	suffix, coding string
+}{
+	{".br", "br"},
+	{".gz", "gzip"},
+}
+
+// findPrecompressed looks for compressed copies of the file at path, made
+// ahead of time (e.g. "app.js.br" by a build step), and returns the path,
+// coding and details of the one the client prefers, or "" if it prefers the
+// file itself.
+// vary reports whether any copy exists at all, in which case the response
+// depends on Accept-Encoding whichever file is sent.
+func findPrecompressed(req *HTTPRequest, path string) (variant, coding string, info os.FileInfo, vary bool) {
+	var offers []string
+	infos := make(map[string]os.FileInfo)
+	for _, v := range precompressedVariants {
+		vinfo, err := os.Stat(path + v.suffix)
+		if err != nil || vinfo.IsDir() {
+			continue
+		}
+		offers = append(offers, v.coding)
+		infos[v.coding] = vinfo
+	}
+	if len(offers) == 0 {
+		return "", "", nil, false
+	}
+
+	// A client refusing everything, identity included, still gets the file
+	// as is rather than a 406 (RFC 9110 12.5.3).
+	coding = negotiateEncoding(req, append(offers, "identity"))
+	for _, v := range precompressedVariants {
+		if v.coding == coding {
+			return path + v.suffix, coding, infos[coding], true
+		}
+	}
+	return "", "", nil, true
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"         // Used by Hijack
+	"encoding/json" // Used for JSON error pages
+	"fmt"           // Used to build the HTML error page
+	"html"          // Used to escape the reason phrase
+	"io"            // Used by ReadFrom
+	"net"           // Used by Hijack
+	"os"            // Used to read custom error pages
+	"path/filepath" // Used to locate custom error pages
+	"strconv"       // Used to name custom error pages by status
+	"strings"       // Used to check the Accept header
+)
+
+// Error pages replace the empty body of error responses (the Router's 404
+// and 405, a handler's bare 403, the 503 of maintenance mode, ...) with a
+// page for humans or programs: see Router.HandleError. Responses that have
+// a body of their own are left alone.
+
+// ErrorHandlerFunc writes the page for an error response with the given
+// status. It must send that status: the headers set for the bare response
+// (e.g. Allow for 405, Retry-After for 503) are already in w.Header().
+type ErrorHandlerFunc func(w ResponseWriter, req *HTTPRequest, status int)
+
+// errorPageWriter wraps a ResponseWriter to send the Router's error page
+// instead of an empty error response.
+type errorPageWriter struct {
+	ResponseWriter
+	req      *HTTPRequest
+	router   *Router
+	replaced bool
+}
+
+// WriteHeader sends the error page when status has one and no body follows.
+func (e *errorPageWriter) WriteHeader(status int) {
+	h := e.Header()
+	page := e.router.errorHandler(status)
+	if page == nil || e.replaced || h.Get("Content-Length") != "0" {
+		e.ResponseWriter.WriteHeader(status)
+		return
+	}
+	e.replaced = true
+	h.Del("Content-Length")
+	h.Del("Content-Type")
+	page(e.ResponseWriter, e.req, status)
+}
+
+// Write passes the body through, unless it was replaced by an error page.
+func (e *errorPageWriter) Write(p []byte) (int, error) {
+	if e.replaced {
+		return len(p), nil
+	}
+	return e.ResponseWriter.Write(p)
+}
+
+// ReadFrom passes through to the wrapped writer, when it has one, so that
+// files are still sent with sendfile.
+func (e *errorPageWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := e.ResponseWriter.(io.ReaderFrom)
+	if !ok || e.replaced {
+		return io.Copy(writerOnly{e}, src)
+	}
+	return rf.ReadFrom(src)
+}
+
+// Flush passes through to the wrapped writer so streaming keeps working.
+func (e *errorPageWriter) Flush() {
+	if f, ok := e.ResponseWriter.(Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack passes through to the wrapped writer, so WebSockets keep working.
+func (e *errorPageWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(e.ResponseWriter)
+}
+
+// ErrorPage returns an ErrorHandlerFunc that answers with a page from dir:
+// "404.json" for clients asking for JSON (Accept: application/json), else
+// "404.html", for a 404. Statuses without a file there, or every status
+// when dir is "", get a generated page:
+//
+//	{"status":404,"error":"Not Found"}
+//
+// or its HTML equivalent.
+func ErrorPage(dir string) ErrorHandlerFunc {
+	return func(w ResponseWriter, req *HTTPRequest, status int) {
+		ext, contentType := ".html", "text/html; charset=utf-8"
+		if strings.Contains(req.Header("Accept"), "application/json") {
+			ext, contentType = ".json", "application/json"
+		}
+
+		var body string
+		if dir != "" {
+			if data, err := os.ReadFile(filepath.Join(dir, strconv.Itoa(status)+ext)); err == nil {
+				body = string(data)
+			}
+		}
+		if body == "" && ext == ".json" {
+			data, _ := json.Marshal(map[string]any{"status": status, "error": statusText[status]})
+			body = string(data)
+		}
+		if body == "" {
+			title := html.EscapeString(statusLine(status))
+			body = fmt.Sprintf("<!DOCTYPE html>\n<html><head><title>%s</title></head>\n<body><h1>%s</h1></body></html>\n", title, title)
+		}
+
+		headerLines := []string{
+			"Content-Type: " + contentType,
+			"Content-Length: " + strconv.Itoa(len(body)),
+		}
+		sendResponse(w, status, headerLines, body)
+	}
+}
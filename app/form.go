@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"         // Used to report malformed form bodies
+	"io"             // Used to read multipart parts
+	"mime"           // Used to parse the Content-Type header and its boundary
+	"mime/multipart" // Used to split multipart/form-data bodies into parts
+	"net/url"        // Used to decode application/x-www-form-urlencoded bodies
+	"strings"        // Used to wrap the body in a reader
+)
+
+// FormFile is a file uploaded through a multipart/form-data form,
+// e.g. <input type="file" name="upload">.
+type FormFile struct {
+	FieldName   string // The form field name ("upload")
+	Filename    string // The name of the file on the client's machine
+	ContentType string // The part's Content-Type, if the browser sent one
+	Data        []byte // The raw file contents
+}
+
+// ParseForm decodes the body of form submissions based on the Content-Type:
+//   - application/x-www-form-urlencoded fills req.Form
+//   - multipart/form-data fills req.Form with the text fields and req.Files
+//     with the uploaded files (several per field with <input multiple>)
+//
+// Other content types are left untouched. It is safe to call more than once.
+func (req *HTTPRequest) ParseForm() error {
+	if req.formParsed {
+		return nil
+	}
+	req.formParsed = true
+	req.Form = url.Values{}
+
+	mediaType, params, err := mime.ParseMediaType(req.Header("Content-Type"))
+	if err != nil {
+		// No (or an unparseable) Content-Type: the body is not a form.
+		return nil
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		// The body uses the same "a=1&b=2" encoding as a query string.
+		form, err := url.ParseQuery(req.Body)
+		if err != nil {
+			return err
+		}
+		req.Form = form
+
+	case "multipart/form-data":
+		boundary := params["boundary"]
+		if boundary == "" {
+			return errors.New("multipart body without boundary")
+		}
+		return req.parseMultipart(boundary)
+	}
+
+	return nil
+}
+
+// baseName returns the file name of an upload without any directory part.
+// Browsers send just the name, but some older ones send the full client
+// path ("C:\\Users\\me\\a.txt"), which must not become a path on our side.
+func (f *FormFile) baseName() string {
+	name := f.Filename
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// parseMultipart walks the parts of a multipart/form-data body. Each part is
+// separated by "--<boundary>" and has its own headers, e.g.
+//
+//	--XyZ
+//	Content-Disposition: form-data; name="upload"; filename="a.txt"
+//	Content-Type: text/plain
+//
+//	hello
+//	--XyZ--
+func (req *HTTPRequest) parseMultipart(boundary string) error {
+	mr := multipart.NewReader(strings.NewReader(req.Body), boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return err
+		}
+
+		if part.FileName() == "" {
+			// A regular text field.
+			req.Form.Add(part.FormName(), string(data))
+		} else {
+			req.Files = append(req.Files, &FormFile{
+				FieldName:   part.FormName(),
+				Filename:    part.FileName(),
+				ContentType: part.Header.Get("Content-Type"),
+				Data:        data,
+			})
+			req.File = req.Files[0]
+		}
+		part.Close()
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"     // Used to report invalid prefixes
+	"strings" // Used to join prefixes and patterns
+)
+
+// Group registers routes on a Router under a shared path prefix, wrapped in
+// shared middleware, so that a larger API need not repeat them:
+//
+//	api := router.Group("/api/v1")
+//	api.Use(JWTAuth(config))
+//	api.Get("/users/{id}", getUser)    // GET /api/v1/users/{id}, authenticated
+//	admin := api.Group("/admin")       // /api/v1/admin/..., authenticated too
+//
+// Unlike Router.Use, a group's middleware only runs for the requests routed
+// to its routes, after routing, so req.Params is set.
+type Group struct {
+	router     *Router
+	parent     *Group
+	prefix     string
+	middleware []Middleware
+}
+
+// Group returns a group of routes under prefix (e.g. "/api/v1"), or the
+// routes it is given as they are for "". It panics if prefix does not start
+// with "/", since that is a programming error.
+func (r *Router) Group(prefix string) *Group {
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		panic(fmt.Sprintf("router: group prefix %q must start with /", prefix))
+	}
+	return &Group{router: r, prefix: strings.TrimSuffix(prefix, "/")}
+}
+
+// Group returns a group nested in g: its routes are under g's prefix
+// followed by prefix, and run g's middleware before their own.
+func (g *Group) Group(prefix string) *Group {
+	sub := g.router.Group(prefix)
+	sub.parent = g
+	sub.prefix = g.prefix + sub.prefix
+	return sub
+}
+
+// Use adds middleware that runs on the requests routed to the group's
+// routes, including those registered before, in the order it was added.
+func (g *Group) Use(mw Middleware) {
+	g.middleware = append(g.middleware, mw)
+}
+
+// pattern returns the pattern a route of the group is registered with:
+// "/users" becomes "/api/v1/users", and "" the prefix itself.
+func (g *Group) pattern(pattern string) string {
+	if pattern == "" && g.prefix != "" {
+		return g.prefix
+	}
+	return g.prefix + pattern
+}
+
+// wrap runs handler behind the middleware of g and of the groups it is in,
+// outermost first. The chain is built for each request, so that middleware
+// added later applies too.
+func (g *Group) wrap(handler HandlerFunc) HandlerFunc {
+	return func(w ResponseWriter, req *HTTPRequest) {
+		h := handler
+		for group := g; group != nil; group = group.parent {
+			for i := len(group.middleware) - 1; i >= 0; i-- {
+				h = group.middleware[i](h)
+			}
+		}
+		h(w, req)
+	}
+}
+
+// Handle registers handler for requests with the given method and path
+// pattern, below the group's prefix.
+func (g *Group) Handle(method, pattern string, handler HandlerFunc) {
+	g.router.Handle(method, g.pattern(pattern), g.wrap(handler))
+}
+
+// HandleStream is like Handle, with the body streamed as for
+// Router.HandleStream.
+func (g *Group) HandleStream(method, pattern string, handler HandlerFunc) {
+	g.router.HandleStream(method, g.pattern(pattern), g.wrap(handler))
+}
+
+// Get registers a handler for GET requests.
+func (g *Group) Get(pattern string, handler HandlerFunc) {
+	g.Handle("GET", pattern, handler)
+}
+
+// Post registers a handler for POST requests.
+func (g *Group) Post(pattern string, handler HandlerFunc) {
+	g.Handle("POST", pattern, handler)
+}
+
+// Put registers a handler for PUT requests.
+func (g *Group) Put(pattern string, handler HandlerFunc) {
+	g.Handle("PUT", pattern, handler)
+}
+
+// Delete registers a handler for DELETE requests.
+func (g *Group) Delete(pattern string, handler HandlerFunc) {
+	g.Handle("DELETE", pattern, handler)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"           // The connection's reader may hold the client's first frames
+	"bytes"           // Used to hand the upgrade request's body to http2
+	"context"         // Used for the upgrade request
+	"crypto/tls"      // h2c is for cleartext connections only
+	"encoding/base64" // Used to decode HTTP2-Settings
+	"errors"          // Used to recognise oversized bodies
+	"fmt"             // Used to log handler panics
+	"io"              // Used to read request bodies
+	"log/slog"        // Used to log HTTP/2 errors
+	"net"             // The connection handed to the HTTP/2 server
+	"net/http"        // http2 speaks in net/http types
+	"runtime/debug"   // Used to log the stack trace of a panicking handler
+	"strconv"         // Used to format Content-Length
+	"strings"         // Used to split header lines
+	"time"            // Used to lift the connection deadlines
+
+	"golang.org/x/net/http2" // Framing, HPACK and flow control
+)
+
+// h2Preface is the head of the HTTP/2 connection preface, as readHead returns
+// it: a client with prior knowledge starts with it instead of a request. The
+// rest of the preface, "SM\r\n\r\n", follows (RFC 9113 3.4).
+const h2Preface = "PRI * HTTP/2.0\r\n\r\n"
+
+// HTTP/2 over cleartext TCP ("h2c") is offered two ways (RFC 7540 3.2 and
+// 3.4, the upgrade being dropped by RFC 9113 but still used):
+//   - prior knowledge: the client starts the connection with the preface
+//     (curl --http2-prior-knowledge);
+//   - upgrade: an HTTP/1.1 request with "Upgrade: h2c" and HTTP2-Settings
+//     is answered with 101 and the connection continues in HTTP/2, the
+//     request becoming stream 1 (curl --http2).
+//
+// The framing, header compression and flow control are golang.org/x/net's
+// http2.Server. Every stream is turned into an HTTPRequest and served by
+// the Router as usual, so handlers and middleware do not know the
+// difference, except that req.Version is "HTTP/2.0".
+
+// serveH2C serves HTTP/2 on conn, from the point where reader has consumed
+// the preface's head. It returns when the connection is done.
+func (s *Server) serveH2C(conn net.Conn, reader *bufio.Reader, clientAddr net.Addr) {
+	rest := make([]byte, len("SM\r\n\r\n"))
+	if _, err := io.ReadFull(reader, rest); err != nil || string(rest) != "SM\r\n\r\n" {
+		slog.Warn("invalid HTTP/2 preface", "remote_addr", clientAddr.String())
+		return
+	}
+	s.serveHTTP2(conn, reader, clientAddr, &http2.ServeConnOpts{SawClientPreface: true})
+}
+
+// wantsH2C reports whether req asks to upgrade a cleartext connection to
+// HTTP/2 and can be, returning the decoded HTTP2-Settings. Over TLS the
+// protocol is chosen with ALPN instead, and the upgrade is ignored.
+func wantsH2C(conn net.Conn, req *HTTPRequest) ([]byte, bool) {
+	if _, isTLS := conn.(*tls.Conn); isTLS || req.isHTTP10() ||
+		!hasToken(req.Header("Upgrade"), "h2c") || !hasToken(req.Header("Connection"), "HTTP2-Settings") {
+		return nil, false
+	}
+	values := req.Headers.Values("HTTP2-Settings")
+	if len(values) != 1 {
+		return nil, false
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
+	if err != nil {
+		return nil, false
+	}
+	return settings, true
+}
+
+// upgradeH2C switches the connection req arrived on to HTTP/2 and serves
+// req as its stream 1. Its body must have been read into req.Body.
+func (s *Server) upgradeH2C(conn net.Conn, reader *bufio.Reader, req *HTTPRequest, settings []byte, clientAddr net.Addr) {
+	upgrade, err := http.NewRequestWithContext(context.Background(), req.Method,
+		"http://"+req.Header("Host")+req.RawPath, bytes.NewReader([]byte(req.Body)))
+	if err != nil {
+		w := newResponse(conn, &HTTPRequest{Close: true})
+		sendResponse(w, 400, nil, "")
+		w.finish()
+		return
+	}
+	upgrade.URL.RawQuery = req.RawQuery
+	for name, values := range req.Headers {
+		upgrade.Header[name] = values
+	}
+	upgrade.ContentLength = int64(len(req.Body))
+	upgrade.RemoteAddr = clientAddr.String()
+
+	if err := writeFull(conn, []byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")); err != nil {
+		return
+	}
+	s.serveHTTP2(conn, reader, clientAddr, &http2.ServeConnOpts{UpgradeRequest: upgrade, Settings: settings})
+}
+
+// serveHTTP2 runs the HTTP/2 server on conn with opts until the client is
+// done with it.
+func (s *Server) serveHTTP2(conn net.Conn, reader *bufio.Reader, clientAddr net.Addr, opts *http2.ServeConnOpts) {
+	// HTTP/2 keeps the connection open between streams itself, and closes
+	// it after IdleTimeout.
+	conn.SetDeadline(time.Time{})
+	h2 := &http2.Server{IdleTimeout: s.IdleTimeout}
+	opts.Handler = s.h2Handler(clientAddr)
+	opts.BaseConfig = &http.Server{
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	h2.ServeConn(&bufferedConn{Conn: conn, r: reader}, opts)
+}
+
+// bufferedConn reads through r, which may already hold the first frames.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// h2Handler returns the handler http2.Server calls for each stream: it runs
+// the same checks and Router as an HTTP/1.1 request would go through.
+func (s *Server) h2Handler(clientAddr net.Addr) http.Handler {
+	return http.HandlerFunc(func(hw http.ResponseWriter, r *http.Request) {
+		s := s.current() // Each stream gets the latest reload
+		req := s.h2Request(r, clientAddr)
+		w := &h2ResponseWriter{hw: hw, req: req, header: make(Header)}
+		totalRequests.Add(1)
+
+		if status, headers := s.rejectRequest("", req); status != 0 {
+			sendResponse(w, status, headers, "")
+			return
+		}
+
+		// The body is framed by HTTP/2, but the size limit still applies.
+		body := io.Reader(r.Body)
+		if s.MaxRequestBytes > 0 {
+			body = &maxBytesReader{r: body, left: s.MaxRequestBytes}
+		}
+		if s.routerFor(req).streamsBody(req) {
+			req.BodyReader = bodyErrorReader{body}
+		} else {
+			data, err := io.ReadAll(body)
+			if err != nil {
+				status := 400
+				if errors.Is(err, errBodyTooLarge) {
+					status = 413
+				}
+				sendResponse(w, status, nil, "")
+				return
+			}
+			req.Body = string(data)
+		}
+
+		// Like serveRequest: a panicking handler costs its stream a 500,
+		// not the whole connection.
+		defer func() {
+			if v := recover(); v != nil {
+				if v == errAborted {
+					panic(http.ErrAbortHandler) // Resets the stream
+				}
+				slog.Error("handler panicked",
+					"request_id", req.ID,
+					"method", req.Method,
+					"path", req.Path,
+					"remote_addr", clientAddr.String(),
+					"panic", fmt.Sprint(v),
+					"stack", string(debug.Stack()),
+				)
+				if !w.wroteHeader {
+					sendResponse(w, 500, nil, "")
+				} else {
+					panic(http.ErrAbortHandler) // Resets the stream
+				}
+			}
+		}()
+		s.routerFor(req).ServeRequest(w, req)
+	})
+}
+
+// h2Request turns the request of an HTTP/2 stream into an HTTPRequest.
+func (s *Server) h2Request(r *http.Request, clientAddr net.Addr) *HTTPRequest {
+	req := &HTTPRequest{
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		RawPath:      r.URL.EscapedPath(),
+		RawQuery:     r.URL.RawQuery,
+		Query:        r.URL.Query(),
+		Version:      "HTTP/2.0",
+		Headers:      make(Header),
+		Timing:       &ServerTiming{},
+		RemoteAddr:   clientAddr.String(),
+		emitWarnings: s.EmitWarnings,
+	}
+	for name, values := range r.Header {
+		for _, value := range values {
+			req.Headers.Add(name, value)
+		}
+	}
+	// HTTP/2 sends these as the :authority pseudo-header and DATA frames.
+	if r.Host != "" && !req.Headers.Has("Host") {
+		req.Headers.Set("Host", r.Host)
+	}
+	if r.ContentLength > 0 && !req.Headers.Has("Content-Length") {
+		req.Headers.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	}
+
+	req.ID = req.Header("X-Request-ID")
+	if !validRequestID(req.ID) {
+		req.ID = newRequestID()
+	}
+	return req
+}
+
+// h2ResponseWriter is the ResponseWriter for a request on an HTTP/2 stream,
+// writing through net/http's.
+type h2ResponseWriter struct {
+	hw          http.ResponseWriter
+	req         *HTTPRequest
+	header      Header
+	wroteHeader bool
+}
+
+// hopByHopHeaders are meaningless in HTTP/2, which manages the connection
+// and framing itself, and must not be sent (RFC 9113 8.2.2).
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+// Header returns the headers that WriteHeader will send.
+func (w *h2ResponseWriter) Header() Header {
+	return w.header
+}
+
+// WriteHeader sends the headers, with the same additions buildHead makes
+// for HTTP/1.1.
+func (w *h2ResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		slog.Warn("superfluous WriteHeader call ignored", "request_id", w.req.ID, "status", status)
+		return
+	}
+	w.wroteHeader = true
+
+	for _, name := range hopByHopHeaders {
+		w.header.Del(name)
+	}
+	h := w.hw.Header()
+	for _, line := range responseHeaderLines(w.req, w.header) {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			h.Add(name, strings.TrimSpace(value))
+		}
+	}
+	w.hw.WriteHeader(status)
+}
+
+// Write sends part of the body, sending the headers first if needed.
+func (w *h2ResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	return w.hw.Write(p)
+}
+
+// Flush sends what has been written so far in DATA frames.
+func (w *h2ResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	if f, ok := w.hw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,743 @@
+package main
+
+import (
+	"compress/gzip" // Used to compress data using the GZIP algorithm
+	"errors"        // Used to classify Range header errors
+	"fmt"           // Used to format header values
+	"io"            // Used to stream file contents
+	"io/fs"         // Used to recognise missing files
+	"mime"          // Used to recognise form uploads
+	"os"            // Used for file I/O
+	"path/filepath" // Used to construct file paths safely across OSs
+	"runtime"       // Used to report the goroutine count
+	"strings"       // Used for string manipulation (prefix trimming, header checks)
+	"time"          // Used to report uptime
+	"unicode/utf8"  // Used to validate echoed content
+)
+
+// registerRoutes wires every endpoint of the server into its Router.
+func (s *Server) registerRoutes() {
+	// Logging comes first so refused requests are logged too.
+	s.Router.Use(RequestLog())
+	if s.AccessLog != nil {
+		s.Router.Use(AccessLog(s.AccessLog, s.AccessLogCombined))
+	}
+	if s.Metrics != nil {
+		s.Router.Use(s.Metrics.Instrument())
+	}
+	if s.ErrorPages {
+		s.Router.HandleError(0, ErrorPage(s.ErrorPagesDir))
+	}
+	s.Router.Use(Maintenance())
+	if s.CORS != nil {
+		s.Router.Use(CORS(*s.CORS))
+	}
+	if s.RateLimit > 0 {
+		s.Router.Use(RateLimit(s.RateLimit, s.RateBurst))
+	}
+	if len(s.Redirects) > 0 {
+		s.Router.Use(Redirects(s.Redirects))
+	}
+	// Last, so the logs and metrics above count the compressed bytes sent.
+	if s.Compress {
+		s.Router.Use(Compress(s.CompressMinSize, s.CompressTypes))
+	}
+
+	for _, rule := range s.Rewrites {
+		s.Router.Rewrite(rule.Pattern, rule.Replacement)
+	}
+
+	s.Router.Get("/", s.rootHandler)
+	s.Router.Get("/echo/{msg...}", Cached(s.CacheTTL, s.echoHandler))
+	s.Router.Get("/user-agent", s.userAgentHandler)
+	s.Router.Get("/health", s.healthHandler)
+	s.Router.Get("/healthz", healthzHandler)
+	s.Router.Get("/readyz", s.readyzHandler)
+	s.Router.Get("/files/{name...}", s.getFileHandler)
+	// Uploads are streamed to disk rather than held in memory.
+	s.Router.HandleStream("POST", "/files/{name...}", s.requireAuth(s.createFileHandler))
+	s.Router.HandleStream("PUT", "/files/{name...}", s.requireAuth(s.putFileHandler))
+	s.Router.Delete("/files/{name...}", s.requireAuth(s.deleteFileHandler))
+	for prefix, dir := range s.Mounts {
+		mount := *s
+		mount.Dir = dir
+		s.Router.Get(strings.TrimSuffix(prefix, "/")+"/{name...}", mount.getFileHandler)
+	}
+	for _, p := range s.Proxies {
+		p.register(s.Router)
+	}
+	if len(s.ConnectAllow) > 0 {
+		s.Router.Connect = ConnectProxy(s.ConnectAllow)
+	}
+	s.Router.Get("/admin/reload", s.requireAuth(reloadStatusHandler))
+	if s.Metrics != nil && s.MetricsPath != "" {
+		s.Router.Get(s.MetricsPath, s.Metrics.Handler())
+	}
+	if s.Debug {
+		s.registerDebugRoutes()
+	}
+}
+
+// requireAuth protects handler with bearer tokens when JWT is configured,
+// with Basic authentication when Credentials are, and leaves it open otherwise.
+func (s *Server) requireAuth(handler HandlerFunc) HandlerFunc {
+	switch {
+	case s.JWT != nil:
+		return JWTAuth(*s.JWT)(handler)
+	case len(s.Credentials) > 0:
+		return BasicAuth("my-http-server", StaticCredentials(s.Credentials))(handler)
+	default:
+		return handler
+	}
+}
+
+// --- ROOT ENDPOINT ---
+func (s *Server) rootHandler(w ResponseWriter, req *HTTPRequest) {
+	sendResponse(w, 200, nil, "")
+}
+
+// --- ECHO ENDPOINT ---
+// GET /echo/{msg} returns {msg} as the body.
+func (s *Server) echoHandler(w ResponseWriter, req *HTTPRequest) {
+	content := req.Params["msg"]
+
+	// Never reflect malformed UTF-8 (e.g. a truncated multibyte sequence)
+	// back to the client as text/plain.
+	if !utf8.ValidString(content) {
+		if s.EchoInvalidUTF8 == "reject" {
+			sendResponse(w, 400, nil, "")
+			return
+		}
+		content = strings.ToValidUTF8(content, string(utf8.RuneError))
+		req.AddWarning(214, "Transformation Applied: invalid UTF-8 replaced")
+	}
+
+	// The Compress middleware compresses it for clients that accept it.
+	headerLines := []string{
+		"Content-Type: text/plain",
+		fmt.Sprintf("Content-Length: %d", len(content)),
+	}
+
+	sendResponse(w, 200, headerLines, content)
+}
+
+// --- USER-AGENT ENDPOINT ---
+// GET /user-agent returns the client's User-Agent header as the body.
+func (s *Server) userAgentHandler(w ResponseWriter, req *HTTPRequest) {
+	userAgent := req.Header("User-Agent")
+
+	headerLines := []string{
+		"Content-Type: text/plain",
+		fmt.Sprintf("Content-Length: %d", len(userAgent)),
+	}
+
+	sendResponse(w, 200, headerLines, userAgent)
+}
+
+// --- HEALTH ENDPOINT ---
+// Used by load balancers and monitoring to check that the server is alive.
+// The goroutine count doubles as a leak detector: after a burst of traffic
+// has finished it should drop back to its idle baseline, since every
+// connection goroutine must exit once its client is gone.
+func (s *Server) healthHandler(w ResponseWriter, req *HTTPRequest) {
+	body := fmt.Sprintf(`{"status":"ok","uptime_seconds":%.3f,"total_requests":%d,"goroutines":%d}`,
+		time.Since(startTime).Seconds(), totalRequests.Load(), runtime.NumGoroutine())
+
+	headerLines := []string{
+		"Content-Type: application/json",
+		fmt.Sprintf("Content-Length: %d", len(body)),
+	}
+
+	sendResponse(w, 200, headerLines, body)
+}
+
+// --- FILE HANDLING ENDPOINT: GET ---
+// GET /files/{name} returns the contents of {name} inside the served directory.
+func (s *Server) getFileHandler(w ResponseWriter, req *HTTPRequest) {
+	fullPath, ok := s.resolveFilePath(req.Params["name"])
+	if !ok {
+		sendResponse(w, 404, nil, "")
+		return
+	}
+
+	// 1. Stat the file first: everything needed to answer a conditional
+	// request (size, modification time) comes from metadata, so a 304 never
+	// touches the file contents.
+	info, err := os.Stat(fullPath)
+	if err != nil && s.SPAFallback != "" {
+		// Single-page apps route on the client: "/files/users/42" is a page
+		// of the app, not a file, so it gets the app's entry point.
+		fullPath = filepath.Join(s.Dir, s.SPAFallback)
+		info, err = os.Stat(fullPath)
+	}
+	if err != nil {
+		sendResponse(w, 404, nil, "")
+		return
+	}
+	// A directory is served as its index file (index.html) if it has one,
+	// or else as a listing of its contents, if enabled.
+	if info.IsDir() {
+		index, indexInfo := s.findIndexFile(fullPath)
+		switch {
+		case index == "" && !s.DirListing:
+			sendResponse(w, 404, nil, "")
+			return
+		case !strings.HasSuffix(req.Path, "/"):
+			redirectToSlash(w, req)
+			return
+		case index == "":
+			s.serveDirectory(w, req, fullPath)
+			return
+		}
+		fullPath, info = index, indexInfo
+	}
+
+	// The type is that of the requested file, even when a compressed copy
+	// of it is sent instead: "app.js.br" still holds JavaScript.
+	requestedPath := fullPath
+	var encodingHeaders []string
+	if s.Precompressed {
+		variant, coding, variantInfo, vary := findPrecompressed(req, fullPath)
+		if vary {
+			encodingHeaders = append(encodingHeaders, "Vary: Accept-Encoding")
+		}
+		if variant != "" {
+			fullPath, info = variant, variantInfo
+			encodingHeaders = append(encodingHeaders, "Content-Encoding: "+coding)
+		}
+	}
+
+	// Each variant has its own size and mtime, and so its own ETag.
+	etag := fileETag(info)
+	validators := []string{
+		"ETag: " + etag,
+		"Last-Modified: " + info.ModTime().UTC().Format(httpTimeFormat),
+	}
+	validators = append(validators, encodingHeaders...)
+
+	// 2. Conditional GET: the client already has this version cached.
+	// If-None-Match is the more precise check, so when it is present
+	// If-Modified-Since is ignored (RFC 9110 13.2.2).
+	notModified := false
+	if inm := req.Header("If-None-Match"); inm != "" {
+		notModified = etagMatches(inm, etag)
+	} else {
+		notModified = notModifiedSince(req, info.ModTime())
+	}
+	if notModified {
+		sendResponse(w, 304, validators, "")
+		return
+	}
+	// A file without a known extension is sniffed, which reads it: only
+	// now that a body will be sent.
+	contentType := s.contentType(requestedPath)
+
+	// 3. Range requests (resumable downloads, video seeking) only need the
+	// size. Only GET (and HEAD, which mirrors it) can ask for ranges, and
+	// If-Range turns the request into a plain GET if the file has changed.
+	size := info.Size()
+	start, end := int64(0), size-1
+	partial := false
+	rangeHeader := req.Header("Range")
+	if rangeHeader != "" && (req.Method == "GET" || req.Method == "HEAD") && ifRangeMatches(req, info.ModTime(), etag) {
+		var err error
+		start, end, err = parseByteRange(rangeHeader, size)
+		switch {
+		case errors.Is(err, errUnsatisfiableRange):
+			// Tell the client how big the file really is (RFC 9110 15.5.17).
+			headers := []string{fmt.Sprintf("Content-Range: bytes */%d", size)}
+			sendResponse(w, 416, headers, "")
+			return
+		case err != nil:
+			// Unparseable ranges are ignored: serve the whole file.
+			start, end = 0, size-1
+		default:
+			partial = true
+		}
+	}
+
+	status := 200
+	headerLines := []string{
+		"Content-Type: " + contentType,
+		// Browsers must use that type rather than guess their own, which
+		// could turn an uploaded text file into HTML that runs scripts.
+		"X-Content-Type-Options: nosniff",
+		// Advertise range support so clients know they can resume or seek.
+		"Accept-Ranges: bytes",
+	}
+	if partial {
+		status = 206
+		headerLines = append(headerLines, fmt.Sprintf("Content-Range: bytes %d-%d/%d", start, end, size))
+	}
+	headerLines = append(headerLines, validators...)
+	length := end - start + 1
+
+	// 4. HEAD (answered by this handler through the router's automatic HEAD
+	// support) gets the exact headers of a GET without reading the file.
+	if req.Method == "HEAD" {
+		headerLines = append(headerLines, fmt.Sprintf("Content-Length: %d", length))
+		sendResponse(w, status, headerLines, "")
+		return
+	}
+
+	// 5. Only now open the file. Its contents are streamed straight to the
+	// connection rather than loaded into memory, so huge files are fine.
+	stop := req.Timing.Start("disk")
+	file, err := os.Open(fullPath)
+	stop()
+	if err != nil {
+		sendResponse(w, 404, nil, "")
+		return
+	}
+	defer file.Close()
+
+	// Start at the requested range (the whole file by default); sendStream
+	// stops after length bytes. Handing it the *os.File itself, rather than
+	// a wrapper, lets the kernel send it with sendfile.
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		sendResponse(w, 500, nil, "")
+		return
+	}
+	sendStream(w, status, headerLines, file, length)
+}
+
+// --- FILE HANDLING ENDPOINT: POST ---
+// POST /files/{name} stores the request body as {name} inside the served directory.
+func (s *Server) createFileHandler(w ResponseWriter, req *HTTPRequest) {
+	fullPath, ok := s.resolveFilePath(req.Params["name"])
+	if !ok {
+		sendResponse(w, 404, nil, "")
+		return
+	}
+
+	// A plain body is the file content, written to disk as it arrives.
+	if !isFormBody(req) {
+		if err := s.storeBody(req, fullPath); err != nil {
+			sendResponse(w, s.uploadErrorStatus(req, err), nil, "")
+			return
+		}
+		sendResponse(w, 201, nil, "")
+		return
+	}
+
+	// Forms are parsed in memory. Compressed uploads (Content-Encoding:
+	// gzip) are stored decompressed. A corrupt or truncated stream is
+	// rejected here, before anything is written, so no partial file is
+	// ever committed.
+	err := req.bufferBody()
+	if err == nil {
+		err = s.decodeRequestBody(req)
+	}
+	if err != nil {
+		sendResponse(w, s.uploadErrorStatus(req, err), nil, "")
+		return
+	}
+
+	// By default the raw body is the file content. HTML forms wrap it instead:
+	// a file input arrives as multipart/form-data, a textarea named "content"
+	// as application/x-www-form-urlencoded.
+	content := []byte(req.Body)
+	isMultipart := strings.HasPrefix(req.Header("Content-Type"), "multipart/form-data")
+	// curl --data-binary labels any body as urlencoded, so a body that does not
+	// decode as a form is simply stored as-is. Broken multipart is an error.
+	if err := req.ParseForm(); err != nil && isMultipart {
+		sendResponse(w, 400, nil, "")
+		return
+	}
+	// A form with several files, or one posted to a directory
+	// ("/files/uploads/"), stores each file under its own name there.
+	if len(req.Files) > 1 || (req.File != nil && s.isDirectoryTarget(req.Params["name"], fullPath)) {
+		s.storeFormFiles(w, req, fullPath)
+		return
+	}
+	if req.File != nil {
+		content = req.File.Data
+	} else if isMultipart {
+		// A multipart upload without a file part has nothing to store.
+		sendResponse(w, 400, nil, "")
+		return
+	} else if values, ok := req.Form["content"]; ok {
+		content = []byte(values[0])
+	}
+
+	// Write atomically so readers never observe a half-written file.
+	stop := req.Timing.Start("disk")
+	err = writeFileAtomic(fullPath, content, 0644)
+	stop()
+	if err != nil {
+		sendResponse(w, 500, nil, "")
+		return
+	}
+
+	sendResponse(w, 201, nil, "")
+}
+
+// isDirectoryTarget reports whether an upload to name (at fullPath) is meant
+// for a directory: the name ends in "/", or names an existing directory.
+func (s *Server) isDirectoryTarget(name, fullPath string) bool {
+	if name == "" || strings.HasSuffix(name, "/") {
+		return true
+	}
+	info, err := os.Stat(fullPath)
+	return err == nil && info.IsDir()
+}
+
+// storeFormFiles saves every uploaded file of a multipart form in dir under
+// the name it had on the client, and answers 201 with the stored names, one
+// per line. The names are all checked before anything is written, so a bad
+// one does not leave half of the upload behind.
+func (s *Server) storeFormFiles(w ResponseWriter, req *HTTPRequest, dir string) {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		sendResponse(w, 409, nil, "")
+		return
+	}
+
+	names := make([]string, len(req.Files))
+	for i, file := range req.Files {
+		name := file.baseName()
+		if name == "" || name == "." || name == ".." || (!s.AllowDotfiles && strings.HasPrefix(name, ".")) {
+			sendResponse(w, 400, nil, "")
+			return
+		}
+		names[i] = name
+	}
+
+	stop := req.Timing.Start("disk")
+	defer stop()
+	for i, file := range req.Files {
+		if err := writeFileAtomic(filepath.Join(dir, names[i]), file.Data, 0644); err != nil {
+			sendResponse(w, 500, nil, "")
+			return
+		}
+	}
+	sendResponse(w, 201, []string{"Content-Type: text/plain; charset=utf-8"}, strings.Join(names, "\n")+"\n")
+}
+
+// isFormBody reports whether the body is an HTML form submission.
+func isFormBody(req *HTTPRequest) bool {
+	mediaType, _, _ := mime.ParseMediaType(req.Header("Content-Type"))
+	return mediaType == "multipart/form-data" || mediaType == "application/x-www-form-urlencoded"
+}
+
+// storeBody streams the request body into the file at fullPath, undoing any
+// Content-Encoding on the way. The file is only replaced once the whole body
+// has arrived intact.
+func (s *Server) storeBody(req *HTTPRequest, fullPath string) error {
+	body, err := s.decodedBodyReader(req)
+	if err != nil {
+		return err
+	}
+	stop := req.Timing.Start("disk")
+	defer stop()
+	return writeFileAtomicFrom(fullPath, body, 0644)
+}
+
+// uploadErrorStatus returns the status for an upload that failed with err:
+// 4xx if the client's body was at fault, 409 if the target directory is
+// missing, 500 if storing it failed. The rest of a bad body may still be on
+// the wire, so the connection is closed after the response.
+func (s *Server) uploadErrorStatus(req *HTTPRequest, err error) int {
+	var bodyErr *bodyReadError
+	switch {
+	case errors.Is(err, errUnsupportedEncoding):
+		req.Close = true
+		return 415
+	case errors.Is(err, errBodyTooLarge):
+		req.Close = true
+		return 413
+	case errors.Is(err, errTrailerTooLarge):
+		req.Close = true
+		return 431
+	case errors.As(err, &bodyErr):
+		req.Close = true
+		if isTimeout(err) {
+			return 408
+		}
+		return 400
+	case errors.Is(err, fs.ErrNotExist):
+		return 409
+	default:
+		return 500
+	}
+}
+
+// --- FILE HANDLING ENDPOINT: PUT ---
+// PUT /files/{name} stores the request body as {name}, replacing the file if
+// it exists. Unlike POST, the body is always the file content as-is (after
+// any Content-Encoding is undone): PUT is for API clients, not HTML forms.
+// It answers 201 when the file was created and 204 when it was replaced.
+func (s *Server) putFileHandler(w ResponseWriter, req *HTTPRequest) {
+	fullPath, ok := s.resolveFilePath(req.Params["name"])
+	if !ok {
+		sendResponse(w, 404, nil, "")
+		return
+	}
+
+	// A directory cannot be replaced by a file.
+	info, err := os.Stat(fullPath)
+	if err == nil && info.IsDir() {
+		sendResponse(w, 409, nil, "")
+		return
+	}
+	existed := err == nil
+
+	// A missing parent directory (409) is not created.
+	err = s.storeBody(req, fullPath)
+	switch {
+	case err != nil:
+		sendResponse(w, s.uploadErrorStatus(req, err), nil, "")
+	case existed:
+		sendResponse(w, 204, nil, "")
+	default:
+		sendResponse(w, 201, nil, "")
+	}
+}
+
+// --- FILE HANDLING ENDPOINT: DELETE ---
+// DELETE /files/{name} removes the file {name}: 204 when it was deleted,
+// 404 when there was no such file. Directories are not deleted (409).
+func (s *Server) deleteFileHandler(w ResponseWriter, req *HTTPRequest) {
+	fullPath, ok := s.resolveFilePath(req.Params["name"])
+	if !ok {
+		sendResponse(w, 404, nil, "")
+		return
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		sendResponse(w, 404, nil, "")
+		return
+	}
+	if info.IsDir() {
+		sendResponse(w, 409, nil, "")
+		return
+	}
+
+	stop := req.Timing.Start("disk")
+	err = os.Remove(fullPath)
+	stop()
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		sendResponse(w, 404, nil, "") // Deleted by someone else meanwhile
+	case err != nil:
+		sendResponse(w, 500, nil, "")
+	default:
+		sendResponse(w, 204, nil, "")
+	}
+}
+
+// resolveFilePath maps the {name} of a /files/{name} URL to a path inside the served directory.
+// It returns false for paths that must not be exposed:
+//   - anything outside the directory. The name is already percent-decoded,
+//     so "..%2f..%2fetc/passwd" arrives here as "../../etc/passwd"; ".."
+//     components are refused outright, whatever AllowDotfiles says;
+//   - unless AllowDotfiles is set, any component starting with a dot
+//     (".env", ".git/config");
+//   - symlinks pointing outside the directory, and with FollowSymlinks off,
+//     any path that goes through a symlink at all.
+//
+// The path returned has its symlinks resolved, so the file checked here is
+// the file the handler opens.
+func (s *Server) resolveFilePath(fileName string) (string, bool) {
+	if strings.ContainsRune(fileName, 0) {
+		return "", false
+	}
+	for _, part := range strings.Split(fileName, "/") {
+		if part == ".." || (!s.AllowDotfiles && strings.HasPrefix(part, ".")) {
+			return "", false
+		}
+	}
+
+	// Lexical containment: Join cleans the path, which must stay below root.
+	root, err := filepath.Abs(s.Dir)
+	if err != nil {
+		return "", false
+	}
+	fullPath := filepath.Join(root, fileName)
+	rel, ok := pathWithin(root, fullPath)
+	if !ok {
+		return "", false
+	}
+
+	// Containment on disk: a symlink inside the directory may point anywhere.
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", false
+	}
+	realPath, err := evalSymlinks(fullPath)
+	if err != nil {
+		return "", false
+	}
+	if _, ok := pathWithin(realRoot, realPath); !ok {
+		return "", false
+	}
+	// Without symlinks, resolving changes nothing below the root.
+	if !s.FollowSymlinks && realPath != filepath.Join(realRoot, rel) {
+		return "", false
+	}
+	return realPath, true
+}
+
+// pathWithin reports whether path is root or below it, and returns path
+// relative to root. Both must be clean and absolute.
+func pathWithin(root, path string) (string, bool) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// evalSymlinks is filepath.EvalSymlinks for a path that may not exist yet,
+// such as the target of an upload: the existing part is resolved and the
+// rest appended. A dangling symlink is an error, since writing through it
+// would create its target, wherever that is.
+func evalSymlinks(path string) (string, error) {
+	realPath, err := filepath.EvalSymlinks(path)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return realPath, err
+	}
+	if _, lerr := os.Lstat(path); lerr == nil {
+		return "", err // The path exists: it is a dangling symlink.
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return "", err
+	}
+	realParent, err := evalSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(realParent, filepath.Base(path)), nil
+}
+
+// notModifiedSince reports whether the client's cached copy, identified by
+// its If-Modified-Since header, is still current for a file last changed at modTime.
+func notModifiedSince(req *HTTPRequest, modTime time.Time) bool {
+	value := req.Header("If-Modified-Since")
+	if value == "" {
+		return false
+	}
+	since, err := parseHTTPDate(value)
+	// Invalid dates, and dates in the future (a client with a broken
+	// clock), are ignored as RFC 9110 13.1.3 requires.
+	if err != nil || since.After(time.Now()) {
+		return false
+	}
+	// HTTP dates have one second resolution, so drop the sub-second part.
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// fileETag returns the entity tag of a file, built from its modification
+// time and size like nginx does. Hashing the contents would be more exact
+// but would mean reading the whole file for every request, even for a 304.
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// etagMatches reports whether an If-None-Match header value, a list of
+// entity tags or "*", matches etag. The comparison is weak (RFC 9110 8.8.3.2):
+// W/"x" matches "x", since a cached copy only needs to be equivalent.
+func etagMatches(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == want {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// errUnsupportedEncoding is returned for a Content-Encoding we cannot decode.
+	errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+	// errBodyTooLarge is returned when a body decompresses past MaxRequestBytes.
+	errBodyTooLarge = errors.New("decoded body too large")
+)
+
+// decodedBodyReader returns req.BodyReader with any Content-Encoding undone,
+// the streaming counterpart of decodeRequestBody. The decoded stream is
+// capped at MaxRequestBytes in the same way. Errors reading it are
+// bodyReadErrors.
+func (s *Server) decodedBodyReader(req *HTTPRequest) (io.Reader, error) {
+	switch strings.ToLower(req.Header("Content-Encoding")) {
+	case "", "identity":
+		return bodyErrorReader{req.BodyReader}, nil
+	case "gzip", "x-gzip":
+	default:
+		return nil, errUnsupportedEncoding
+	}
+
+	zr, err := gzip.NewReader(req.BodyReader)
+	if err != nil {
+		return nil, &bodyReadError{err}
+	}
+	var r io.Reader = zr
+	if s.MaxRequestBytes > 0 {
+		r = &maxBytesReader{r: zr, left: s.MaxRequestBytes}
+	}
+	return bodyErrorReader{r}, nil
+}
+
+// maxBytesReader reads at most left bytes from r and fails with
+// errBodyTooLarge if there are more.
+type maxBytesReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	// Read one byte past the cap to tell "exactly at the cap" from "over it".
+	if int64(len(p)) > m.left+1 {
+		p = p[:m.left+1]
+	}
+	n, err := m.r.Read(p)
+	if int64(n) > m.left {
+		return int(m.left), errBodyTooLarge
+	}
+	m.left -= int64(n)
+	return n, err
+}
+
+// decodeRequestBody replaces a compressed req.Body with its decompressed form.
+//
+// gzip streams end with a CRC-32 and the uncompressed length; the gzip reader
+// checks both when it reaches the end, so reading to EOF is what detects
+// corrupt or truncated uploads (gzip.ErrChecksum, io.ErrUnexpectedEOF).
+// The output is capped at MaxRequestBytes so a tiny "zip bomb" cannot
+// expand into gigabytes in memory. Errors decoding it are bodyReadErrors,
+// as in decodedBodyReader: the client sent a bad body.
+func (s *Server) decodeRequestBody(req *HTTPRequest) error {
+	switch strings.ToLower(req.Header("Content-Encoding")) {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+	default:
+		return errUnsupportedEncoding
+	}
+
+	zr, err := gzip.NewReader(strings.NewReader(req.Body))
+	if err != nil {
+		return &bodyReadError{err}
+	}
+	defer zr.Close()
+
+	var r io.Reader = zr
+	if s.MaxRequestBytes > 0 {
+		// Read one byte past the cap to tell "exactly at the cap" from "over it".
+		r = io.LimitReader(zr, s.MaxRequestBytes+1)
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return &bodyReadError{err}
+	}
+	if s.MaxRequestBytes > 0 && int64(len(decoded)) > s.MaxRequestBytes {
+		return errBodyTooLarge
+	}
+
+	req.Body = string(decoded)
+	return nil
+}
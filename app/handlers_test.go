@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"         // Used to build gzip bodies
+	"compress/gzip" // Used to build gzip bodies
+	"encoding/json" // Used to decode /health
+	"errors"        // Used to fail uploads on purpose
+	"io"            // Used to fail uploads on purpose
+	"net/http"      // Used to read large responses
+	"os"            // Used to inspect the served directory
+	"path/filepath" // Used to build paths in the served directory
+	"runtime"       // Used to measure allocations
+	"strings"       // Used to build bodies
+	"syscall"       // Used to make named pipes
+	"testing"       // The test framework
+	"time"          // Used for deadlines
+)
+
+// leftovers returns the names of the temp files writeFileAtomic left in dir.
+func leftovers(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp-") {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+// failingReader returns data, then err.
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.data == "" {
+		return 0, f.err
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestWriteFileAtomicFrom(t *testing.T) {
+	tests := []struct {
+		name    string
+		r       io.Reader
+		wantErr bool
+	}{
+		{"complete", strings.NewReader("hello"), false},
+		{"write error halfway", &failingReader{"hel", errors.New("disk full")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "f.txt")
+			err := writeFileAtomicFrom(path, tt.r, 0644)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			data, readErr := os.ReadFile(path)
+			if tt.wantErr && !errors.Is(readErr, os.ErrNotExist) {
+				t.Errorf("a failed write left %q behind", data)
+			}
+			if !tt.wantErr && string(data) != "hello" {
+				t.Errorf("file = %q, want %q", data, "hello")
+			}
+			if tmp := leftovers(t, dir); len(tmp) > 0 {
+				t.Errorf("temp files left: %v", tmp)
+			}
+		})
+	}
+}
+
+func TestUploadIsAtomic(t *testing.T) {
+	t.Run("complete", func(t *testing.T) {
+		s := newTestServer(t)
+		resp := do(t, s, request("POST", "/files/f.txt", "hello"))
+		if resp.status != 201 {
+			t.Fatalf("status = %d, want 201", resp.status)
+		}
+		if data, _ := os.ReadFile(filepath.Join(s.Dir, "f.txt")); string(data) != "hello" {
+			t.Errorf("file = %q, want %q", data, "hello")
+		}
+		if tmp := leftovers(t, s.Dir); len(tmp) > 0 {
+			t.Errorf("temp files left: %v", tmp)
+		}
+	})
+
+	t.Run("client hangs up mid-body", func(t *testing.T) {
+		s := newTestServer(t)
+		conn, done := dialDone(t, s)
+		conn.Write([]byte("POST /files/f.txt HTTP/1.1\r\nHost: test\r\nContent-Length: 100\r\n\r\nonly ten b"))
+		conn.Close()
+		<-done
+		if _, err := os.Stat(filepath.Join(s.Dir, "f.txt")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("a truncated upload was stored (err = %v)", err)
+		}
+		if tmp := leftovers(t, s.Dir); len(tmp) > 0 {
+			t.Errorf("temp files left: %v", tmp)
+		}
+	})
+
+	t.Run("rename fails", func(t *testing.T) {
+		s := newTestServer(t)
+		// A non-empty directory cannot be replaced by a file.
+		os.MkdirAll(filepath.Join(s.Dir, "d", "sub"), 0755)
+		resp := do(t, s, request("POST", "/files/d", "hello"))
+		if resp.status != 500 {
+			t.Errorf("status = %d, want 500", resp.status)
+		}
+		if tmp := leftovers(t, s.Dir); len(tmp) > 0 {
+			t.Errorf("temp files left: %v", tmp)
+		}
+	})
+}
+
+func TestHealthCountsRequests(t *testing.T) {
+	s := newTestServer(t)
+	health := func() (report struct {
+		Status        string  `json:"status"`
+		Uptime        float64 `json:"uptime_seconds"`
+		TotalRequests uint64  `json:"total_requests"`
+	}) {
+		t.Helper()
+		resp := get(t, s, "/health")
+		if resp.status != 200 || resp.header.Get("Content-Type") != "application/json" {
+			t.Fatalf("GET /health: %d %q", resp.status, resp.header.Get("Content-Type"))
+		}
+		if err := json.Unmarshal([]byte(resp.body), &report); err != nil {
+			t.Fatalf("GET /health: %v in %s", err, resp.body)
+		}
+		return report
+	}
+
+	before := health()
+	for _, target := range []string{"/", "/echo/a", "/nope"} {
+		get(t, s, target)
+	}
+	after := health()
+	// The three requests, and the second /health itself.
+	if got := after.TotalRequests - before.TotalRequests; got != 4 {
+		t.Errorf("total_requests went up by %d, want 4", got)
+	}
+	if after.Status != "ok" || after.Uptime < before.Uptime {
+		t.Errorf("status %q, uptime %v after %v", after.Status, after.Uptime, before.Uptime)
+	}
+}
+
+func TestEchoInvalidUTF8(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		target      string
+		wantStatus  int
+		wantBody    string
+		wantWarning string
+	}{
+		{"valid", nil, "/echo/caf%C3%A9", 200, "café", ""},
+		{"truncated, replaced", nil, "/echo/caf%C3", 200, "caf\uFFFD", ""},
+		{"truncated, replaced with a warning", []string{"-warnings"}, "/echo/caf%C3", 200, "caf\uFFFD", `214 my-http-server "Transformation Applied: invalid UTF-8 replaced"`},
+		{"invalid byte, replaced", nil, "/echo/a%FFb", 200, "a\uFFFDb", ""},
+		{"truncated, rejected", []string{"-echo-invalid-utf8", "reject"}, "/echo/caf%C3", 400, "", ""},
+		{"valid, reject mode", []string{"-echo-invalid-utf8", "reject"}, "/echo/caf%C3%A9", 200, "café", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.args...)
+			resp := get(t, s, tt.target)
+			if resp.status != tt.wantStatus || resp.body != tt.wantBody {
+				t.Errorf("got %d %q, want %d %q", resp.status, resp.body, tt.wantStatus, tt.wantBody)
+			}
+			if got := resp.header.Get("Warning"); got != tt.wantWarning {
+				t.Errorf("Warning = %q, want %q", got, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestFormUploads(t *testing.T) {
+	multipart := func(parts ...string) string {
+		return "--XyZ\r\n" + strings.Join(parts, "\r\n--XyZ\r\n") + "\r\n--XyZ--\r\n"
+	}
+	filePart := func(field, filename, data string) string {
+		return `Content-Disposition: form-data; name="` + field + `"; filename="` + filename + "\"\r\nContent-Type: text/plain\r\n\r\n" + data
+	}
+	const multipartType = "Content-Type: multipart/form-data; boundary=XyZ"
+
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		header     string
+		wantStatus int
+		wantFiles  map[string]string
+	}{
+		{"urlencoded content field", "/files/f.txt", "content=hello+world%21&other=x", "Content-Type: application/x-www-form-urlencoded", 201, map[string]string{"f.txt": "hello world!"}},
+		{"urlencoded, not a form", "/files/f.txt", "a;b%zz", "Content-Type: application/x-www-form-urlencoded", 201, map[string]string{"f.txt": "a;b%zz"}},
+		{"multipart file", "/files/f.txt", multipart(`Content-Disposition: form-data; name="note"`+"\r\n\r\nignored", filePart("file", "local.txt", "file bytes")), multipartType, 201, map[string]string{"f.txt": "file bytes"}},
+		{"multipart to a directory", "/files/", multipart(filePart("file", "a.txt", "A"), filePart("file", "b.txt", "B")), multipartType, 201, map[string]string{"a.txt": "A", "b.txt": "B"}},
+		{"multipart without a file", "/files/f.txt", multipart(`Content-Disposition: form-data; name="note"` + "\r\n\r\nno file"), multipartType, 400, nil},
+		{"broken multipart", "/files/f.txt", "--XyZ\r\nno end", multipartType, 400, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			resp := do(t, s, request("POST", tt.target, tt.body, tt.header))
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.status, tt.wantStatus)
+			}
+			for name, want := range tt.wantFiles {
+				if data, _ := os.ReadFile(filepath.Join(s.Dir, name)); string(data) != want {
+					t.Errorf("%s = %q, want %q", name, data, want)
+				}
+			}
+			if tt.wantFiles == nil {
+				if entries, _ := os.ReadDir(s.Dir); len(entries) > 0 {
+					t.Errorf("a refused upload stored %s", entries[0].Name())
+				}
+			}
+		})
+	}
+}
+
+// fifoOpened reports whether anyone holds the named pipe at path open for
+// reading: opening it for writing without blocking only works then.
+func fifoOpened(path string) bool {
+	f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+func TestNotModifiedDoesNotReadTheFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		file       string
+		method     string
+		header     func(info os.FileInfo) string
+		wantStatus int
+	}{
+		{"If-None-Match", "data.txt", "GET", func(info os.FileInfo) string { return "If-None-Match: " + fileETag(info) }, 304},
+		{"If-Modified-Since", "data.txt", "GET", func(info os.FileInfo) string {
+			return "If-Modified-Since: " + info.ModTime().UTC().Format(httpTimeFormat)
+		}, 304},
+		{"no extension to take the type from", "data", "GET", func(info os.FileInfo) string { return "If-None-Match: " + fileETag(info) }, 304},
+		{"HEAD", "data.txt", "HEAD", func(os.FileInfo) string { return "Accept: */*" }, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			// Opening a named pipe blocks until a writer comes along, so a
+			// handler that opens the file never answers.
+			path := filepath.Join(s.Dir, tt.file)
+			if err := syscall.Mkfifo(path, 0644); err != nil {
+				t.Skipf("named pipes: %v", err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, r := send(t, s, request(tt.method, "/files/"+tt.file, "", tt.header(info)))
+			// Let a handler stuck opening the pipe go before the connection is
+			// waited for.
+			t.Cleanup(func() { fifoOpened(path) })
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			resp := readResponse(t, r, tt.method)
+			if resp.status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRanges(t *testing.T) {
+	tests := []struct {
+		name             string
+		rangeHeader      string
+		wantStatus       int
+		wantContentRange string
+		wantBody         string
+	}{
+		{"start past the end", "bytes=10-", 416, "bytes */10", ""},
+		{"suffix of nothing", "bytes=-0", 416, "bytes */10", ""},
+		{"first bytes", "bytes=0-3", 206, "bytes 0-3/10", "0123"},
+		{"end past the end", "bytes=7-100", 206, "bytes 7-9/10", "789"},
+		{"suffix", "bytes=-2", 206, "bytes 8-9/10", "89"},
+		{"not bytes", "lines=1-2", 200, "", "0123456789"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			os.WriteFile(filepath.Join(s.Dir, "f.txt"), []byte("0123456789"), 0644)
+			resp := get(t, s, "/files/f.txt", "Range: "+tt.rangeHeader)
+			if resp.status != tt.wantStatus || resp.body != tt.wantBody {
+				t.Errorf("got %d %q, want %d %q", resp.status, resp.body, tt.wantStatus, tt.wantBody)
+			}
+			if got := resp.header.Get("Content-Range"); got != tt.wantContentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.wantContentRange)
+			}
+		})
+	}
+}
+
+func TestLargeFileIsStreamed(t *testing.T) {
+	const size = 64 << 20
+	s := newTestServer(t)
+	f, err := os.Create(filepath.Join(s.Dir, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Truncate(size) // Sparse: no time spent writing it
+	f.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	_, r := send(t, s, request("GET", "/files/big.bin", ""))
+	resp, err := http.ReadResponse(r, &http.Request{Method: "GET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil || n != size || resp.ContentLength != size {
+		t.Fatalf("downloaded %d bytes (err %v), Content-Length %d, want %d", n, err, resp.ContentLength, size)
+	}
+
+	// Serving it allocated nowhere near its size.
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/8 {
+		t.Errorf("serving a %d byte file allocated %d bytes", size, allocated)
+	}
+}
+
+func TestCompressedUploadErrors(t *testing.T) {
+	gzipped := func(data string) string {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write([]byte(data))
+		zw.Close()
+		return b.String()
+	}
+	valid := gzipped("content=hello")
+	corrupt := []byte(valid)
+	corrupt[len(corrupt)-8] ^= 0xff // The CRC-32
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"valid", valid, 201},
+		{"not gzip", "content=hello", 400},
+		{"truncated", valid[:len(valid)-4], 400},
+		{"bad checksum", string(corrupt), 400},
+	}
+	// Forms are decoded in memory, other bodies as they are stored: both
+	// blame the client for a bad stream.
+	for _, contentType := range []string{"application/x-www-form-urlencoded", "text/plain"} {
+		for _, tt := range tests {
+			t.Run(contentType+", "+tt.name, func(t *testing.T) {
+				s := newTestServer(t)
+				conn, r := send(t, s, request("POST", "/files/f.txt", tt.body, "Content-Type: "+contentType, "Content-Encoding: gzip"))
+				resp := readResponse(t, r, "POST")
+				if resp.status != tt.wantStatus {
+					t.Fatalf("status = %d, want %d", resp.status, tt.wantStatus)
+				}
+				if tt.wantStatus == 201 {
+					return
+				}
+				if !closed(t, conn, r) {
+					t.Error("connection left open after a bad body")
+				}
+				if _, err := os.Stat(filepath.Join(s.Dir, "f.txt")); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("a bad upload was stored (err = %v)", err)
+				}
+			})
+		}
+	}
+}
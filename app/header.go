@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/textproto" // Used to canonicalize header names
+	"sort"          // Used to emit headers in a stable order
+)
+
+// Header holds the headers of a request or response, keyed by canonical
+// name ("Content-Type", not "content-type"). A header sent several times
+// keeps all of its values, in order.
+type Header map[string][]string
+
+// Add appends value to the header called key.
+func (h Header) Add(key, value string) {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	h[key] = append(h[key], value)
+}
+
+// Set replaces any values of the header called key with value.
+func (h Header) Set(key, value string) {
+	h[textproto.CanonicalMIMEHeaderKey(key)] = []string{value}
+}
+
+// Get returns the first value of the header called key, or "".
+func (h Header) Get(key string) string {
+	if values := h[textproto.CanonicalMIMEHeaderKey(key)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Values returns every value of the header called key.
+func (h Header) Values(key string) []string {
+	return h[textproto.CanonicalMIMEHeaderKey(key)]
+}
+
+// Has reports whether the header called key is present.
+func (h Header) Has(key string) bool {
+	_, ok := h[textproto.CanonicalMIMEHeaderKey(key)]
+	return ok
+}
+
+// Del removes the header called key.
+func (h Header) Del(key string) {
+	delete(h, textproto.CanonicalMIMEHeaderKey(key))
+}
+
+// Clone returns a copy of h that can be modified independently.
+func (h Header) Clone() Header {
+	clone := make(Header, len(h))
+	for key, values := range h {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// lines returns the headers as "Name: value" lines, sorted by name so
+// responses are reproducible.
+func (h Header) lines() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, key := range keys {
+		for _, value := range h[key] {
+			lines = append(lines, key+": "+value)
+		}
+	}
+	return lines
+}
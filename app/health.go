@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json" // Used to encode the readiness report
+	"errors"        // Used to report invalid checks
+	"fmt"           // Used to report failed checks
+	"net"           // Used by the tcp check
+	"net/http"      // Used by the URL check
+	"os"            // Used by the writable check
+	"strconv"       // Used to format Content-Length
+	"strings"       // Used to parse check specs
+	"sync"          // Used to run the checks in parallel
+	"sync/atomic"   // Used for the draining flag
+	"time"          // Used for the check timeout
+)
+
+// Kubernetes-style probes (and load balancers' health checks):
+//   - GET /healthz (liveness) answers 200 as long as the server serves at
+//     all; failing it gets the process restarted.
+//   - GET /readyz (readiness) answers 200 only when every ReadyCheck passes
+//     and the server is not shutting down, else 503; failing it takes the
+//     server out of rotation without restarting it.
+
+// draining is set once the process starts shutting down, so /readyz sends
+// traffic elsewhere while the connections left are drained.
+var draining atomic.Bool
+
+// readyCheckTimeout bounds each readiness check.
+const readyCheckTimeout = 2 * time.Second
+
+// ReadyCheck is a dependency the server needs to be ready.
+type ReadyCheck struct {
+	Name  string       // As shown by /readyz, e.g. "tcp:db:5432"
+	Check func() error // Returns why the dependency is unavailable
+}
+
+// parseReadyCheck parses a -ready-check value:
+//   - "writable:/path": files can be created in the directory /path, or
+//     in dir (the served directory) for plain "writable";
+//   - "tcp:host:port": host:port accepts connections;
+//   - "http://..." or "https://...": the URL answers GET with 2xx.
+func parseReadyCheck(spec, dir string) (ReadyCheck, error) {
+	if spec == "writable" {
+		spec = "writable:" + dir
+	}
+	check := ReadyCheck{Name: spec}
+	switch {
+	case strings.HasPrefix(spec, "writable:"):
+		dir := strings.TrimPrefix(spec, "writable:")
+		check.Check = func() error { return checkWritable(dir) }
+	case strings.HasPrefix(spec, "tcp:"):
+		addr := strings.TrimPrefix(spec, "tcp:")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return check, err
+		}
+		check.Check = func() error {
+			conn, err := net.DialTimeout("tcp", addr, readyCheckTimeout)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		client := &http.Client{Timeout: readyCheckTimeout}
+		check.Check = func() error {
+			resp, err := client.Get(spec)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				return fmt.Errorf("status %d", resp.StatusCode)
+			}
+			return nil
+		}
+	default:
+		return check, errors.New(`expected "writable:/path", "tcp:host:port" or an http(s):// URL`)
+	}
+	return check, nil
+}
+
+// checkWritable creates and removes a file in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// --- LIVENESS ENDPOINT ---
+// GET /healthz answers "ok": the server is up and serving requests.
+func healthzHandler(w ResponseWriter, req *HTTPRequest) {
+	headerLines := []string{
+		"Content-Type: text/plain",
+		"Content-Length: 2",
+		"Cache-Control: no-store",
+	}
+	sendResponse(w, 200, headerLines, "ok")
+}
+
+// --- READINESS ENDPOINT ---
+// GET /readyz runs the ReadyChecks in parallel and reports each outcome:
+//
+//	{"status":"ready","checks":{"tcp:db:5432":"ok"}}
+//
+// with 200, or 503 with "not ready" (and the errors), "maintenance" or
+// "draining".
+func (s *Server) readyzHandler(w ResponseWriter, req *HTTPRequest) {
+	results := make(map[string]string, len(s.ReadyChecks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range s.ReadyChecks {
+		wg.Go(func() {
+			result := "ok"
+			if err := check.Check(); err != nil {
+				result = err.Error()
+			}
+			mu.Lock()
+			results[check.Name] = result
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	status, state := 200, "ready"
+	for _, result := range results {
+		if result != "ok" {
+			status, state = 503, "not ready"
+		}
+	}
+	if maintenance.Load() {
+		status, state = 503, "maintenance"
+	}
+	if draining.Load() {
+		status, state = 503, "draining"
+	}
+
+	body, _ := json.Marshal(struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks,omitempty"`
+	}{state, results})
+	headerLines := []string{
+		"Content-Type: application/json",
+		"Content-Length: " + strconv.Itoa(len(body)),
+		"Cache-Control: no-store",
+	}
+	sendResponse(w, status, headerLines, string(body))
+}
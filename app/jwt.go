@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto"          // Used to name the RS256 hash
+	"crypto/hmac"     // Used to verify HS256 signatures
+	"crypto/rsa"      // Used to verify RS256 signatures
+	"crypto/sha256"   // Both algorithms sign a SHA-256 digest
+	"crypto/x509"     // Used to parse the RSA public key
+	"encoding/base64" // JWT segments are base64url encoded
+	"encoding/json"   // Used to decode the header and claims
+	"encoding/pem"    // Used to read the public key file
+	"errors"          // Used to describe why a token was refused
+	"fmt"             // Used to build the WWW-Authenticate challenge
+	"os"              // Used to read the public key file
+	"strings"         // Used to split the token into its segments
+	"time"            // Used to check exp and nbf
+)
+
+// A JSON Web Token (RFC 7519) is three base64url segments separated by dots:
+//
+//	header.claims.signature
+//
+// e.g. {"alg":"HS256","typ":"JWT"} . {"sub":"alice","exp":1700000000} . <sig>
+// The signature covers "header.claims", so the claims can be trusted once it
+// has been verified with the key the server was configured with.
+
+// JWTConfig configures JWTAuth. At least one key must be set, and a token is
+// only accepted with the algorithm that matches a configured key, so a token
+// cannot pick a weaker algorithm than the server expects.
+type JWTConfig struct {
+	// HMACSecret verifies HS256 tokens (shared secret).
+	HMACSecret []byte
+	// RSAPublicKey verifies RS256 tokens (signed with the matching private key).
+	RSAPublicKey *rsa.PublicKey
+	// Authorize, if set, decides whether a valid token may perform this
+	// request, e.g. by checking a "scope" claim. Refused requests get 403.
+	Authorize func(req *HTTPRequest, claims map[string]any) bool
+}
+
+// jwtLeeway tolerates small clock differences between the token issuer and us.
+const jwtLeeway = 30 * time.Second
+
+var errInvalidToken = errors.New("invalid token")
+
+// JWTAuth returns middleware that requires an "Authorization: Bearer <jwt>"
+// header with a valid, unexpired token. Missing or invalid tokens get 401,
+// tokens that Authorize refuses get 403 (RFC 6750 3.1). On success the
+// token's claims are available to later handlers as req.Claims.
+func JWTAuth(config JWTConfig) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, req *HTTPRequest) {
+			scheme, token, found := strings.Cut(req.Header("Authorization"), " ")
+			if !found || !strings.EqualFold(scheme, "Bearer") {
+				sendResponse(w, 401, []string{`WWW-Authenticate: Bearer realm="my-http-server"`}, "")
+				return
+			}
+
+			claims, err := config.verify(strings.TrimSpace(token), time.Now())
+			if err != nil {
+				challenge := fmt.Sprintf(`WWW-Authenticate: Bearer realm="my-http-server", error="invalid_token", error_description=%q`, err.Error())
+				sendResponse(w, 401, []string{challenge}, "")
+				return
+			}
+			if config.Authorize != nil && !config.Authorize(req, claims) {
+				sendResponse(w, 403, []string{`WWW-Authenticate: Bearer realm="my-http-server", error="insufficient_scope"`}, "")
+				return
+			}
+
+			req.Claims = claims
+			next(w, req)
+		}
+	}
+}
+
+// verify checks the token's signature and time limits and returns its claims.
+func (c JWTConfig) verify(token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	// 1. Header: which algorithm was used.
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	// 2. Signature, with the key for that algorithm only.
+	signed := []byte(parts[0] + "." + parts[1])
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	switch {
+	case header.Alg == "HS256" && c.HMACSecret != nil:
+		mac := hmac.New(sha256.New, c.HMACSecret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errors.New("bad signature")
+		}
+	case header.Alg == "RS256" && c.RSAPublicKey != nil:
+		digest := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(c.RSAPublicKey, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("bad signature")
+		}
+	default:
+		// Includes "none": an unsigned token is never acceptable.
+		return nil, fmt.Errorf("unexpected algorithm %q", header.Alg)
+	}
+
+	// 3. Claims, now known to come from the key holder.
+	var claims map[string]any
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-jwtLeeway)) {
+		return nil, errors.New("token not valid yet")
+	}
+	return claims, nil
+}
+
+// decodeJWTSegment decodes one base64url JSON segment of a token into v.
+func decodeJWTSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errInvalidToken
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// loadRSAPublicKey reads a PEM encoded RSA public key ("PUBLIC KEY" or
+// "RSA PUBLIC KEY") from the file at path.
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return rsaKey, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"   // Used to read responses
+	"bytes"   // Used to trim goroutine dumps
+	"context" // Used to stop the server
+	"net"     // Loopback connections
+	"runtime" // Used to count goroutines
+	"testing" // The test framework
+	"time"    // Used for the settle loop
+)
+
+// CheckGoroutineLeaks records how many goroutines are running and returns
+// a function that fails t unless the count is back at that baseline. Since
+// goroutines take a moment to exit after the connection they served closes,
+// the check retries for a while before giving up, then dumps the stacks of
+// every goroutine to show what leaked. Use it as
+//
+//	defer CheckGoroutineLeaks(t)()
+func CheckGoroutineLeaks(t testing.TB) func() {
+	t.Helper()
+	baseline := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		n := runtime.NumGoroutine()
+		for giveUp := time.Now().Add(5 * time.Second); n > baseline && time.Now().Before(giveUp); n = runtime.NumGoroutine() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n <= baseline {
+			return
+		}
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		t.Errorf("%d goroutines running, %d before:\n%s", n, baseline, bytes.TrimSpace(buf))
+	}
+}
+
+func TestConnectionsDoNotLeakGoroutines(t *testing.T) {
+	s := newTestServer(t)
+	defer CheckGoroutineLeaks(t)()
+
+	for range 20 {
+		// Keep-alive: several requests, one after the other.
+		conn, done := dialDone(t, s)
+		r := bufio.NewReader(conn)
+		for range 3 {
+			conn.Write([]byte(request("GET", "/echo/a", "")))
+			readResponse(t, r, "GET")
+		}
+		conn.Close()
+		<-done
+
+		// Pipelining: both requests in one write.
+		conn, done = dialDone(t, s)
+		r = bufio.NewReader(conn)
+		go conn.Write([]byte(request("GET", "/", "") + request("POST", "/files/f.txt", "hello")))
+		readResponse(t, r, "GET")
+		readResponse(t, r, "POST")
+		conn.Close()
+		<-done
+
+		// A client that hangs up halfway through a body.
+		conn, done = dialDone(t, s)
+		conn.Write([]byte("POST /files/g.txt HTTP/1.1\r\nHost: test\r\nContent-Length: 100\r\n\r\nonly ten b"))
+		conn.Close()
+		<-done
+
+		// A client that hangs up halfway through a head.
+		conn, done = dialDone(t, s)
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: te"))
+		conn.Close()
+		<-done
+	}
+}
+
+func TestShutdownDoesNotLeakGoroutines(t *testing.T) {
+	t.Cleanup(func() { draining.Store(false) })
+	s := newTestServer(t)
+	defer CheckGoroutineLeaks(t)()
+
+	ready := make(chan net.Addr, 1)
+	s.OnReady = func(addr net.Addr) { ready <- addr }
+	ctx, stop := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- s.ListenAndServeAll(ctx, []Listener{{Addr: "127.0.0.1:0"}}) }()
+	addr := (<-ready).String()
+
+	// Idle keep-alive connections, and one halfway through a request.
+	var conns []net.Conn
+	for range 10 {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		conn.Write([]byte(request("GET", "/", "")))
+		readResponse(t, bufio.NewReader(conn), "GET")
+		conns = append(conns, conn)
+	}
+	conns[0].Write([]byte("POST /files/f.txt HTTP/1.1\r\nHost: test\r\nContent-Length: 100\r\n\r\nsome"))
+
+	stop()
+	<-errs
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	s.Shutdown(shutdownCtx)
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
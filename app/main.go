@@ -1,261 +1,765 @@
 package main
 
 import (
-	"bytes"         // Used to manipulate byte buffers (for compression)
-	"compress/gzip" // Used to compress data using the GZIP algorithm
+	"bytes"         // Used to write byte slices through writeFileAtomicFrom
+	"context"       // Used to stop serving on a signal
+	"errors"        // Used to report invalid settings
 	"flag"          // Used to parse command-line arguments (flags)
 	"fmt"           // Used for formatted I/O (printing to console)
-	"io"            // Used to handle input/output errors like EOF
+	"io"            // Used for the access log destination
+	"log/slog"      // Used for the server's own log messages
+	"maps"          // Used to list the inherited listeners
 	"net"           // Used for network I/O (TCP sockets)
 	"os"            // Used for operating system functionality (File I/O, Exit)
+	"os/signal"     // Used to shut down on Ctrl-C and SIGTERM, reload on SIGHUP and upgrade on SIGUSR2
 	"path/filepath" // Used to construct file paths safely across OSs
-	"strings"       // Used for string manipulation (splitting, prefix checks)
+	"slices"        // Used to sort the inherited listeners
+	"strconv"       // Used to convert the port number to a string
+	"strings"       // Used to split list flags
+	"sync"          // Used to run one reload at a time
+	"sync/atomic"   // Used for lock-free counters shared between goroutines
+	"syscall"       // Used for SIGTERM, SIGHUP and SIGUSR2
+	"time"          // Used to measure server uptime
 )
 
-func main() {
+// --- SERVER STATISTICS ---
+// These are shared by every connection goroutine, so the counter must be atomic.
+var (
+	// startTime records when the process started, used to report uptime on /health.
+	startTime = time.Now()
+	// totalRequests counts every request the server has parsed since startup.
+	totalRequests atomic.Uint64
+)
+
+// stringList is a flag that may be given several times, e.g.
+// -proxy /a/=... -proxy /b/=...
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, " ") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// config is the server as described by the command line, the environment
+// and the config file. It is read at startup and again for every reload.
+type config struct {
+	// server is complete but for what newServer adds.
+	server *Server
+	// vhosts maps host names to the directories of their sites.
+	vhosts map[string]string
+
+	// The settings below only take effect at startup: a reload keeps the
+	// listeners, logs and metrics the server started with.
+	listen          []string
+	socketMode      os.FileMode
+	tlsCert         string
+	tlsKey          string
+	accessLog       string
+	logLevel        slog.Level
+	logFormat       string
+	metricsAddr     string
+	adminAddr       string
+	shutdownTimeout time.Duration
+	shutdownDelay   time.Duration
+}
+
+// configure parses args (the command-line arguments without the program
+// name), the HTTP_SERVER_* environment variables and the config file into a
+// config. Invalid settings are reported as errors.
+func configure(args []string) (*config, error) {
 	// 1. Parse Command Line Flags
 	// The user can start the server with: ./server --directory /tmp/
 	// If the flag isn't provided, it defaults to "." (current directory).
-	dir := flag.String("directory", ".", "Directory to serve files from")
-	flag.Parse()
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	configPath := fs.String("config", "", "YAML or JSON file of settings named like these flags; flags on the command line take precedence")
+	dir := fs.String("directory", ".", "Directory to serve files from")
+	allowDotfiles := fs.Bool("allow-dotfiles", false, "Serve files and directories whose name starts with a dot")
+	followSymlinks := fs.Bool("follow-symlinks", true, "Follow symlinks under -directory that point inside it (false refuses every symlink)")
+	host := fs.String("host", "0.0.0.0", "Interface to listen on (0.0.0.0 means all interfaces)")
+	port := fs.Int("port", 4221, "TCP port to listen on (0 picks a free port)")
+	h2c := fs.Bool("h2c", false, "Serve HTTP/2 without TLS to clients with prior knowledge or sending Upgrade: h2c")
+	proxyProtocol := fs.Bool("proxy-protocol", false, "Expect a PROXY protocol v1/v2 header on every connection")
+	autoHead := fs.Bool("auto-head", true, "Answer HEAD requests using the matching GET route")
+	trailingSlash := fs.String("trailing-slash", "strict", `What to do with requests like /user-agent/ whose path only matches a route with its trailing slash added or removed: "strict" (404), "redirect" (301, or 308 for other methods than GET and HEAD) or "match" (serve them)`)
+	autoOptions := fs.Bool("auto-options", true, "Answer OPTIONS requests with the methods allowed for the path")
+	readOnly := fs.Bool("read-only", false, "Refuse requests that modify files (POST, PUT, PATCH, DELETE) with 403")
+	allowedMethods := fs.String("allowed-methods", "", "Comma-separated list of the only HTTP methods to accept (e.g. GET,HEAD); empty allows all")
+	dirListing := fs.Bool("enable-dir-listing", false, "List the contents of directories requested under /files/ (HTML, or JSON with ?format=json)")
+	indexFiles := fs.String("index-files", "index.html", "Comma-separated file names served for directories under /files/ that contain one; empty disables")
+	errorPages := fs.String("error-pages", "", `Send error responses with a page, HTML or JSON depending on Accept: "default" for generated ones, or a directory of custom ones named by status (404.html, 404.json, ...), generated for the others; empty sends them bare`)
+	spaFallback := fs.String("spa-fallback", "", "File (e.g. index.html) served for /files/ paths that do not exist, for single-page apps")
+	precompressed := fs.Bool("precompressed", true, "Serve file.br/file.gz instead of file under /files/ to clients that accept them")
+	compress := fs.Bool("compress", true, "Compress responses with br, zstd or gzip for clients that accept it")
+	compressMinSize := fs.Int("compress-min-size", 0, "Only compress response bodies larger than this many bytes (e.g. 1024)")
+	compressTypes := fs.String("compress-types", strings.Join(defaultCompressTypes, ","), `Comma-separated content types to compress ("text/*" matches every text type)`)
+	mimeTypes := fs.String("mime-types", "", "Comma-separated extension=type overrides for /files/ (e.g. .md=text/markdown,.log=text/plain)")
+	maxRequestBytes := fs.Int64("max-request-bytes", 10<<20, "Maximum size of a single request (headers + body) in bytes, 0 for no limit (headers alone are always capped at 1 MiB)")
+	cacheTTL := fs.Duration("cache-ttl", 0, "How long to cache /echo/ responses in memory (e.g. 30s), 0 disables")
+	emitWarnings := fs.Bool("warnings", false, "Add a Warning header to degraded responses")
+	tlsCert := fs.String("tls-cert", "", "PEM certificate file; with -tls-key, serve HTTPS instead of HTTP")
+	tlsKey := fs.String("tls-key", "", "PEM private key file for -tls-cert")
+	basicAuth := fs.String("basic-auth", "", `Require "user:password" (HTTP Basic auth) for uploads`)
+	basicAuthFile := fs.String("basic-auth-file", "", "File of user:password lines accepted for uploads")
+	jwtSecret := fs.String("jwt-secret", "", "Require an HS256 bearer token signed with this secret for uploads")
+	jwtPublicKey := fs.String("jwt-public-key", "", "PEM RSA public key; require an RS256 bearer token signed with its private key for uploads")
+	rateLimit := fs.Float64("rate-limit", 0, "Requests per second allowed per client IP, 0 disables")
+	rateBurst := fs.Int("rate-burst", 10, "Requests a client IP may make at once before -rate-limit applies")
+	accessLog := fs.String("access-log", "", `Write an access log line per request to this file, or "-" for stdout`)
+	accessLogFormat := fs.String("access-log-format", "combined", `Access log format: "common" or "combined"`)
+	logLevel := fs.String("log-level", "info", "Minimum log level: debug, info, warn or error (debug logs every request)")
+	logFormat := fs.String("log-format", "text", `Log format: "text" (key=value) or "json" (one object per line)`)
+	metricsPath := fs.String("metrics-path", "", "Serve Prometheus metrics on this path (e.g. /metrics), empty disables")
+	metricsAddr := fs.String("metrics-addr", "", `Serve metrics on this separate "host:port" instead of the main port`)
+	adminAddr := fs.String("admin-addr", "", `Serve the admin API (routes, maintenance mode, log level, connections, reload, shutdown) on this separate "host:port", e.g. 127.0.0.1:9901`)
+	debug := fs.Bool("debug", false, "Serve CPU/heap/goroutine profiles for go tool pprof under /debug/pprof/")
+	readTimeout := fs.Duration("read-timeout", 30*time.Second, "Maximum time to read a request (headers and body), 0 for no limit")
+	writeTimeout := fs.Duration("write-timeout", 0, "Maximum time to handle a request and write the response, 0 for no limit")
+	idleTimeout := fs.Duration("idle-timeout", 120*time.Second, "Maximum time a keep-alive connection may wait for the next request, 0 for no limit")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 30*time.Second, "Maximum time to let connections finish when stopping (SIGTERM, Ctrl-C) or after an upgrade (SIGUSR2) before closing them")
+	shutdownDelay := fs.Duration("shutdown-delay", 0, "When stopping, keep accepting connections this long with /readyz answering 503, so load balancers stop sending traffic first")
+	maxKeepAliveRequests := fs.Int("max-keepalive-requests", 100, "Close a connection after this many requests, 0 for no limit")
+	maxConns := fs.Int("max-conns", 0, "Maximum number of connections handled at once, 0 for no limit")
+	maxConnsReject := fs.Bool("max-conns-reject", false, "Answer 503 when -max-conns or the -workers queue is full instead of making new clients wait")
+	workers := fs.Int("workers", 0, "Handle connections with a fixed pool of this many goroutines, 0 for one goroutine per connection")
+	queueSize := fs.Int("queue-size", 128, "Connections waiting for a free worker when -workers is set")
+	connectAllow := fs.String("connect-allow", "", `Comma-separated host:port targets CONNECT may tunnel to ("*" and "*.example.com" hosts, "*" ports); empty disables CONNECT`)
+	var listen stringList
+	fs.Var(&listen, "listen", `Address to listen on as host:port, e.g. 127.0.0.1:8080 or "[::1]:0" (port 0 picks a free port), or a Unix socket as unix:/path/to.sock, with "https://" or "http://" in front to force TLS (with -tls-cert) or plain HTTP; repeatable; overrides -host and -port`)
+	socketMode := fs.String("socket-mode", "", "Permissions of Unix socket files from -listen, in octal (e.g. 0660); empty keeps the umask default")
+	var mounts stringList
+	fs.Var(&mounts, "mount", "Serve a directory read-only under a URL prefix, e.g. /static/=/srv/static; repeatable")
+	var vhosts stringList
+	fs.Var(&vhosts, "vhost", "Serve another site for requests with this Host, e.g. example.com=/srv/example (its -directory); other hosts get the default site; repeatable")
+	corsOrigins := fs.String("cors-origins", "", `Comma-separated origins allowed to call the server from scripts (CORS), e.g. https://example.com,https://*.example.com, or "*" for any; empty disables CORS`)
+	corsMethods := fs.String("cors-methods", "", "Comma-separated methods CORS preflights may ask for; empty allows those of the requested path")
+	corsHeaders := fs.String("cors-headers", "", "Comma-separated request headers CORS preflights may ask for; empty allows any")
+	corsExposeHeaders := fs.String("cors-expose-headers", "", "Comma-separated response headers scripts may read (e.g. X-Request-ID)")
+	corsCredentials := fs.Bool("cors-credentials", false, "Let cross-origin requests carry cookies and Authorization")
+	corsMaxAge := fs.Duration("cors-max-age", 0, "How long browsers may cache CORS preflight answers (e.g. 10m), 0 leaves it to them")
+	var readyChecks stringList
+	fs.Var(&readyChecks, "ready-check", `Dependency /readyz checks: "writable" (-directory) or "writable:/path" (files can be created), "tcp:host:port" (accepts connections), or an http(s):// URL (answers 2xx); repeatable`)
+	var proxies stringList
+	var redirects stringList
+	fs.Var(&redirects, "redirect", "Redirect requests matching a route pattern, e.g. /blog/{slug}=https://blog.example.com/{slug};status=308 (301, the default, 302, 307 or 308); repeatable")
+	var rewrites stringList
+	fs.Var(&rewrites, "rewrite", "Serve requests whose path matches a regular expression as if sent for another path, e.g. ^/v1/assets/(.*)$=/files/$1 (the first match applies); repeatable")
+	fs.Var(&proxies, "proxy", "Forward requests under a prefix to upstreams, e.g. /api/=http://10.0.0.1:8080,http://10.0.0.2:8080;strategy=least-connections (round-robin, least-connections or random); repeatable")
+	echoInvalidUTF8 := fs.String("echo-invalid-utf8", "replace", `How /echo/ handles invalid UTF-8: "replace" or "reject"`)
+	fs.Parse(args)
 
-	fmt.Println("Logs from your program will appear here!")
+	// Flags not given above come from HTTP_SERVER_* environment variables,
+	// then from the config file: flags > environment > config file.
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if err := applyEnv(fs, set); err != nil {
+		return nil, fmt.Errorf("Invalid environment variable %w", err)
+	}
+	if *configPath != "" {
+		if err := loadConfig(fs, *configPath, set); err != nil {
+			return nil, fmt.Errorf("Invalid -config file: %w", err)
+		}
+	}
 
-	// 2. Create the TCP Listener
-	// We bind to 0.0.0.0 (all interfaces) on port 4221.
-	l, err := net.Listen("tcp", "0.0.0.0:4221")
+	level, err := parseLevel(*logLevel)
+	if err == nil {
+		_, err = newLogger(io.Discard, level, *logFormat)
+	}
 	if err != nil {
-		fmt.Println("Failed to bind to port 4221")
-		os.Exit(1)
+		return nil, fmt.Errorf("Invalid -log-level/-log-format: %w", err)
+	}
+	if *port < 0 || *port > 65535 {
+		return nil, fmt.Errorf("Invalid -port value: %d (must be between 0 and 65535)", *port)
+	}
+	if *rateLimit < 0 || *rateBurst < 1 {
+		return nil, errors.New("Invalid -rate-limit/-rate-burst: the rate must not be negative and the burst must be at least 1")
+	}
+	if *accessLogFormat != "common" && *accessLogFormat != "combined" {
+		return nil, fmt.Errorf("Invalid -access-log-format value: %s", *accessLogFormat)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if *echoInvalidUTF8 != "replace" && *echoInvalidUTF8 != "reject" {
+		return nil, fmt.Errorf("Invalid -echo-invalid-utf8 value: %s", *echoInvalidUTF8)
 	}
-	// 'defer' ensures the listener is closed if the main function exits unexpectedly.
-	defer l.Close()
 
-	// 3. The Main Connection Loop
-	// This loop runs forever, waiting for new users to connect.
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			fmt.Println("Error accepting connection: ", err.Error())
+	// Normalise "get, head" into ["GET", "HEAD"].
+	var methods []string
+	for _, m := range strings.Split(*allowedMethods, ",") {
+		if m = strings.ToUpper(strings.TrimSpace(m)); m != "" {
+			methods = append(methods, m)
+		}
+	}
+
+	var compressible []string
+	for _, t := range strings.Split(*compressTypes, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			compressible = append(compressible, t)
+		}
+	}
+
+	var connectTargets []string
+	for _, target := range strings.Split(*connectAllow, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			if _, _, err := net.SplitHostPort(target); err != nil {
+				return nil, fmt.Errorf("Invalid -connect-allow value: %s", target)
+			}
+			connectTargets = append(connectTargets, target)
+		}
+	}
+
+	var indexNames []string
+	for _, name := range strings.Split(*indexFiles, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			indexNames = append(indexNames, name)
+		}
+	}
+
+	// Parse ".md=text/markdown" pairs; extensions match case-insensitively.
+	types := make(map[string]string)
+	for _, pair := range strings.Split(*mimeTypes, ",") {
+		if strings.TrimSpace(pair) == "" {
 			continue
 		}
-		
-		// 4. Concurrency (Goroutines)
-		// The 'go' keyword spawns a lightweight thread.
-		// This allows the main loop to immediately go back to waiting for the NEXT user.
-		go handleConnection(conn, *dir)
+		ext, contentType, ok := strings.Cut(pair, "=")
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if !ok || ext == "" || strings.TrimSpace(contentType) == "" {
+			return nil, fmt.Errorf("Invalid -mime-types entry: %s (expected .ext=type)", pair)
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		types[ext] = strings.TrimSpace(contentType)
 	}
-}
 
-// handleConnection manages the lifecycle of a single TCP connection.
-// It supports Persistent Connections (Keep-Alive) and Explicit Closures.
-func handleConnection(conn net.Conn, dir string) {
-	// Ensure the connection is closed when this function finally returns.
-	defer conn.Close()
-
-	// --- PERSISTENT CONNECTION LOOP ---
-	// HTTP/1.1 connections stay open by default unless "Connection: close" is sent.
-	for {
-		// 1. Read Request Data
-		// We allocate a 1KB buffer.
-		buf := make([]byte, 1024)
-		
-		n, err := conn.Read(buf)
-		
-		// Handle Disconnection:
-		// io.EOF means the client (browser/curl) has closed the connection cleanly.
-		if err == io.EOF {
-			break // Exit the loop to close the connection
+	// JoinHostPort adds the brackets IPv6 literals need (e.g. [::1]:4221).
+	addr := net.JoinHostPort(*host, strconv.Itoa(*port))
+	var mode uint64
+	if *socketMode != "" {
+		var err error
+		if mode, err = strconv.ParseUint(*socketMode, 8, 32); err != nil || mode > 0o777 {
+			return nil, fmt.Errorf("Invalid -socket-mode value: %s", *socketMode)
 		}
+	}
+	for i, spec := range listen {
+		listenAddr, _, err := parseListen(spec, *tlsCert != "")
 		if err != nil {
-			fmt.Println("Error reading request:", err)
-			break
-		}
-		// If 0 bytes were read, the connection is effectively dead.
-		if n == 0 {
-			break
-		}
-
-		request := string(buf[:n])
-		
-		// 2. Parse the Request Line
-		lines := strings.Split(request, "\r\n")
-		requestLine := strings.Split(lines[0], " ")
-		
-		if len(requestLine) < 2 {
-			continue // Skip malformed requests
-		}
-		
-		method := requestLine[0] // e.g., "GET", "POST"
-		path := requestLine[1]   // e.g., "/", "/echo/abc"
-
-		// --- CHECK FOR CONNECTION: CLOSE HEADER ---
-		// We scan the headers to see if the client wants to close the connection after this request.
-		shouldClose := false
-		for _, line := range lines {
-			// We check for the header. In a real server, we would use case-insensitive matching.
-			if strings.HasPrefix(line, "Connection: close") {
-				shouldClose = true
-				break
-			}
+			return nil, err
+		}
+		if i == 0 {
+			addr = listenAddr
+		}
+	}
+
+	mounted := make(map[string]string)
+	for _, spec := range mounts {
+		prefix, mountDir, ok := strings.Cut(spec, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") || mountDir == "" {
+			return nil, fmt.Errorf("Invalid -mount value: %s", spec)
 		}
+		mounted[prefix] = mountDir
+	}
 
-		// 3. Routing Logic
-		// We route the request based on the path.
+	var reverseProxies []*ReverseProxy
+	for _, spec := range proxies {
+		p, err := parseProxySpec(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -proxy value: %s (%w)", spec, err)
+		}
+		reverseProxies = append(reverseProxies, p)
+	}
 
-		if path == "/" {
-			// --- ROOT ENDPOINT ---
-			// If we need to close, we explicitly add the Connection header.
-			if shouldClose {
-				conn.Write([]byte("HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n"))
-			} else {
-				conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
-			}
+	var redirectRules []RedirectRule
+	for _, spec := range redirects {
+		rule, err := parseRedirectRule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -redirect value: %s (%w)", spec, err)
+		}
+		redirectRules = append(redirectRules, rule)
+	}
 
-		} else if strings.HasPrefix(path, "/echo/") {
-			// --- ECHO ENDPOINT (With GZIP) ---
-			
-			content := strings.TrimPrefix(path, "/echo/")
-			
-			// Compression Logic
-			finalBody := content
-			shouldCompress := false
-			
-			// Check headers for 'Accept-Encoding: gzip'
-			for _, line := range lines {
-				if strings.HasPrefix(line, "Accept-Encoding: ") {
-					value := strings.TrimPrefix(line, "Accept-Encoding: ")
-					if strings.Contains(value, "gzip") {
-						shouldCompress = true
-						break
-					}
-				}
-			}
+	var rewriteRules []RewriteRule
+	for _, spec := range rewrites {
+		rule, err := parseRewriteRule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -rewrite value: %s (%w)", spec, err)
+		}
+		rewriteRules = append(rewriteRules, rule)
+	}
 
-			// If client supports gzip, compress the body
-			if shouldCompress {
-				var b bytes.Buffer
-				w := gzip.NewWriter(&b)
-				w.Write([]byte(content))
-				w.Close() // Must close to write the Gzip footer/checksum
-				finalBody = b.String()
-			}
+	var cors *CORSConfig
+	if origins := splitList(*corsOrigins); len(origins) > 0 {
+		cors = &CORSConfig{
+			AllowedOrigins:   origins,
+			AllowedHeaders:   splitList(*corsHeaders),
+			ExposedHeaders:   splitList(*corsExposeHeaders),
+			AllowCredentials: *corsCredentials,
+			MaxAge:           *corsMaxAge,
+		}
+		for _, m := range splitList(*corsMethods) {
+			cors.AllowedMethods = append(cors.AllowedMethods, strings.ToUpper(m))
+		}
+	}
 
-			// Construct Headers
-			headerLines := []string{
-				"HTTP/1.1 200 OK",
-				"Content-Type: text/plain",
-				// Content-Length matches the size of the body (compressed or not)
-				fmt.Sprintf("Content-Length: %d", len(finalBody)),
-			}
+	var checks []ReadyCheck
+	for _, spec := range readyChecks {
+		check, err := parseReadyCheck(spec, *dir)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -ready-check value: %s (%w)", spec, err)
+		}
+		checks = append(checks, check)
+	}
 
-			if shouldCompress {
-				headerLines = append(headerLines, "Content-Encoding: gzip")
-			}
+	virtualHosts := make(map[string]string)
+	for _, spec := range vhosts {
+		name, vhostDir, ok := strings.Cut(spec, "=")
+		if name = canonicalHost(strings.TrimSpace(name)); !ok || name == "" || vhostDir == "" {
+			return nil, fmt.Errorf("Invalid -vhost value: %s", spec)
+		}
+		virtualHosts[name] = vhostDir
+	}
 
-			// ADDED: If the client asked to close, echo that back in the headers
-			if shouldClose {
-				headerLines = append(headerLines, "Connection: close")
-			}
+	// Credentials for uploads, from the file and/or the flag.
+	credentials := make(map[string]string)
+	if *basicAuthFile != "" {
+		users, err := loadCredentials(*basicAuthFile)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -basic-auth-file: %w", err)
+		}
+		credentials = users
+	}
+	if *basicAuth != "" {
+		user, password, ok := strings.Cut(*basicAuth, ":")
+		if !ok || user == "" {
+			return nil, errors.New(`Invalid -basic-auth value: expected "user:password"`)
+		}
+		credentials[user] = password
+	}
 
-			// Join headers and body with CRLFs
-			responseHeaders := strings.Join(headerLines, "\r\n")
-			response := responseHeaders + "\r\n\r\n" + finalBody
-			
-			conn.Write([]byte(response))
-
-		} else if path == "/user-agent" {
-			// --- USER-AGENT ENDPOINT ---
-			
-			var userAgent string
-			// Scan headers to find User-Agent
-			for _, line := range lines {
-				if strings.HasPrefix(line, "User-Agent: ") {
-					userAgent = strings.TrimPrefix(line, "User-Agent: ")
-					break
-				}
-			}
-			
-			length := len(userAgent)
-			
-			// Construct Headers manually to include Connection: close if needed
-			headerLines := []string{
-				"HTTP/1.1 200 OK",
-				"Content-Type: text/plain",
-				fmt.Sprintf("Content-Length: %d", length),
+	// Bearer tokens for uploads, verified with a shared secret and/or a public key.
+	var jwtConfig *JWTConfig
+	if *jwtSecret != "" || *jwtPublicKey != "" {
+		if len(credentials) > 0 {
+			return nil, errors.New("-basic-auth and -jwt-* cannot be combined: both use the Authorization header")
+		}
+		jwtConfig = &JWTConfig{}
+		if *jwtSecret != "" {
+			jwtConfig.HMACSecret = []byte(*jwtSecret)
+		}
+		if *jwtPublicKey != "" {
+			key, err := loadRSAPublicKey(*jwtPublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid -jwt-public-key: %w", err)
 			}
+			jwtConfig.RSAPublicKey = key
+		}
+	}
 
-			if shouldClose {
-				headerLines = append(headerLines, "Connection: close")
-			}
+	errorPagesDir := *errorPages
+	if errorPagesDir == "default" {
+		errorPagesDir = ""
+	} else if info, err := os.Stat(errorPagesDir); errorPagesDir != "" && (err != nil || !info.IsDir()) {
+		return nil, fmt.Errorf("Invalid -error-pages value: %s is not a directory", errorPagesDir)
+	}
+
+	slashPolicy, err := parseTrailingSlash(*trailingSlash)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid -trailing-slash value: %w", err)
+	}
+
+	router := NewRouter()
+	router.AutoHead = *autoHead
+	router.AutoOptions = *autoOptions
+	router.TrailingSlash = slashPolicy
+
+	srv := &Server{
+		Addr:                 addr,
+		Dir:                  *dir,
+		AllowDotfiles:        *allowDotfiles,
+		FollowSymlinks:       *followSymlinks,
+		ProxyProtocol:        *proxyProtocol,
+		H2C:                  *h2c,
+		Mounts:               mounted,
+		Proxies:              reverseProxies,
+		ReadyChecks:          checks,
+		Redirects:            redirectRules,
+		Rewrites:             rewriteRules,
+		CORS:                 cors,
+		ConnectAllow:         connectTargets,
+		MaxRequestBytes:      *maxRequestBytes,
+		AllowedMethods:       methods,
+		MIMETypes:            types,
+		IndexFiles:           indexNames,
+		DirListing:           *dirListing,
+		SPAFallback:          *spaFallback,
+		ErrorPages:           *errorPages != "",
+		ErrorPagesDir:        errorPagesDir,
+		Precompressed:        *precompressed,
+		Compress:             *compress,
+		CompressMinSize:      *compressMinSize,
+		CompressTypes:        compressible,
+		ReadOnly:             *readOnly,
+		Router:               router,
+		EchoInvalidUTF8:      *echoInvalidUTF8,
+		EmitWarnings:         *emitWarnings,
+		CacheTTL:             *cacheTTL,
+		Credentials:          credentials,
+		JWT:                  jwtConfig,
+		RateLimit:            *rateLimit,
+		RateBurst:            *rateBurst,
+		ReadTimeout:          *readTimeout,
+		WriteTimeout:         *writeTimeout,
+		IdleTimeout:          *idleTimeout,
+		MaxKeepAliveRequests: *maxKeepAliveRequests,
+		MaxConnections:       *maxConns,
+		RejectWhenFull:       *maxConnsReject,
+		Workers:              *workers,
+		QueueSize:            *queueSize,
+		Debug:                *debug,
+		MetricsPath:          *metricsPath,
+		AccessLogCombined:    *accessLogFormat == "combined",
+	}
+
+	return &config{
+		server:          srv,
+		vhosts:          virtualHosts,
+		listen:          listen,
+		socketMode:      os.FileMode(mode),
+		tlsCert:         *tlsCert,
+		tlsKey:          *tlsKey,
+		accessLog:       *accessLog,
+		logLevel:        level,
+		logFormat:       *logFormat,
+		metricsAddr:     *metricsAddr,
+		adminAddr:       *adminAddr,
+		shutdownTimeout: *shutdownTimeout,
+		shutdownDelay:   *shutdownDelay,
+	}, nil
+}
 
-			responseHeaders := strings.Join(headerLines, "\r\n")
-			response := responseHeaders + "\r\n\r\n" + userAgent
-			conn.Write([]byte(response))
-
-		} else if strings.HasPrefix(path, "/files/") {
-			// --- FILE HANDLING ENDPOINT ---
-			
-			fileName := strings.TrimPrefix(path, "/files/")
-			fullPath := filepath.Join(dir, fileName)
-
-			if method == "POST" {
-				// --- POST: CREATE FILE ---
-				
-				parts := strings.Split(request, "\r\n\r\n")
-				if len(parts) < 2 {
-					conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
-					// Even on error, we respect the close header logic below
-				} else {
-					fileContent := parts[1]
-					err := os.WriteFile(fullPath, []byte(fileContent), 0644)
-					if err != nil {
-						conn.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
-					} else {
-						// Success response
-						if shouldClose {
-							conn.Write([]byte("HTTP/1.1 201 Created\r\nConnection: close\r\n\r\n"))
-						} else {
-							conn.Write([]byte("HTTP/1.1 201 Created\r\n\r\n"))
-						}
-					}
-				}
-
-			} else {
-				// --- GET: READ FILE ---
-				
-				fileData, err := os.ReadFile(fullPath)
-				if err != nil {
-					conn.Write([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
-				} else {
-					length := len(fileData)
-					
-					headerLines := []string{
-						"HTTP/1.1 200 OK",
-						"Content-Type: application/octet-stream",
-						fmt.Sprintf("Content-Length: %d", length),
-					}
-					
-					if shouldClose {
-						headerLines = append(headerLines, "Connection: close")
-					}
-
-					responseHeaders := strings.Join(headerLines, "\r\n")
-					response := responseHeaders + "\r\n\r\n" + string(fileData)
-					conn.Write([]byte(response))
-				}
+// splitList splits a comma-separated flag value, dropping blanks.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseListen splits a -listen value into its address and whether it speaks
+// TLS. Every listener speaks HTTPS when a certificate is given (haveTLS),
+// unless its address says otherwise.
+func parseListen(spec string, haveTLS bool) (string, bool, error) {
+	addr, useTLS := spec, haveTLS
+	if a, ok := strings.CutPrefix(spec, "http://"); ok {
+		addr, useTLS = a, false
+	} else if a, ok := strings.CutPrefix(spec, "https://"); ok {
+		addr, useTLS = a, true
+		if !haveTLS {
+			return "", false, fmt.Errorf("-listen %s requires -tls-cert and -tls-key", spec)
+		}
+	}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return "", false, fmt.Errorf("Invalid -listen value: %s", spec)
+		}
+	} else if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+		return "", false, fmt.Errorf("Invalid -listen value: %s", spec)
+	}
+	return addr, useTLS, nil
+}
+
+// listeners returns the listeners to serve: the sockets passed by systemd,
+// which take the place of -host and -port, and those from -listen.
+//
+// After an upgrade, the addresses the previous process handed over
+// (inherited) are served on its sockets rather than bound again. The ones
+// no longer configured are served as they are, like systemd's.
+func (c *config) listeners(activated []net.Listener, inherited map[string]net.Listener) []Listener {
+	listen := c.listen
+	if len(listen) == 0 && len(activated) == 0 && (len(inherited) == 0 || inherited[c.server.Addr] != nil) {
+		listen = []string{c.server.Addr}
+	}
+	var configured []Listener
+	for _, spec := range listen {
+		addr, useTLS, _ := parseListen(spec, c.tlsCert != "")
+		ln := Listener{Addr: addr, Bound: inherited[addr], Mode: c.socketMode}
+		delete(inherited, addr)
+		if useTLS {
+			ln.CertFile, ln.KeyFile = c.tlsCert, c.tlsKey
+		}
+		configured = append(configured, ln)
+	}
+
+	var listeners []Listener
+	for _, l := range activated {
+		listeners = append(listeners, Listener{Addr: l.Addr().String(), Bound: l, CertFile: c.tlsCert, KeyFile: c.tlsKey})
+	}
+	for _, addr := range slices.Sorted(maps.Keys(inherited)) {
+		listeners = append(listeners, Listener{Addr: addr, Bound: inherited[addr], CertFile: c.tlsCert, KeyFile: c.tlsKey})
+	}
+	return append(listeners, configured...)
+}
+
+// newServer completes c.server with what every generation of the server
+// shares (metrics, the access log) and registers its routes.
+func (c *config) newServer(metrics *Metrics, accessLog io.Writer) *Server {
+	s := c.server
+	s.Metrics = metrics
+	s.AccessLog = accessLog
+	if c.metricsAddr != "" {
+		s.MetricsPath = "" // Served on their own listener
+	}
+	s.registerRoutes()
+
+	// Every virtual host gets the same routes over its own directory.
+	for name, dir := range c.vhosts {
+		if s.VirtualHosts == nil {
+			s.VirtualHosts = make(map[string]*Server)
+		}
+		s.VirtualHosts[name] = s.NewVirtualHost(dir)
+	}
+	return s
+}
+
+func main() {
+	// 1. Read the Configuration
+	cfg, err := configure(os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// The level can be changed at runtime through the admin API.
+	var logLevel slog.LevelVar
+	logLevel.Set(cfg.logLevel)
+	logger, _ := newLogger(os.Stdout, &logLevel, cfg.logFormat)
+	slog.SetDefault(logger)
+
+	activated, err := systemdListeners()
+	if err != nil {
+		fmt.Println("Socket activation failed:", err)
+		os.Exit(1)
+	}
+	inherited, upgraded, err := inheritedListeners()
+	if err != nil {
+		fmt.Println("Upgrade failed:", err)
+		os.Exit(1)
+	}
+	// The metrics and admin API listeners are handed over in upgrades too.
+	besideListener := func(addr string) Listener {
+		ln := Listener{Addr: addr, Bound: inherited[addr]}
+		delete(inherited, addr)
+		return ln
+	}
+	metricsLn := besideListener(cfg.metricsAddr)
+	adminLn := besideListener(cfg.adminAddr)
+	listeners := cfg.listeners(activated, inherited)
+
+	// The sockets are bound up front so that an upgrade can hand them over.
+	for i := range listeners {
+		if err := listeners[i].bind(); err != nil {
+			slog.Error("server stopped", "err", err)
+			os.Exit(1)
+		}
+	}
+	handover := slices.Clone(listeners)
+
+	// Access log destination: stdout or a file we append to.
+	var accessLogOut io.Writer
+	switch cfg.accessLog {
+	case "":
+	case "-":
+		accessLogOut = os.Stdout
+	default:
+		file, err := os.OpenFile(cfg.accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Println("Cannot open -access-log:", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		accessLogOut = file
+	}
+
+	// Metrics are served on the main port, or on their own listener so they
+	// are not exposed to the public.
+	var metrics *Metrics
+	if cfg.server.MetricsPath != "" || cfg.metricsAddr != "" {
+		metrics = NewMetrics()
+	}
+	if cfg.metricsAddr != "" {
+		path := cfg.server.MetricsPath
+		if path == "" {
+			path = "/metrics"
+		}
+
+		metricsRouter := NewRouter()
+		metricsRouter.Get(path, metrics.Handler())
+		serveBeside("metrics", &metricsLn, metricsRouter, "path", path)
+		handover = append(handover, metricsLn)
+	}
+
+	srv := cfg.newServer(metrics, accessLogOut)
+
+	// With port 0 the OS picks the port, so report the address actually bound.
+	// Once every listener is served, the process this one replaces can stop.
+	ready := 0
+	srv.OnReady = func(addr net.Addr) {
+		slog.Info("listening", "addr", addr.String())
+		if ready++; ready == len(listeners) {
+			upgraded()
+		}
+	}
+
+	// SIGHUP re-reads the configuration and swaps it in without dropping
+	// a connection.
+	srv.enableReload()
+	var reloadMu sync.Mutex
+	reload := func() error {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		next, err := configure(os.Args[1:])
+		if err != nil {
+			return err
+		}
+		return srv.Reload(next.newServer(metrics, accessLogOut))
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			recordReload(reload())
+		}
+	}()
+
+	// Ctrl-C, or SIGTERM from a service manager, stops the server: /readyz
+	// fails at once, and after -shutdown-delay, once load balancers have
+	// noticed, the listeners close.
+	serveCtx, stopServing := context.WithCancel(context.Background())
+	defer stopServing()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		draining.Store(true)
+		time.Sleep(cfg.shutdownDelay)
+		stopServing()
+	}()
+
+	if cfg.adminAddr != "" {
+		admin := &Admin{Server: srv, LogLevel: &logLevel, Reload: reload, Shutdown: stop}
+		serveBeside("admin API", &adminLn, admin.Router())
+		handover = append(handover, adminLn)
+	}
+
+	// SIGUSR2 replaces this process with a new one started from the
+	// executable (see upgrade), which takes over the listeners; this one
+	// then stops.
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			if err := upgrade(handover); err != nil {
+				slog.Error("upgrade failed, carrying on", "err", err)
+				continue
 			}
+			slog.Info("upgraded, handing over to the new process")
+			draining.Store(true)
+			stopServing()
+			return
+		}
+	}()
 
-		} else {
-			// --- 404 CATCH-ALL ---
-			conn.Write([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
+	fmt.Println("Logs from your program will appear here!")
+
+	// 2. Start Listening
+	// This blocks, accepting connections until a listener fails or we are
+	// told to stop, which closes the listeners and removes Unix socket files.
+	if err := srv.ListenAndServeAll(serveCtx, listeners); err != nil {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
+	}
+
+	// 3. Let the connections finish what they are doing
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		slog.Warn("closed connections still busy after -shutdown-timeout")
+	}
+}
+
+// serveBeside binds ln and serves router on it, beside the main server, for
+// what must not be exposed with it (metrics, the admin API). The process
+// exits if it fails.
+func serveBeside(what string, ln *Listener, router *Router, logAttrs ...any) {
+	if err := ln.bind(); err != nil {
+		slog.Error(what+" server stopped", "err", err)
+		os.Exit(1)
+	}
+	srv := &Server{Addr: ln.Addr, Router: router}
+	srv.OnReady = func(addr net.Addr) {
+		slog.Info("serving "+what, append([]any{"addr", addr.String()}, logAttrs...)...)
+	}
+	go func() {
+		if err := srv.ListenAndServeAll(context.Background(), []Listener{*ln}); err != nil {
+			slog.Error(what+" server stopped", "err", err)
+			os.Exit(1)
 		}
+	}()
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as path
+// and renames it into place once everything has been flushed to disk.
+// A rename within one directory is atomic, so other clients either see the old
+// file or the complete new one - never a truncated upload.
+// On any failure the temporary file is removed and the target is left untouched.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return writeFileAtomicFrom(path, bytes.NewReader(data), perm)
+}
 
-		// --- FINAL STEP: CHECK IF WE SHOULD CLOSE ---
-		// If the "Connection: close" header was present, we break the loop.
-		// This allows 'defer conn.Close()' to run, effectively hanging up the phone.
-		if shouldClose {
-			break
+// writeFileAtomicFrom is writeFileAtomic for data read from r, which is
+// copied to disk as it is read: only if all of r could be read does the file
+// replace path.
+func writeFileAtomicFrom(path string, r io.Reader, perm os.FileMode) error {
+	// The temp file must live in the target's directory: os.Rename cannot move
+	// files across filesystems atomically.
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	// Clean up the temp file if anything below fails.
+	success := false
+	defer func() {
+		if !success {
+			tmp.Close()
+			os.Remove(tmpName)
 		}
+	}()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return err
+	}
+	// Sync forces the data onto disk before the rename makes it visible.
+	if err := tmp.Sync(); err != nil {
+		return err
 	}
-}
\ No newline at end of file
+	// os.CreateTemp always uses 0600, so apply the requested permissions.
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+
+	success = true
+	return nil
+}
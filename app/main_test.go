@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"   // Used to read the response
+	"context" // Used to stop the server
+	"net"     // The loopback connection
+	"strings" // Used to check errors
+	"testing" // The test framework
+	"time"    // Used for deadlines
+)
+
+func TestListenAddressFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantAddr string
+		wantErr  string
+	}{
+		{"defaults", nil, "0.0.0.0:4221", ""},
+		{"host and port", []string{"-host", "127.0.0.1", "-port", "8080"}, "127.0.0.1:8080", ""},
+		{"IPv6 host", []string{"-host", "::1", "-port", "0"}, "[::1]:0", ""},
+		{"port too large", []string{"-port", "65536"}, "", "Invalid -port value: 65536"},
+		{"negative port", []string{"-port", "-1"}, "", "Invalid -port value: -1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := configure(append([]string{"-directory", t.TempDir()}, tt.args...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.server.Addr != tt.wantAddr {
+				t.Errorf("Addr = %q, want %q", cfg.server.Addr, tt.wantAddr)
+			}
+		})
+	}
+}
+
+// serveLoopback serves the server configured by args, as main does, and
+// returns the address it is reachable at.
+func serveLoopback(t *testing.T, args ...string) string {
+	t.Helper()
+	cfg, err := configure(append([]string{"-directory", t.TempDir(), "-host", "127.0.0.1", "-port", "0"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := cfg.newServer(nil, nil)
+	ready := make(chan net.Addr, 1)
+	s.OnReady = func(addr net.Addr) { ready <- addr }
+
+	ctx, stop := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- s.ListenAndServeAll(ctx, cfg.listeners(nil, nil)) }()
+	t.Cleanup(func() {
+		stop()
+		<-errs
+	})
+	select {
+	case addr := <-ready:
+		return addr.String()
+	case err := <-errs:
+		t.Fatalf("ListenAndServeAll: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the server never became ready")
+	}
+	return ""
+}
+
+func TestListenOnPortZero(t *testing.T) {
+	addr := serveLoopback(t)
+	if strings.HasSuffix(addr, ":0") {
+		t.Fatalf("OnReady reported %s, not the port bound", addr)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte(request("GET", "/echo/reachable", "")))
+	if resp := readResponse(t, bufio.NewReader(conn), "GET"); resp.status != 200 || resp.body != "reachable" {
+		t.Errorf("got %d %q", resp.status, resp.body)
+	}
+
+	// A second server on the same address fails, naming it.
+	s := newTestServer(t)
+	err = s.ListenAndServeAll(context.Background(), []Listener{{Addr: addr}})
+	if err == nil || !strings.Contains(err.Error(), "failed to bind to "+addr) {
+		t.Errorf("binding a taken address: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"         // Used to write the exposition format
+	"sort"        // Used to print series in a stable order
+	"strings"     // Used to build the response body
+	"sync"        // Used to guard the counters shared by all connections
+	"sync/atomic" // Used for the in-flight gauges
+	"time"        // Used to measure request durations
+)
+
+// durationBuckets are the upper bounds, in seconds, of the request duration
+// histogram (the Prometheus client defaults).
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects the numbers exposed on /metrics in the Prometheus text
+// format (https://prometheus.io/docs/instrumenting/exposition_formats/).
+// Requests are counted by Instrument, connections by handleConnection.
+type Metrics struct {
+	connections atomic.Int64 // Open connections
+	inFlight    atomic.Int64 // Requests currently being handled
+
+	mu            sync.Mutex
+	requests      map[[2]string]uint64 // By {method, status code}
+	bucketCounts  []uint64             // Requests at or under each durationBuckets bound
+	durationSum   float64              // Total seconds, for the histogram _sum
+	durationCount uint64
+	bytes         uint64 // Response body bytes written
+}
+
+// NewMetrics returns an empty set of metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:     make(map[[2]string]uint64),
+		bucketCounts: make([]uint64, len(durationBuckets)),
+	}
+}
+
+// Instrument returns middleware that records every request the router sees.
+// Install it with router.Use so every handler is covered.
+func (m *Metrics) Instrument() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, req *HTTPRequest) {
+			m.inFlight.Add(1)
+			defer m.inFlight.Add(-1)
+
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			next(sw, req)
+			m.observe(req.Method, sw.status, time.Since(start), sw.bytes)
+		}
+	}
+}
+
+// observe records one finished request.
+func (m *Metrics) observe(method string, status int, d time.Duration, bytes int64) {
+	if status == 0 {
+		status = 200
+	}
+	// Clients can send any method name; bound the number of series.
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+	default:
+		method = "OTHER"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[[2]string{method, fmt.Sprint(status)}]++
+	seconds := d.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			m.bucketCounts[i]++
+		}
+	}
+	m.durationSum += seconds
+	m.durationCount++
+	m.bytes += uint64(bytes)
+}
+
+// Handler returns the handler serving the metrics to Prometheus.
+func (m *Metrics) Handler() HandlerFunc {
+	return func(w ResponseWriter, req *HTTPRequest) {
+		headers := []string{"Content-Type: text/plain; version=0.0.4; charset=utf-8"}
+		sendResponse(w, 200, headers, m.String())
+	}
+}
+
+// String formats the metrics in the Prometheus text exposition format.
+func (m *Metrics) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# HELP http_connections_open Number of open client connections.\n")
+	fmt.Fprintf(&b, "# TYPE http_connections_open gauge\n")
+	fmt.Fprintf(&b, "http_connections_open %d\n", m.connections.Load())
+
+	fmt.Fprintf(&b, "# HELP http_requests_in_flight Number of requests being handled.\n")
+	fmt.Fprintf(&b, "# TYPE http_requests_in_flight gauge\n")
+	fmt.Fprintf(&b, "http_requests_in_flight %d\n", m.inFlight.Load())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(&b, "# HELP http_requests_total Requests handled, by method and status code.\n")
+	fmt.Fprintf(&b, "# TYPE http_requests_total counter\n")
+	keys := make([][2]string, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		fmt.Fprintf(&b, "http_requests_total{method=%q,code=%q} %d\n", key[0], key[1], m.requests[key])
+	}
+
+	fmt.Fprintf(&b, "# HELP http_request_duration_seconds Time spent handling requests.\n")
+	fmt.Fprintf(&b, "# TYPE http_request_duration_seconds histogram\n")
+	for i, bound := range durationBuckets {
+		fmt.Fprintf(&b, "http_request_duration_seconds_bucket{le=\"%g\"} %d\n", bound, m.bucketCounts[i])
+	}
+	fmt.Fprintf(&b, "http_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationCount)
+	fmt.Fprintf(&b, "http_request_duration_seconds_sum %g\n", m.durationSum)
+	fmt.Fprintf(&b, "http_request_duration_seconds_count %d\n", m.durationCount)
+
+	fmt.Fprintf(&b, "# HELP http_response_bytes_total Response body bytes written.\n")
+	fmt.Fprintf(&b, "# TYPE http_response_bytes_total counter\n")
+	fmt.Fprintf(&b, "http_response_bytes_total %d\n", m.bytes)
+
+	return b.String()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"         // Used to match file signatures
+	"mime"          // Used to look up types by extension
+	"os"            // Used to read the start of files to sniff
+	"path/filepath" // Used to get the file extension
+	"strings"       // Used to normalise extensions
+	"unicode/utf8"  // Used to recognise text files
+)
+
+// sniffLen is how much of a file is looked at to guess its type.
+const sniffLen = 512
+
+// contentType returns the Content-Type to serve the file at path with. The
+// extension decides, looked up first in MIMETypes and then in the system and
+// Go's built-in tables ("index.html" is "text/html; charset=utf-8"). Files
+// with an unknown or no extension are recognised from their first bytes.
+func (s *Server) contentType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != "" {
+		if t, ok := s.MIMETypes[ext]; ok {
+			return t
+		}
+		if t := mime.TypeByExtension(ext); t != "" {
+			return t
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+	buf := make([]byte, sniffLen)
+	n, _ := file.Read(buf)
+	return sniffContentType(buf[:n])
+}
+
+// fileSignatures are the magic numbers of common binary formats.
+var fileSignatures = []struct {
+	prefix      string
+	contentType string
+}{
+	{"%PDF-", "application/pdf"},
+	{"\x89PNG\r\n\x1a\n", "image/png"},
+	{"\xff\xd8\xff", "image/jpeg"},
+	{"GIF87a", "image/gif"},
+	{"GIF89a", "image/gif"},
+	{"PK\x03\x04", "application/zip"},
+	{"\x1f\x8b\x08", "application/gzip"},
+	{"\x00asm", "application/wasm"},
+}
+
+// sniffContentType guesses the type of data, the start of a file, in the
+// spirit of the WHATWG MIME Sniffing Standard: known signatures first, then
+// markup, then anything that reads as text. Everything else is
+// application/octet-stream, which browsers download rather than render.
+func sniffContentType(data []byte) string {
+	for _, sig := range fileSignatures {
+		if bytes.HasPrefix(data, []byte(sig.prefix)) {
+			return sig.contentType
+		}
+	}
+	// RIFF containers say what they hold at offset 8.
+	if len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP" {
+		return "image/webp"
+	}
+
+	start := bytes.ToLower(bytes.TrimLeft(data, " \t\r\n\f"))
+	switch {
+	case bytes.HasPrefix(start, []byte("<!doctype html")), bytes.HasPrefix(start, []byte("<html")):
+		return "text/html; charset=utf-8"
+	case bytes.HasPrefix(start, []byte("<?xml")):
+		return "text/xml; charset=utf-8"
+	}
+
+	if isText(data) {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+// isText reports whether data looks like UTF-8 text: valid encoding (a rune
+// cut off at the end of the sniffed bytes is fine) and no control characters
+// other than whitespace.
+func isText(data []byte) bool {
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size <= 1 {
+			// Allow a multi-byte character split by the sniffing window.
+			return len(data) < utf8.UTFMax && !utf8.FullRune(data)
+		}
+		if r < ' ' && r != '\t' && r != '\n' && r != '\r' && r != '\f' || r == 0x7f {
+			return false
+		}
+		data = data[size:]
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"     // Used to report invalid patterns
+	"regexp"  // Used by regular expression routes
+	"strconv" // Used to number regular expression groups
+	"strings" // Used to split patterns and paths into segments
+)
+
+// A route pattern is a path split into "/"-separated segments, each of which is:
+//
+//	files      a literal, which must match the path segment exactly
+//	{name}     a parameter, which matches any one non-empty segment
+//	{name...}  a catch-all, which matches the rest of the path (slashes included)
+//
+// A pattern ending in "/" is shorthand for an anonymous catch-all, so
+// "/files/" behaves like "/files/{...}" and matches everything under /files/.
+// The matched values are available to handlers in req.Params.
+type segmentKind int
+
+// The order matters: when two patterns match the same path, the one with the
+// higher kind at the first differing segment is more specific.
+const (
+	segmentCatchAll segmentKind = iota + 1
+	segmentParam
+	segmentLiteral
+)
+
+type segment struct {
+	kind  segmentKind
+	value string // the literal text, or the parameter name
+}
+
+// compilePattern splits pattern into segments. It panics on malformed
+// patterns, since those are programming errors caught at registration.
+func compilePattern(pattern string) []segment {
+	if !strings.HasPrefix(pattern, "/") {
+		panic(fmt.Sprintf("router: pattern %q must start with /", pattern))
+	}
+
+	parts := strings.Split(pattern[1:], "/")
+	segments := make([]segment, 0, len(parts))
+	for i, part := range parts {
+		last := i == len(parts)-1
+		switch {
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "...}"):
+			if !last {
+				panic(fmt.Sprintf("router: catch-all must be the last segment in %q", pattern))
+			}
+			segments = append(segments, segment{segmentCatchAll, part[1 : len(part)-4]})
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			segments = append(segments, segment{segmentParam, part[1 : len(part)-1]})
+		case part == "" && last && pattern != "/":
+			// Trailing slash: match everything below this point.
+			segments = append(segments, segment{segmentCatchAll, ""})
+		default:
+			segments = append(segments, segment{segmentLiteral, part})
+		}
+	}
+	return segments
+}
+
+// matchSegments matches path against segments and returns the captured
+// parameters. params is nil for patterns without named parameters.
+func matchSegments(segments []segment, path string) (params map[string]string, ok bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	rest := path[1:]
+
+	for i, seg := range segments {
+		if seg.kind == segmentCatchAll {
+			if seg.value != "" {
+				params = setParam(params, seg.value, rest)
+			}
+			return params, true
+		}
+
+		// Take the next segment off the path.
+		part, tail, more := strings.Cut(rest, "/")
+		switch seg.kind {
+		case segmentLiteral:
+			if part != seg.value {
+				return nil, false
+			}
+		case segmentParam:
+			if part == "" {
+				return nil, false
+			}
+			params = setParam(params, seg.value, part)
+		}
+
+		last := i == len(segments)-1
+		if !more {
+			// The path ran out: it matches only if the pattern did too.
+			return params, last
+		}
+		if last {
+			return nil, false // The path is longer than the pattern.
+		}
+		rest = tail
+	}
+	return params, false
+}
+
+// matchRegex matches path against re and returns the groups it captured,
+// by number and by name. params is nil when re has no groups.
+func matchRegex(re *regexp.Regexp, path string) (params map[string]string, ok bool) {
+	match := re.FindStringSubmatch(path)
+	if match == nil {
+		return nil, false
+	}
+	for i, name := range re.SubexpNames()[1:] {
+		params = setParam(params, strconv.Itoa(i+1), match[i+1])
+		if name != "" {
+			params = setParam(params, name, match[i+1])
+		}
+	}
+	return params, true
+}
+
+// endsInCatchAll reports whether a pattern ends in a catch-all or prefix.
+func endsInCatchAll(segments []segment) bool {
+	return len(segments) > 0 && segments[len(segments)-1].kind == segmentCatchAll
+}
+
+// setParam stores a parameter, allocating the map on first use.
+func setParam(params map[string]string, name, value string) map[string]string {
+	if params == nil {
+		params = make(map[string]string)
+	}
+	params[name] = value
+	return params
+}
+
+// compareSpecificity returns a positive number if a is more specific than b,
+// negative if less, and 0 if they are equally specific. Segments are compared
+// left to right: literal beats parameter beats catch-all, and a pattern that
+// continues beats one that has ended. So "/files/readme" beats
+// "/files/{name}", which beats "/files/".
+func compareSpecificity(a, b []segment) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var ka, kb segmentKind
+		if i < len(a) {
+			ka = a[i].kind
+		}
+		if i < len(b) {
+			kb = b[i].kind
+		}
+		if ka != kb {
+			return int(ka) - int(kb)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"         // Connection readers and response writers are pooled
+	"bytes"         // Scratch buffers are pooled
+	"compress/gzip" // gzip writers are pooled
+	"sync"          // sync.Pool recycles the objects between requests
+
+	"github.com/andybalholm/brotli"      // brotli writers are pooled
+	"github.com/klauspost/compress/zstd" // zstd encoders are pooled
+)
+
+// Every connection needs a read buffer and every response a write buffer
+// (4KB each), and a compressor carries hundreds of KB (brotli and zstd, a few
+// MB) of state.
+// Allocating them per request makes the garbage collector do most of the
+// work under load, so they are recycled through these pools instead.
+var (
+	readerPool = sync.Pool{New: func() any { return bufio.NewReader(nil) }}
+	writerPool = sync.Pool{New: func() any { return bufio.NewWriter(nil) }}
+	bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+	gzipPool   = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+	brotliPool = sync.Pool{New: func() any { return brotli.NewWriter(nil) }}
+	zstdPool   = sync.Pool{New: func() any { return newZstdEncoder() }}
+)
+
+// newZstdEncoder returns a zstd encoder for response bodies. By default it
+// compresses on as many goroutines as there are CPUs, which only pays off
+// for inputs far larger than a response; one is plenty here. The window is
+// kept to the 8MB every HTTP client must support (RFC 8878 3.1.1.1.2).
+func newZstdEncoder() *zstd.Encoder {
+	enc, err := zstd.NewWriter(nil,
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithWindowSize(8<<20),
+	)
+	if err != nil {
+		panic(err) // Only invalid options fail, and these are fixed.
+	}
+	return enc
+}
+
+// maxPooledBufferBytes keeps a buffer that grew for one large body from
+// being held on to for the lifetime of the process.
+const maxPooledBufferBytes = 64 << 10
+
+// getBuffer returns an empty scratch buffer. Hand it back with putBuffer
+// once its contents have been copied out.
+func getBuffer() *bytes.Buffer {
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+// putBuffer returns b to the pool.
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() <= maxPooledBufferBytes {
+		bufferPool.Put(b)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"   // Used to read responses off the wire
+	"bytes"   // Used to pick headers out of responses
+	"strconv" // Used to parse Content-Length and chunk sizes
+	"strings" // Used to build request bodies
+	"testing" // The test framework
+	"time"    // Used to lift the connection deadline
+)
+
+// The benchmarks send the same request over and over on one keep-alive
+// connection and report allocations: what they measure is the per-request
+// cost that pooling connection readers, response writers and gzip writers is
+// there to cut.
+
+// discardResponse reads one response off r without allocating, so that
+// benchmarks measure the server rather than the client. It understands just
+// enough HTTP for the server's own responses: a body of Content-Length
+// bytes, or a chunked one.
+func discardResponse(r *bufio.Reader) error {
+	length, chunked := 0, false
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if len(line) == 2 {
+			break // The blank line ending the head
+		}
+		if value, ok := bytes.CutPrefix(line, []byte("Content-Length: ")); ok {
+			if length, err = strconv.Atoi(string(bytes.TrimSpace(value))); err != nil {
+				return err
+			}
+		}
+		chunked = chunked || bytes.Equal(line, []byte("Transfer-Encoding: chunked\r\n"))
+	}
+	if !chunked {
+		_, err := r.Discard(length)
+		return err
+	}
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		size, err := strconv.ParseInt(string(bytes.TrimSpace(line)), 16, 64)
+		if err != nil {
+			return err
+		}
+		// The chunk and its CRLF; the last, empty, chunk is followed by the
+		// CRLF ending the (empty) trailers.
+		if _, err := r.Discard(int(size) + 2); err != nil || size == 0 {
+			return err
+		}
+	}
+}
+
+// benchmarkRequest measures the server answering raw over and over on one
+// keep-alive connection.
+func benchmarkRequest(b *testing.B, raw string) {
+	s := newTestServer(b, "-max-keepalive-requests", "0")
+	conn := dial(b, s)
+	conn.SetDeadline(time.Time{})
+	r := bufio.NewReader(conn)
+	request := []byte(raw)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := conn.Write(request); err != nil {
+			b.Fatal(err)
+		}
+		if err := discardResponse(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkKeepAliveGet(b *testing.B) {
+	benchmarkRequest(b, request("GET", "/echo/hello", ""))
+}
+
+func BenchmarkGzipEcho(b *testing.B) {
+	benchmarkRequest(b, request("GET", "/echo/"+strings.Repeat("hello", 100), "", "Accept-Encoding: gzip"))
+}
+
+func BenchmarkUpload(b *testing.B) {
+	benchmarkRequest(b, request("POST", "/files/f.txt", strings.Repeat("upload ", 1000)))
+}
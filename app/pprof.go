@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"           // Used to build the index page
+	"runtime/pprof" // Used to collect the profiles
+	"runtime/trace" // Used to collect execution traces
+	"strconv"       // Used to parse the seconds and debug parameters
+	"strings"       // Used to build the index page
+	"time"          // Used to time CPU profiles and traces
+)
+
+// The profiling endpoints mirror net/http/pprof, so the usual tools work
+// against this server directly:
+//
+//	go tool pprof http://localhost:4221/debug/pprof/profile?seconds=10
+//	go tool pprof http://localhost:4221/debug/pprof/heap
+//	curl 'http://localhost:4221/debug/pprof/goroutine?debug=2'
+//
+// They expose internals (and a CPU profile costs real CPU), so they are only
+// registered with -debug.
+
+// registerDebugRoutes adds the /debug/pprof/ endpoints to the router.
+func (s *Server) registerDebugRoutes() {
+	s.Router.Get("/debug/pprof/", pprofIndexHandler)
+	s.Router.Get("/debug/pprof/profile", pprofCPUHandler)
+	s.Router.Get("/debug/pprof/trace", pprofTraceHandler)
+	s.Router.Get("/debug/pprof/{name}", pprofProfileHandler)
+}
+
+// pprofIndexHandler lists the available profiles.
+func pprofIndexHandler(w ResponseWriter, req *HTTPRequest) {
+	var b strings.Builder
+	b.WriteString("Profiles (add ?debug=1 for text):\n\n")
+	for _, p := range pprof.Profiles() {
+		fmt.Fprintf(&b, "%6d  /debug/pprof/%s\n", p.Count(), p.Name())
+	}
+	b.WriteString("\n        /debug/pprof/profile?seconds=30  CPU profile\n")
+	b.WriteString("        /debug/pprof/trace?seconds=1     execution trace\n")
+	sendResponse(w, 200, []string{"Content-Type: text/plain; charset=utf-8"}, b.String())
+}
+
+// pprofProfileHandler writes a named runtime profile (heap, goroutine,
+// allocs, block, mutex, threadcreate). debug=0, the default, is the binary
+// format go tool pprof reads; debug=1 and 2 are human-readable text.
+func pprofProfileHandler(w ResponseWriter, req *HTTPRequest) {
+	profile := pprof.Lookup(req.Params["name"])
+	if profile == nil {
+		sendResponse(w, 404, nil, "")
+		return
+	}
+	debug, _ := strconv.Atoi(req.Query.Get("debug"))
+
+	contentType := "application/octet-stream"
+	if debug > 0 {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// The size is unknown until the profile is written, so it is streamed.
+	profile.WriteTo(w, debug)
+}
+
+// pprofCPUHandler records a CPU profile for ?seconds=N (default 30) and
+// sends it once done.
+func pprofCPUHandler(w ResponseWriter, req *HTTPRequest) {
+	seconds := profileSeconds(req, 30)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// Only one CPU profile can run at a time.
+	if err := pprof.StartCPUProfile(w); err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		sendResponse(w, 500, nil, "Could not start CPU profile: "+err.Error()+"\n")
+		return
+	}
+	time.Sleep(seconds)
+	pprof.StopCPUProfile()
+}
+
+// pprofTraceHandler records an execution trace for ?seconds=N (default 1),
+// for go tool trace.
+func pprofTraceHandler(w ResponseWriter, req *HTTPRequest) {
+	seconds := profileSeconds(req, 1)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := trace.Start(w); err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		sendResponse(w, 500, nil, "Could not start trace: "+err.Error()+"\n")
+		return
+	}
+	time.Sleep(seconds)
+	trace.Stop()
+}
+
+// profileSeconds returns the ?seconds= parameter, or def if it is missing or invalid.
+func profileSeconds(req *HTTPRequest, def int) time.Duration {
+	seconds, err := strconv.Atoi(req.Query.Get("seconds"))
+	if err != nil || seconds <= 0 {
+		seconds = def
+	}
+	return time.Duration(seconds) * time.Second
+}
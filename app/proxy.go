@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"       // Used to recognise upstreams that cannot be reached
+	"fmt"          // Used to report invalid -proxy values
+	"io"           // Used to stream bodies both ways
+	"log/slog"     // Used to log failed upstream requests
+	"math/rand/v2" // Used by the random strategy
+	"net"          // Used to recognise dial errors
+	"net/http"     // Used to talk to the upstreams
+	"net/url"      // Used to parse upstream addresses
+	"strconv"      // Used to format Content-Length
+	"strings"      // Used to parse -proxy values
+	"sync/atomic"  // Used for the per-upstream counters
+	"time"         // Used for the upstream timeouts
+)
+
+// Upstream is a server requests can be forwarded to.
+type Upstream struct {
+	URL *url.URL // e.g. http://10.0.0.1:8080
+
+	// active counts the requests in flight to it, for least-connections.
+	active atomic.Int64
+}
+
+// Balancer picks the upstream each request goes to.
+type Balancer interface {
+	// Next returns one of upstreams, which is never empty.
+	Next(upstreams []*Upstream) *Upstream
+}
+
+// NewBalancer returns the balancing strategy called name:
+//   - "round-robin": each upstream in turn;
+//   - "least-connections": the one with the fewest requests in flight;
+//   - "random": any one, picked at random.
+func NewBalancer(name string) (Balancer, error) {
+	switch name {
+	case "round-robin", "":
+		return &roundRobin{}, nil
+	case "least-connections":
+		return leastConnections{}, nil
+	case "random":
+		return random{}, nil
+	}
+	return nil, fmt.Errorf("unknown balancing strategy %q", name)
+}
+
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+func (b *roundRobin) Next(upstreams []*Upstream) *Upstream {
+	return upstreams[(b.next.Add(1)-1)%uint64(len(upstreams))]
+}
+
+type leastConnections struct{}
+
+func (leastConnections) Next(upstreams []*Upstream) *Upstream {
+	best := upstreams[0]
+	for _, u := range upstreams[1:] {
+		if u.active.Load() < best.active.Load() {
+			best = u
+		}
+	}
+	return best
+}
+
+type random struct{}
+
+func (random) Next(upstreams []*Upstream) *Upstream {
+	return upstreams[rand.IntN(len(upstreams))]
+}
+
+// ReverseProxy forwards the requests under Prefix to a pool of upstreams,
+// making the server a simple layer 7 load balancer. The path and query are
+// forwarded unchanged, with X-Forwarded-For/-Host/-Proto telling the upstream
+// who the client is. Bodies are streamed both ways.
+//
+// An upstream that cannot be connected to is skipped in favour of the next
+// one the Balancer picks; the request has not been sent, so this is safe
+// whatever the method. When none is reachable the client gets 502.
+type ReverseProxy struct {
+	Prefix    string // e.g. "/api/"
+	Upstreams []*Upstream
+	Balancer  Balancer
+
+	transport http.RoundTripper
+}
+
+// parseProxySpec parses a -proxy value:
+//
+//	/api/=http://10.0.0.1:8080,http://10.0.0.2:8080;strategy=least-connections
+//
+// The strategy defaults to round-robin.
+func parseProxySpec(spec string) (*ReverseProxy, error) {
+	spec, options, _ := strings.Cut(spec, ";")
+	prefix, targets, ok := strings.Cut(spec, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return nil, errors.New(`expected "/prefix/=http://host:port,..."`)
+	}
+
+	strategy := ""
+	for _, option := range strings.Split(options, ";") {
+		if option == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(option, "=")
+		if key != "strategy" {
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+		strategy = value
+	}
+	balancer, err := NewBalancer(strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	p := NewReverseProxy(prefix, balancer)
+	for _, target := range strings.Split(targets, ",") {
+		u, err := url.Parse(strings.TrimSpace(target))
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid upstream %q", target)
+		}
+		p.Upstreams = append(p.Upstreams, &Upstream{URL: u})
+	}
+	return p, nil
+}
+
+// NewReverseProxy returns a proxy for prefix without upstreams yet.
+func NewReverseProxy(prefix string, balancer Balancer) *ReverseProxy {
+	return &ReverseProxy{
+		Prefix:   prefix,
+		Balancer: balancer,
+		transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+			MaxIdleConnsPerHost: 32,
+			IdleConnTimeout:     90 * time.Second,
+			// Pass Accept-Encoding and compressed bodies through untouched.
+			DisableCompression: true,
+		},
+	}
+}
+
+// register adds the proxy's routes to r. The bodies are streamed to the
+// upstream rather than buffered.
+func (p *ReverseProxy) register(r *Router) {
+	pattern := p.Prefix
+	if !strings.HasSuffix(pattern, "/") {
+		pattern += "/"
+	}
+	for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"} {
+		r.HandleStream(method, pattern, p.ServeRequest)
+		if pattern != p.Prefix {
+			r.HandleStream(method, p.Prefix, p.ServeRequest) // "/api" itself
+		}
+	}
+}
+
+// ServeRequest forwards req to an upstream and copies its response back.
+func (p *ReverseProxy) ServeRequest(w ResponseWriter, req *HTTPRequest) {
+	tried := make(map[*Upstream]bool)
+	for len(tried) < len(p.Upstreams) {
+		var candidates []*Upstream
+		for _, u := range p.Upstreams {
+			if !tried[u] {
+				candidates = append(candidates, u)
+			}
+		}
+		upstream := p.Balancer.Next(candidates)
+		tried[upstream] = true
+
+		resp, err := p.roundTrip(upstream, req)
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			slog.Warn("upstream unreachable", "request_id", req.ID, "upstream", upstream.URL.Host, "err", err)
+			continue // Nothing was sent: try another one
+		}
+		if err != nil {
+			slog.Warn("upstream request failed", "request_id", req.ID, "upstream", upstream.URL.Host, "err", err)
+			sendResponse(w, 502, nil, "")
+			return
+		}
+		p.copyResponse(w, resp, req)
+		return
+	}
+	sendResponse(w, 502, nil, "")
+}
+
+// roundTrip sends req to upstream.
+func (p *ReverseProxy) roundTrip(upstream *Upstream, req *HTTPRequest) (*http.Response, error) {
+	upstream.active.Add(1)
+	defer upstream.active.Add(-1)
+
+	target := strings.TrimSuffix(upstream.URL.String(), "/") + req.RawPath
+	if req.RawQuery != "" {
+		target += "?" + req.RawQuery
+	}
+	var body io.Reader = strings.NewReader(req.Body)
+	if req.BodyReader != nil {
+		body = req.BodyReader
+	}
+	out, err := http.NewRequest(req.Method, target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Chunked bodies have no length; the transport chunks them again.
+	out.ContentLength = -1
+	if !req.isChunked() {
+		out.ContentLength, _ = req.contentLength()
+		if out.ContentLength == 0 {
+			out.Body = http.NoBody
+		}
+	}
+
+	for name, values := range req.Headers {
+		out.Header[name] = append([]string(nil), values...)
+	}
+	removeHopByHop(out.Header, req.Header("Connection"))
+	out.Header.Set("X-Request-ID", req.ID)
+	if prior := req.Header("X-Forwarded-For"); prior != "" {
+		out.Header.Set("X-Forwarded-For", prior+", "+clientIP(req.RemoteAddr))
+	} else {
+		out.Header.Set("X-Forwarded-For", clientIP(req.RemoteAddr))
+	}
+	out.Header.Set("X-Forwarded-Host", req.Header("Host"))
+	out.Header.Set("X-Forwarded-Proto", "http")
+
+	// The response body is read after the counter drops: least-connections
+	// counts requests waiting for an answer, which is what loads a server.
+	return p.transport.RoundTrip(out)
+}
+
+// copyResponse sends the upstream's response to the client.
+func (p *ReverseProxy) copyResponse(w ResponseWriter, resp *http.Response, req *HTTPRequest) {
+	defer resp.Body.Close()
+
+	removeHopByHop(resp.Header, resp.Header.Get("Connection"))
+	for name, values := range resp.Header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Del("Content-Length")
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		slog.Warn("copy upstream response failed", "request_id", req.ID, "err", err)
+		// The client must not take a truncated body for a complete one.
+		panic(errAborted)
+	}
+}
+
+// removeHopByHop deletes the headers that only concern one connection
+// (RFC 9110 7.6.1), including those listed in its Connection header.
+func removeHopByHop(h http.Header, connection string) {
+	for _, name := range strings.Split(connection, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			h.Del(name)
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+	h.Del("Te")
+	h.Del("Trailer")
+}
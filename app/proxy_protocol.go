@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"           // Used to peek at and consume the header without losing request bytes
+	"bytes"           // Used to compare the binary v2 signature
+	"encoding/binary" // Used to decode big-endian lengths and ports in v2 headers
+	"errors"          // Used to create descriptive parse errors
+	"fmt"             // Used to wrap errors with context
+	"io"              // Used to read exact byte counts (io.ReadFull)
+	"net"             // Used to build the client's net.TCPAddr
+	"strconv"         // Used to parse port numbers in v1 headers
+	"strings"         // Used to split the v1 text header
+)
+
+// The PROXY protocol lets a load balancer tell us who the real client is.
+// Without it every connection appears to come from the balancer's own IP.
+// Spec: https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+//
+// Version 1 is a single human-readable line:
+//
+//	PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+//
+// Version 2 is binary and starts with a fixed 12 byte signature.
+
+// proxyV2Signature is the magic prefix of every v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// proxyV1MaxLength is the longest possible v1 line (including CRLF) per the spec.
+	proxyV1MaxLength = 107
+
+	// Address families in the v2 header (upper nibble of byte 14).
+	proxyV2FamilyUnspec = 0x0
+	proxyV2FamilyInet   = 0x1
+	proxyV2FamilyInet6  = 0x2
+)
+
+// readProxyHeader consumes a PROXY protocol header (v1 or v2, auto-detected)
+// from the start of the connection and returns the original client address.
+// It returns a nil address when the header is valid but carries no address
+// (v1 "UNKNOWN" or the v2 LOCAL command used by proxies for health checks).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// Both versions start with a distinctive first byte: 'P' for "PROXY"
+	// and '\r' for the v2 signature.
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case 'P':
+		return readProxyV1(r)
+	case '\r':
+		return readProxyV2(r)
+	default:
+		return nil, errors.New("missing PROXY protocol header")
+	}
+}
+
+// readProxyV1 parses the text form: "PROXY <proto> <src> <dst> <sport> <dport>\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// Read byte by byte up to the maximum length so a client cannot make us
+	// buffer an unbounded line.
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long")
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+
+	// "UNKNOWN" means the proxy could not determine the source; keep the real peer.
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("unsupported PROXY v1 protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid PROXY v1 source address %q", fields[2])
+	}
+	port, err := strconv.Atoi(fields[4])
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid PROXY v1 source port %q", fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 parses the binary form:
+//
+//	bytes 0-11   signature
+//	byte  12     version (upper nibble, must be 2) and command (lower nibble)
+//	byte  13     address family (upper nibble) and transport (lower nibble)
+//	bytes 14-15  length of the address block that follows
+//	bytes 16...  source address, destination address, source port, destination port
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errors.New("invalid PROXY v2 signature")
+	}
+
+	version := header[12] >> 4
+	command := header[12] & 0x0F
+	family := header[13] >> 4
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+
+	// Always consume the full address block, even if we ignore it, so the
+	// HTTP request starts exactly where the header ends.
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0:
+		// LOCAL: the proxy opened the connection itself (e.g. a health check).
+		return nil, nil
+	case 0x1:
+		// PROXY: the connection was relayed on behalf of a client.
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", command)
+	}
+
+	switch family {
+	case proxyV2FamilyInet:
+		// 4 (src) + 4 (dst) + 2 (sport) + 2 (dport)
+		if len(payload) < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		ip := net.IP(payload[0:4])
+		port := binary.BigEndian.Uint16(payload[8:10])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+
+	case proxyV2FamilyInet6:
+		// 16 (src) + 16 (dst) + 2 (sport) + 2 (dport)
+		if len(payload) < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		ip := net.IP(payload[0:16])
+		port := binary.BigEndian.Uint16(payload[32:34])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+
+	case proxyV2FamilyUnspec:
+		return nil, nil
+
+	default:
+		// Unix sockets and unknown families carry no useful IP address.
+		return nil, nil
+	}
+}
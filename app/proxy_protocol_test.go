@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"           // readProxyHeader reads from a bufio.Reader
+	"bytes"           // Used to capture the access log
+	"encoding/binary" // Used to build v2 headers
+	"io"              // Used to read what follows the header
+	"net"             // Used to build addresses
+	"strings"         // Used to build v1 headers
+	"testing"         // The test framework
+)
+
+// proxyV2Header returns a v2 header for command (0 LOCAL, 1 PROXY) relaying
+// a TCP connection from src to dst.
+func proxyV2Header(command byte, src, dst *net.TCPAddr) []byte {
+	var family byte = proxyV2FamilyInet
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil {
+		family = proxyV2FamilyInet6
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	block := append(append([]byte{}, srcIP...), dstIP...)
+	block = binary.BigEndian.AppendUint16(block, uint16(src.Port))
+	block = binary.BigEndian.AppendUint16(block, uint16(dst.Port))
+
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family<<4|0x1) // TCP
+	header = binary.BigEndian.AppendUint16(header, uint16(len(block)))
+	return append(header, block...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src4 := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 56324}
+	dst4 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 4000}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+
+	tests := []struct {
+		name    string
+		header  []byte
+		want    string // "" for no address
+		wantErr bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n"), "203.0.113.7:56324", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 4000 443\r\n"), "[2001:db8::7]:4000", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), "", true},
+		{"v2 IPv4", proxyV2Header(1, src4, dst4), "203.0.113.7:56324", false},
+		{"v2 IPv6", proxyV2Header(1, src6, dst6), "[2001:db8::7]:4000", false},
+		{"v2 LOCAL", proxyV2Header(0, src4, dst4), "", false},
+		{"v2 bad version", append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 0), "", true},
+		{"no header", []byte("GET / HTTP/1.1\r\n"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(tt.header), strings.NewReader("GET / HTTP/1.1\r\n")))
+			addr, err := readProxyHeader(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("address = %q, want %q", got, tt.want)
+			}
+			// The request starts right after the header.
+			if rest, _ := r.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("after the header: %q", rest)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolV2ClientAddress(t *testing.T) {
+	cfg, err := configure([]string{"-directory", t.TempDir(), "-proxy-protocol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	s := cfg.newServer(nil, &log)
+
+	header := proxyV2Header(1, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443})
+	_, r := send(t, s, string(header)+request("GET", "/", ""))
+	if resp := readResponse(t, r, "GET"); resp.status != 200 {
+		t.Fatalf("status = %d, want 200", resp.status)
+	}
+	// The access log names the client, not the proxy.
+	if !strings.HasPrefix(log.String(), "203.0.113.7 ") {
+		t.Errorf("access log: %q", log.String())
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"  // Used to distinguish unsatisfiable ranges from invalid ones
+	"strconv" // Used to parse range offsets
+	"strings" // Used to split the Range header
+	"time"    // Used to compare If-Range dates
+)
+
+// errUnsatisfiableRange means the Range header is valid but none of the
+// requested bytes exist (e.g. "bytes=500-" on a 100 byte file). The server
+// answers with 416 and "Content-Range: bytes */<size>".
+var errUnsatisfiableRange = errors.New("range not satisfiable")
+
+// errInvalidRange means the Range header could not be understood. Per
+// RFC 9110 such headers are ignored and the full resource is served.
+var errInvalidRange = errors.New("invalid range")
+
+// ifRangeMatches reports whether a Range request may be honoured given its
+// If-Range header (RFC 9110 13.1.5). A client resuming a download sends the
+// validator of the copy it has; if the file changed since, the pieces would
+// not fit together, so it gets the whole new file instead. The validator is
+// either an entity tag, which must equal etag, or a date, which must equal
+// the Last-Modified time exactly.
+func ifRangeMatches(req *HTTPRequest, modTime time.Time, etag string) bool {
+	value := req.Header("If-Range")
+	if value == "" {
+		return true
+	}
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/") {
+		// Weak tags never match here: a range needs byte-for-byte equality.
+		return value == etag
+	}
+	date, err := parseHTTPDate(value)
+	if err != nil {
+		return false
+	}
+	return modTime.Truncate(time.Second).Equal(date)
+}
+
+// parseByteRange parses a single-range "Range: bytes=..." header for a
+// resource that is size bytes long and returns the first and last byte
+// offsets (inclusive). The three forms are:
+//
+//	bytes=0-99   the first 100 bytes
+//	bytes=100-   everything from offset 100
+//	bytes=-100   the last 100 bytes
+func parseByteRange(header string, size int64) (start, end int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		// Other units and multiple ranges are not supported: serve everything.
+		return 0, 0, errInvalidRange
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, errInvalidRange
+	}
+
+	if first == "" {
+		// Suffix range: the last N bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, errInvalidRange
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, errUnsatisfiableRange
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errInvalidRange
+	}
+
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, errInvalidRange
+		}
+		// A range running past the end is clamped to the last byte.
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+
+	if start >= size {
+		return 0, 0, errUnsatisfiableRange
+	}
+	return start, end, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"container/list" // Used to keep the buckets in least recently used order
+	"math"           // Used to round Retry-After up
+	"net"            // Used to strip the port from the client address
+	"strconv"        // Used to format Retry-After
+	"sync"           // Used to guard the buckets shared by all connections
+	"time"           // Used to refill the buckets
+)
+
+// rateLimitSweepInterval is how often idle buckets are looked for.
+const rateLimitSweepInterval = time.Minute
+
+// maxRateLimitClients caps how many clients are tracked, so a flood of
+// distinct addresses cannot grow the map unbounded: past it, the least
+// recently seen client is forgotten.
+const maxRateLimitClients = 100000
+
+// tokenBucket holds the allowance of one client. It gains rate tokens per
+// second up to burst, and every request spends one.
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is the shared state of one RateLimit middleware. The buckets
+// are also kept in a list, most recently used first, so that the client to
+// forget when the map is full, and those idle long enough to sweep, are
+// found at its back without scanning the whole map.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*list.Element // Of *tokenBucket, in lru
+	lru       list.List
+	lastSweep time.Time
+}
+
+// RateLimit returns middleware that allows each client IP rate requests per
+// second on average, with bursts of up to burst requests. Requests over the
+// limit get 429 with a Retry-After header saying how many seconds to wait.
+//
+// Install it for every route with router.Use, or for selected ones by
+// wrapping their handler; each RateLimit call keeps its own counters:
+//
+//	router.Post("/files/{name...}", RateLimit(1, 5)(s.createFileHandler))
+func RateLimit(rate float64, burst int) Middleware {
+	limiter := &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*list.Element),
+		lastSweep: time.Now(),
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, req *HTTPRequest) {
+			if wait, ok := limiter.allow(clientIP(req.RemoteAddr), time.Now()); !ok {
+				retryAfter := int(math.Ceil(wait.Seconds()))
+				sendResponse(w, 429, []string{"Retry-After: " + strconv.Itoa(retryAfter)}, "")
+				return
+			}
+			next(w, req)
+		}
+	}
+}
+
+// allow spends a token of key's bucket. If none is left it returns false and
+// how long until the next token arrives.
+func (l *rateLimiter) allow(key string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	var b *tokenBucket
+	if e, ok := l.buckets[key]; ok {
+		b = e.Value.(*tokenBucket)
+		l.lru.MoveToFront(e)
+	} else {
+		// Full: make room by forgetting the least recently seen client.
+		if len(l.buckets) >= maxRateLimitClients {
+			l.remove(l.lru.Back())
+		}
+		// New clients start with a full bucket.
+		b = &tokenBucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+
+	// Refill for the time elapsed since the last request.
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		missing := 1 - b.tokens
+		return time.Duration(missing / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// sweep forgets clients that have been idle long enough for their bucket to
+// be full again: a fresh bucket would behave exactly the same. They are all
+// at the back of the list, so sweeping stops at the first busier client.
+func (l *rateLimiter) sweep(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for e := l.lru.Back(); e != nil && now.Sub(e.Value.(*tokenBucket).last) >= refill; e = l.lru.Back() {
+		l.remove(e)
+	}
+	l.lastSweep = now
+}
+
+// remove forgets the client of e.
+func (l *rateLimiter) remove(e *list.Element) {
+	delete(l.buckets, e.Value.(*tokenBucket).key)
+	l.lru.Remove(e)
+}
+
+// clientIP returns the IP part of a "host:port" address, so all connections
+// from one machine share a bucket.
+func clientIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
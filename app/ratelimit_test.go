@@ -0,0 +1,54 @@
+package main
+
+import (
+	"container/list" // The limiter's bucket list
+	"strconv"        // Used to name clients
+	"testing"        // The test framework
+	"time"           // Used to advance the clock
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{rate: 1, burst: 2, buckets: make(map[string]*list.Element), lastSweep: time.Now()}
+	now := l.lastSweep
+	for i, want := range []bool{true, true, false} {
+		if _, ok := l.allow("a", now); ok != want {
+			t.Fatalf("request %d: allowed = %v, want %v", i+1, ok, want)
+		}
+	}
+	if wait, ok := l.allow("a", now); ok || wait != time.Second {
+		t.Errorf("over the limit: wait %v, allowed %v; want 1s, false", wait, ok)
+	}
+	if _, ok := l.allow("b", now); !ok {
+		t.Error("another client was refused")
+	}
+	if _, ok := l.allow("a", now.Add(time.Second)); !ok {
+		t.Error("refused after a token was refilled")
+	}
+}
+
+func TestRateLimiterForgetsClients(t *testing.T) {
+	l := &rateLimiter{rate: 1, burst: 1, buckets: make(map[string]*list.Element), lastSweep: time.Now()}
+	now := l.lastSweep
+
+	// Full: each new client pushes out the least recently seen one.
+	for i := range maxRateLimitClients {
+		l.allow(strconv.Itoa(i), now)
+	}
+	l.allow("0", now) // Seen again, so "1" is now the oldest
+	l.allow("new", now)
+	if len(l.buckets) != maxRateLimitClients || l.lru.Len() != maxRateLimitClients {
+		t.Fatalf("%d buckets, %d in the list; want %d", len(l.buckets), l.lru.Len(), maxRateLimitClients)
+	}
+	for key, want := range map[string]bool{"0": true, "1": false, "2": true, "new": true} {
+		if _, ok := l.buckets[key]; ok != want {
+			t.Errorf("client %q tracked = %v, want %v", key, ok, want)
+		}
+	}
+
+	// Once the sweep interval is over, the clients whose bucket has refilled
+	// since are forgotten.
+	l.allow("last", now.Add(rateLimitSweepInterval+time.Second))
+	if len(l.buckets) != 1 || l.lru.Len() != 1 {
+		t.Errorf("%d buckets, %d in the list after the sweep; want 1", len(l.buckets), l.lru.Len())
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"  // Used to report invalid rules
+	"fmt"     // Used to report invalid statuses
+	"net/url" // Used to escape the parameters put in targets
+	"strconv" // Used to parse statuses
+	"strings" // Used to parse rules and fill in targets
+)
+
+// RedirectRule sends requests whose path matches Source elsewhere, before
+// routing: vanity URLs ("/docs" to a documentation site) and resources that
+// moved ("/blog/{slug}" to "/posts/{slug}").
+type RedirectRule struct {
+	// Source is a route pattern (see pattern.go), e.g. "/old/{name...}".
+	Source string
+	// Target is the path or URL redirected to. "{name}" in it is replaced
+	// by the parameter Source captured under that name. The request's
+	// query string is kept, unless Target has one of its own.
+	Target string
+	// Status is 301 or 308 for a permanent move, 302 or 307 for a temporary
+	// one; 307 and 308 make clients repeat the method and body, where 301
+	// and 302 let them switch to GET.
+	Status int
+
+	segments []segment
+}
+
+// parseRedirectRule parses a -redirect value:
+//
+//	/blog/{slug}=/posts/{slug};status=308
+//
+// The status defaults to 301.
+func parseRedirectRule(spec string) (rule RedirectRule, err error) {
+	spec, options, _ := strings.Cut(spec, ";")
+	source, target, ok := strings.Cut(spec, "=")
+	if !ok || !strings.HasPrefix(source, "/") || target == "" {
+		return RedirectRule{}, errors.New(`expected "/source=target"`)
+	}
+
+	// compilePattern panics on malformed patterns, which here are input.
+	defer func() {
+		if r := recover(); r != nil {
+			rule, err = RedirectRule{}, fmt.Errorf("%v", r)
+		}
+	}()
+	compilePattern(source)
+
+	rule = RedirectRule{Source: source, Target: target, Status: 301}
+	for _, option := range strings.Split(options, ";") {
+		if option == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(option, "=")
+		if key != "status" {
+			return RedirectRule{}, fmt.Errorf("unknown option %q", key)
+		}
+		status, err := strconv.Atoi(value)
+		if err != nil || status != 301 && status != 302 && status != 307 && status != 308 {
+			return RedirectRule{}, fmt.Errorf("invalid status %q: expected 301, 302, 307 or 308", value)
+		}
+		rule.Status = status
+	}
+	return rule, nil
+}
+
+// location returns where the rule sends req, given the parameters its
+// Source captured.
+func (rule RedirectRule) location(req *HTTPRequest, params map[string]string) string {
+	location := rule.Target
+	for name, value := range params {
+		// Escaped like a path, so a catch-all keeps its slashes.
+		location = strings.ReplaceAll(location, "{"+name+"}", (&url.URL{Path: value}).EscapedPath())
+	}
+	if !strings.Contains(location, "?") {
+		return withQuery(location, req.RawQuery)
+	}
+	return location
+}
+
+// Redirects returns middleware that redirects the requests matching one of
+// rules, whatever their method, instead of routing them. When several rules
+// match, the most specific Source wins, as for routes.
+func Redirects(rules []RedirectRule) Middleware {
+	for i := range rules {
+		rules[i].segments = compilePattern(rules[i].Source)
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, req *HTTPRequest) {
+			var best *RedirectRule
+			var bestParams map[string]string
+			for i := range rules {
+				params, ok := matchSegments(rules[i].segments, req.Path)
+				if ok && (best == nil || compareSpecificity(rules[i].segments, best.segments) > 0) {
+					best, bestParams = &rules[i], params
+				}
+			}
+			if best == nil {
+				next(w, req)
+				return
+			}
+			redirect(w, best.Status, best.location(req, bestParams))
+		}
+	}
+}
+
+// Redirect returns a handler that redirects every request to location with
+// the given 3xx status. It panics on a non-3xx status, since that is a
+// programming error.
+func Redirect(status int, location string) HandlerFunc {
+	if status < 300 || status > 399 {
+		panic(fmt.Sprintf("router: redirect status %d is not a 3xx code", status))
+	}
+	return func(w ResponseWriter, req *HTTPRequest) {
+		redirect(w, status, location)
+	}
+}
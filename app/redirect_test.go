@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing" // The test framework
+)
+
+func TestRouterRedirect(t *testing.T) {
+	tests := []struct {
+		name         string
+		target       string
+		status       int
+		wantLocation string
+	}{
+		{"moved permanently", "/new", 301, "/new"},
+		{"found", "/new", 302, "/new"},
+		{"temporary, absolute URL", "https://example.com/new?x=1", 307, "https://example.com/new?x=1"},
+		{"permanent", "/new", 308, "/new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.Router.Redirect("/old", tt.target, tt.status)
+			resp := get(t, s, "/old")
+			if resp.status != tt.status {
+				t.Errorf("status = %d, want %d", resp.status, tt.status)
+			}
+			if got := resp.header.Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+			if resp.body != "" || resp.header.Get("Content-Length") != "0" {
+				t.Errorf("body = %q, Content-Length %q", resp.body, resp.header.Get("Content-Length"))
+			}
+		})
+	}
+}
+
+func TestRouterRedirectRejectsOtherStatuses(t *testing.T) {
+	for _, status := range []int{200, 299, 400, 404} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Redirect with status %d did not panic", status)
+				}
+			}()
+			NewRouter().Redirect("/old", "/new", status)
+		}()
+	}
+}
+
+func TestRedirectRules(t *testing.T) {
+	tests := []struct {
+		name         string
+		rule         string
+		target       string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"parameter", "/blog/{slug}=/posts/{slug}", "/blog/hello", 301, "/posts/hello"},
+		{"catch-all keeps slashes", "/old/{rest...}=/new/{rest};status=308", "/old/a/b", 308, "/new/a/b"},
+		{"parameter is escaped", "/blog/{slug}=/posts/{slug}", "/blog/a%20b", 301, "/posts/a%20b"},
+		{"query kept", "/blog/{slug}=/posts/{slug}", "/blog/hello?page=2&x=%41", 301, "/posts/hello?page=2&x=%41"},
+		{"target's own query wins", "/blog/{slug}=/posts/{slug}?from=blog", "/blog/hello?page=2", 301, "/posts/hello?from=blog"},
+		{"non-ASCII query bytes are escaped", "/blog/{slug}=/posts/{slug}", "/blog/hello?q=caf\xc3\xa9", 301, "/posts/hello?q=caf%C3%A9"},
+		{"no match", "/blog/{slug}=/posts/{slug}", "/", 200, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, "-redirect", tt.rule)
+			resp := get(t, s, tt.target)
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.status, tt.wantStatus)
+			}
+			if got := resp.header.Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+// The request line cannot carry a CR or LF any more, but the Location must
+// not rely on that.
+func TestRedirectLocationCannotInjectHeaders(t *testing.T) {
+	rule, err := parseRedirectRule("/blog/{slug}=/posts/{slug}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &HTTPRequest{RawQuery: "a=1\r\nSet-Cookie: session=evil\r\n\r\n<script>x</script> \x00\x7f"}
+	want := "/posts/hello?a=1%0D%0ASet-Cookie:%20session=evil%0D%0A%0D%0A<script>x</script>%20%00%7F"
+	if got := rule.location(req, map[string]string{"slug": "hello"}); got != want {
+		t.Errorf("location = %q, want %q", got, want)
+	}
+}
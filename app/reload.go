@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json" // Used to encode the reload status
+	"errors"        // Used to refuse reloading a server that is not reloadable
+	"log/slog"      // Used to log the outcome of reloads
+	"strconv"       // Used to format Content-Length
+	"sync"          // Guards the reload status
+	"sync/atomic"   // Used to share the live Server between generations
+	"time"          // Used to timestamp reloads
+)
+
+// A reloadable server changes its configuration without a restart: Reload
+// swaps in another Server, built from the re-read configuration, and every
+// request that starts from then on is served by it, on the connections
+// already open as well as new ones. Nothing is dropped; a request in
+// progress finishes with the settings it started with.
+//
+// What belongs to the listeners (the addresses, TLS, MaxConnections,
+// Workers, QueueSize, RejectWhenFull, ProxyProtocol) stays as the server
+// started with.
+
+// enableReload makes s reloadable. It must be called before s serves.
+func (s *Server) enableReload() {
+	s.live = new(atomic.Pointer[Server])
+	s.live.Store(s)
+}
+
+// Reload makes next serve every request from now on, in place of s (and
+// whatever s was reloaded with before). next must have its routes
+// registered.
+func (s *Server) Reload(next *Server) error {
+	if s.live == nil {
+		return errors.New("server is not reloadable")
+	}
+	next.live = s.live
+	s.live.Store(next)
+	return nil
+}
+
+// current returns the Server that serves new requests: the latest one
+// reloaded, or s itself.
+func (s *Server) current() *Server {
+	if s.live == nil {
+		return s
+	}
+	return s.live.Load()
+}
+
+// reloadStatus is the outcome of the latest reload, reported by
+// GET /admin/reload.
+var reloadStatus struct {
+	mu        sync.Mutex
+	Reloads   int       `json:"reloads"`   // Successful ones since startup
+	Failures  int       `json:"failures"`  // Failed ones since startup
+	LastTime  time.Time `json:"last_time"` // Zero if there was none yet
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// recordReload logs the outcome of a reload and keeps it for /admin/reload.
+// A failed reload leaves the server as it was.
+func recordReload(err error) {
+	reloadStatus.mu.Lock()
+	defer reloadStatus.mu.Unlock()
+	reloadStatus.LastTime = time.Now()
+	if err != nil {
+		reloadStatus.Failures++
+		reloadStatus.LastError = err.Error()
+		slog.Error("reload failed, keeping the current configuration", "err", err)
+		return
+	}
+	reloadStatus.Reloads++
+	reloadStatus.LastError = ""
+	slog.Info("configuration reloaded")
+}
+
+// --- RELOAD STATUS ENDPOINT ---
+// GET /admin/reload reports how the reloads (SIGHUP) went.
+func reloadStatusHandler(w ResponseWriter, req *HTTPRequest) {
+	writeReloadStatus(w, 200)
+}
+
+// writeReloadStatus sends the reload status with status.
+func writeReloadStatus(w ResponseWriter, status int) {
+	reloadStatus.mu.Lock()
+	body, _ := json.Marshal(&reloadStatus)
+	reloadStatus.mu.Unlock()
+
+	headerLines := []string{
+		"Content-Type: application/json",
+		"Content-Length: " + strconv.Itoa(len(body)),
+	}
+	sendResponse(w, status, headerLines, string(body))
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"         // Used to decode chunked bodies
+	"crypto/rand"   // Used to generate unpredictable request IDs
+	"encoding/hex"  // Used to format request IDs
+	"errors"        // Used to report malformed requests
+	"fmt"           // Used to format Warning header values
+	"io"            // Used to read the rest of the body
+	"net/textproto" // Used to canonicalize header names
+	"net/url"       // Used for the decoded query and form values
+	"strconv"       // Used to parse Content-Length
+	"strings"       // Used to split the raw request into its parts
+	"time"          // Used as a fallback source for request IDs
+)
+
+// HTTPRequest holds the parsed parts of a single HTTP request.
+type HTTPRequest struct {
+	Method  string // e.g. "GET", "POST"
+	Path    string // e.g. "/", "/echo/a b", percent-decoded, without the query string
+	Version string // e.g. "HTTP/1.1"
+	Headers Header // Every value of every header; most code wants req.Header
+	Body    string // Everything after the blank line
+
+	// BodyReader streams the body instead, for handlers registered with
+	// Router.HandleStream; Body is then empty. Reading it to io.EOF
+	// guarantees the whole body arrived: a client that hangs up early, a
+	// broken chunk or a body over the size limit is an error.
+	BodyReader io.Reader
+
+	// Trailer holds the trailer fields sent after a chunked body, e.g. a
+	// checksum computed while streaming the upload.
+	Trailer Header
+
+	// RawPath is the path exactly as sent, still percent-encoded (e.g.
+	// "/echo/a%20b"), for handlers that need the original bytes. pathErr is
+	// set when it is not valid percent-encoding.
+	RawPath string
+	pathErr error
+
+	// RawQuery is the query string after the "?", as sent (e.g. "q=a%20b&x=1"),
+	// and Query the same parsed and percent-decoded ({"q": ["a b"], "x": ["1"]}).
+	RawQuery string
+	Query    url.Values
+
+	// Params holds the path parameters captured by the matched route,
+	// e.g. {"msg": "abc"} for "/echo/abc" and the pattern "/echo/{msg...}".
+	Params map[string]string
+
+	// Form holds decoded form fields and Files the uploaded files of a form
+	// submission, in the order they were sent; File is the first of them
+	// (nil if there is none). All are filled by ParseForm.
+	Form       url.Values
+	Files      []*FormFile
+	File       *FormFile
+	formParsed bool
+
+	// Claims holds the claims of the bearer token accepted by JWTAuth, e.g.
+	// {"sub": "alice", "exp": 1700000000}, for per-user decisions.
+	Claims map[string]any
+
+	// RemoteAddr is the "ip:port" of the client, taken from the PROXY
+	// protocol header when there is one.
+	RemoteAddr string
+
+	// ID identifies the request in logs and is echoed back as X-Request-ID.
+	// It is taken from the client's X-Request-ID header or generated.
+	ID string
+
+	// Close is true when the client asked us to hang up after this request.
+	Close bool
+	// keepAlive is the Keep-Alive header value (e.g. "timeout=120, max=99")
+	// sent with the response while the connection stays open.
+	keepAlive string
+
+	// Timing collects Server-Timing metrics recorded while handling the request.
+	Timing *ServerTiming
+
+	// warnings holds Warning header values added with AddWarning. They are
+	// only collected when emitWarnings is set (the -warnings flag).
+	warnings     []string
+	emitWarnings bool
+}
+
+// Header returns the value of the request header called name, which is
+// matched case-insensitively ("accept-encoding" finds "Accept-Encoding").
+// It returns "" if the client did not send it.
+//
+// A header sent several times is combined into one comma-separated value,
+// which means the same thing (RFC 9110 5.3): "Accept-Encoding: gzip" plus
+// "Accept-Encoding: br" reads as "gzip, br". Cookie is the exception and is
+// joined with "; " (RFC 6265 5.4).
+func (req *HTTPRequest) Header(name string) string {
+	separator := ", "
+	if textproto.CanonicalMIMEHeaderKey(name) == "Cookie" {
+		separator = "; "
+	}
+	return strings.Join(req.Headers.Values(name), separator)
+}
+
+// AddWarning records that the response is degraded in some way, e.g. the
+// content was altered or a preferred encoding could not be used. The response
+// emits it as "Warning: <code> my-http-server "<text>"" (RFC 7234 5.5):
+//   - 110 Response is Stale
+//   - 214 Transformation Applied
+//   - 299 Miscellaneous Persistent Warning
+func (req *HTTPRequest) AddWarning(code int, text string) {
+	if !req.emitWarnings {
+		return
+	}
+	req.warnings = append(req.warnings, fmt.Sprintf("%d my-http-server %q", code, text))
+}
+
+// parseRequest turns the raw bytes of a request into an HTTPRequest.
+//
+// A request looks like this:
+//
+//	GET /echo/abc HTTP/1.1\r\n      <- request line
+//	Host: localhost:4221\r\n        <- headers, one per line
+//	\r\n                            <- blank line ends the headers
+//	body...                         <- optional body
+func parseRequest(raw string) (*HTTPRequest, error) {
+	// 1. Separate the head (request line + headers) from the body.
+	head, body, _ := strings.Cut(raw, "\r\n\r\n")
+	lines := strings.Split(head, "\r\n")
+
+	// 2. Parse the Request Line
+	requestLine := strings.Split(lines[0], " ")
+	if len(requestLine) < 2 || len(requestLine) > 3 {
+		return nil, errors.New("malformed request line")
+	}
+	if !validTarget(requestLine[1]) {
+		return nil, errors.New("malformed request target")
+	}
+
+	req := &HTTPRequest{
+		Method:  requestLine[0],
+		Path:    requestLine[1],
+		Headers: make(Header),
+		Body:    body,
+		Timing:  &ServerTiming{},
+	}
+	if len(requestLine) > 2 {
+		req.Version = requestLine[2]
+	}
+
+	// Split off the query string so routes match on the path alone.
+	// Malformed pairs (e.g. "a=%zz") are skipped; the rest is kept.
+	req.RawPath, req.RawQuery, _ = strings.Cut(req.Path, "?")
+	req.Query, _ = url.ParseQuery(req.RawQuery)
+
+	// Decode "%20" and friends so routes and handlers see the real path.
+	// An invalid escape ("%zz") leaves Path raw; rejectRequest answers 400.
+	req.Path = req.RawPath
+	if decoded, err := url.PathUnescape(req.RawPath); err != nil {
+		req.pathErr = err
+	} else {
+		req.Path = decoded
+	}
+
+	// 3. Parse the Headers ("Name: value")
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue // Ignore lines that are not headers
+		}
+		// Header names are case-insensitive: Add stores "user-agent" and
+		// "USER-AGENT" alike as "User-Agent". Repeated headers keep every value.
+		req.Headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	// --- CHECK FOR CONNECTION: CLOSE HEADER ---
+	// HTTP/1.1 connections persist unless the client says "close"; HTTP/1.0
+	// ones are closed after the response unless the client opts in with
+	// "keep-alive" (RFC 9112 9.3). Connection lists tokens, e.g.
+	// "keep-alive, Upgrade".
+	if req.isHTTP10() {
+		req.Close = !hasToken(req.Header("Connection"), "keep-alive")
+	} else {
+		req.Close = hasToken(req.Header("Connection"), "close")
+	}
+
+	// --- REQUEST ID ---
+	// Keep the caller's ID so a request can be traced across services.
+	req.ID = req.Header("X-Request-ID")
+	if !validRequestID(req.ID) {
+		req.ID = newRequestID()
+	}
+
+	return req, nil
+}
+
+// isHTTP10 reports whether the client speaks HTTP/1.0, which predates
+// persistent connections by default, chunked coding and 100 Continue.
+func (req *HTTPRequest) isHTTP10() bool {
+	return req.Version == "HTTP/1.0"
+}
+
+// contentLength returns the declared Content-Length, or 0 if there is none.
+func (req *HTTPRequest) contentLength() (int64, error) {
+	cl := req.Header("Content-Length")
+	if cl == "" {
+		return 0, nil
+	}
+	length, err := strconv.ParseInt(cl, 10, 64)
+	if err != nil || length < 0 {
+		return 0, fmt.Errorf("invalid Content-Length %q", cl)
+	}
+	return length, nil
+}
+
+// readBody reads the request body into req.Body: exactly Content-Length
+// bytes, or the decoded chunks when it is sent with "Transfer-Encoding:
+// chunked". A chunked body may decode to at most maxBytes (0 for no limit).
+//
+// r is positioned right after the head, and exactly the body is read from
+// it, never more: the next pipelined request may already be buffered in r
+// and is left there.
+func readBody(r *bufio.Reader, req *HTTPRequest, maxBytes int64) error {
+	if req.isChunked() {
+		body, trailer, err := decodeChunked(r, maxBytes)
+		if err != nil {
+			return err
+		}
+		req.Body, req.Trailer = body, trailer
+		return nil
+	}
+
+	length, err := req.contentLength()
+	if err != nil {
+		return err
+	}
+	if length == 0 {
+		return nil
+	}
+
+	// The buffer grows as the bytes arrive rather than being allocated for
+	// the declared length up front: with no -max-request-bytes, a client
+	// could otherwise claim any size and have us allocate it. lengthReader
+	// turns a body cut short into io.ErrUnexpectedEOF.
+	body, err := io.ReadAll(&lengthReader{r: r, left: length})
+	if err != nil {
+		return err
+	}
+	req.Body = string(body)
+	return nil
+}
+
+// streamBody sets req.BodyReader to read the body from r as the handler
+// consumes it, with the same framing and limits as readBody.
+func streamBody(r *bufio.Reader, req *HTTPRequest, maxBytes int64) error {
+	if req.isChunked() {
+		req.BodyReader = &chunkedReader{r: r, maxBytes: maxBytes, trailer: &req.Trailer}
+		return nil
+	}
+
+	length, err := req.contentLength()
+	if err != nil {
+		return err
+	}
+	req.BodyReader = &lengthReader{r: r, left: length}
+	return nil
+}
+
+// bufferBody reads a streamed body into req.Body, for streaming handlers that
+// need the whole body after all (e.g. to parse a form).
+func (req *HTTPRequest) bufferBody() error {
+	if req.BodyReader == nil {
+		return nil
+	}
+	body, err := io.ReadAll(req.BodyReader)
+	if err != nil {
+		return &bodyReadError{err}
+	}
+	req.Body, req.BodyReader = string(body), nil
+	return nil
+}
+
+// bodyReadError wraps an error reading a streamed body, so that a handler
+// storing the body can tell a bad upload (4xx) from a failure to store it
+// (5xx).
+type bodyReadError struct {
+	err error
+}
+
+func (e *bodyReadError) Error() string { return "read request body: " + e.err.Error() }
+func (e *bodyReadError) Unwrap() error { return e.err }
+
+// bodyErrorReader marks the errors of r, except io.EOF, as bodyReadErrors.
+type bodyErrorReader struct {
+	r io.Reader
+}
+
+func (b bodyErrorReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &bodyReadError{err}
+	}
+	return n, err
+}
+
+// lengthReader reads a body of exactly left bytes. Unlike io.LimitReader it
+// reports io.ErrUnexpectedEOF, not io.EOF, if the client hangs up early, so
+// a truncated upload is never mistaken for a complete one.
+type lengthReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *lengthReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if err == io.EOF && l.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// newRequestID returns a random 128-bit ID as 32 hex characters. crypto/rand
+// makes collisions practically impossible, even across server instances.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand does not fail on supported platforms; fall back to time.
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// validTarget reports whether target, as sent on the request line, is free
+// of spaces and control characters. Those are never valid in a URL (RFC 3986
+// 2), and would otherwise end up in Location headers built from the path or
+// query.
+func validTarget(target string) bool {
+	if target == "" {
+		return false
+	}
+	for i := 0; i < len(target); i++ {
+		if c := target[i]; c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// validRequestID reports whether a client-supplied ID is safe to reuse:
+// non-empty, at most 128 characters and only visible ASCII, so it cannot
+// break log lines or response headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
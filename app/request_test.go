@@ -0,0 +1,87 @@
+package main
+
+import (
+	"regexp"  // Used to recognise generated IDs
+	"strings" // Used to build long IDs
+	"testing" // The test framework
+)
+
+var generatedID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header []string
+		want   string // "" for a generated ID
+	}{
+		{"passed through", "/", []string{"X-Request-ID: trace-abc-123"}, "trace-abc-123"},
+		{"passed through on an error", "/nope", []string{"X-Request-ID: trace-abc-123"}, "trace-abc-123"},
+		{"generated", "/", nil, ""},
+		{"generated on an error", "/nope", nil, ""},
+		{"too long, replaced", "/", []string{"X-Request-ID: " + strings.Repeat("a", 129)}, ""},
+		{"not visible ASCII, replaced", "/", []string{"X-Request-ID: two words"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			ids := get(t, s, tt.target, tt.header...).header.Values("X-Request-ID")
+			if len(ids) != 1 {
+				t.Fatalf("X-Request-ID = %q, want one", ids)
+			}
+			if tt.want != "" && ids[0] != tt.want {
+				t.Errorf("X-Request-ID = %q, want %q", ids[0], tt.want)
+			}
+			if tt.want == "" && !generatedID.MatchString(ids[0]) {
+				t.Errorf("generated X-Request-ID = %q, want 32 hex digits", ids[0])
+			}
+		})
+	}
+}
+
+func TestRequestIDsAreUnique(t *testing.T) {
+	s := newTestServer(t)
+	seen := make(map[string]bool)
+	for range 100 {
+		id := get(t, s, "/").header.Get("X-Request-ID")
+		if seen[id] {
+			t.Fatalf("X-Request-ID %q generated twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestRequestTarget(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string // The request line
+		wantStatus int
+		wantQuery  string // x from the query, echoed back
+	}{
+		{"query", "GET /query?x=a%20b&y=2 HTTP/1.1", 200, "a b"},
+		{"plus is a space", "GET /query?x=a+b HTTP/1.1", 200, "a b"},
+		{"no query", "GET /query HTTP/1.1", 200, ""},
+		{"space in the query", "GET /query?x=a b HTTP/1.1", 400, ""},
+		{"tab in the query", "GET /query?x=a\tb HTTP/1.1", 400, ""},
+		{"tab in the path", "GET /que\try HTTP/1.1", 400, ""},
+		{"two spaces", "GET  /query HTTP/1.1", 400, ""},
+		{"no target", "GET", 400, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.Router.Get("/query", func(w ResponseWriter, req *HTTPRequest) {
+				sendResponse(w, 200, nil, req.Query.Get("x"))
+			})
+			// What follows a refused request is never read as one.
+			conn, r := send(t, s, tt.line+"\r\nHost: test\r\n\r\n"+request("GET", "/", ""))
+			resp := readResponse(t, r, "GET")
+			if resp.status != tt.wantStatus || resp.body != tt.wantQuery {
+				t.Fatalf("got %d %q, want %d %q", resp.status, resp.body, tt.wantStatus, tt.wantQuery)
+			}
+			if tt.wantStatus == 400 && (!resp.close || !closed(t, conn, r)) {
+				t.Error("connection left open after a malformed request line")
+			}
+		})
+	}
+}
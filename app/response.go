@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"   // The head is built in a pooled buffer
+	"fmt"     // Used to format the status line
+	"io"      // Used to report writes that make no progress
+	"net"     // Used to write to the client's connection
+	"strconv" // Used to format Content-Length
+	"strings" // Used to join header lines
+	"time"    // Used for the Date header
+)
+
+// httpTimeFormat is the date format used in HTTP headers (RFC 9110 IMF-fixdate),
+// e.g. "Sun, 06 Nov 1994 08:49:37 GMT". Times must be in UTC.
+const httpTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// parseHTTPDate parses a date sent by a client. Besides IMF-fixdate, old
+// clients may use the obsolete RFC 850 and asctime formats, which recipients
+// must still accept (RFC 9110 5.6.7).
+func parseHTTPDate(value string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{httpTimeFormat, time.RFC850, time.ANSIC} {
+		var t time.Time
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// serverVersion is reported in the Server header of every response.
+const serverVersion = "1.0.0"
+
+// statusText maps the status codes this server sends to their reason phrases.
+var statusText = map[int]string{
+	101: "Switching Protocols",
+	200: "OK",
+	201: "Created",
+	204: "No Content",
+	206: "Partial Content",
+	301: "Moved Permanently",
+	302: "Found",
+	303: "See Other",
+	304: "Not Modified",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
+	400: "Bad Request",
+	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	408: "Request Timeout",
+	409: "Conflict",
+	411: "Length Required",
+	413: "Content Too Large",
+	415: "Unsupported Media Type",
+	416: "Range Not Satisfiable",
+	417: "Expectation Failed",
+	426: "Upgrade Required",
+	429: "Too Many Requests",
+	431: "Request Header Fields Too Large",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
+}
+
+// statusLine formats a status code with its reason phrase, e.g. "302 Found".
+func statusLine(code int) string {
+	return strings.TrimSpace(fmt.Sprintf("%d %s", code, statusText[code]))
+}
+
+// sendResponse writes a complete response whose body is held in memory.
+//
+// status is the code (e.g. 200) and headers are full "Name: value" lines,
+// added to w.Header(). Content-Length is set from body unless the handler
+// passed its own (e.g. the length of a body it knows HEAD will drop).
+//
+// The returned error is also remembered by the connection's writer, so
+// handleConnection stops using a connection the response could not be
+// written to.
+func sendResponse(w ResponseWriter, status int, headers []string, body string) error {
+	addHeaderLines(w.Header(), headers)
+	if !w.Header().Has("Content-Length") {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.WriteHeader(status)
+
+	if body == "" || statusHasNoBody(status) {
+		return nil
+	}
+	_, err := io.WriteString(w, body)
+	return err
+}
+
+// sendStream writes a response whose body of exactly length bytes is copied
+// from body in chunks, instead of being held in memory as a string. This is
+// what lets the server send files far larger than the available RAM.
+// Headers are handled exactly like sendResponse; Content-Length is always
+// set from length.
+func sendStream(w ResponseWriter, status int, headers []string, body io.Reader, length int64) error {
+	addHeaderLines(w.Header(), headers)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+
+	if statusHasNoBody(status) {
+		return nil
+	}
+
+	// io.CopyN reads and writes in small buffers, so memory use stays
+	// constant no matter how big the body is. If the source runs short (e.g.
+	// the file was truncated meanwhile) the writer closes the connection,
+	// since the client would otherwise wait for the rest forever.
+	_, err := io.CopyN(w, body, length)
+	return err
+}
+
+// addHeaderLines adds "Name: value" lines to h.
+func addHeaderLines(h Header, lines []string) {
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if ok {
+			h.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+}
+
+// buildHead writes the status line and headers of a response to b, including
+// the blank line that ends the headers. Headers that depend on the request
+// rather than the handler (Date, Server, Server-Timing, Warning, Connection)
+// are added here so every endpoint behaves the same way. Handlers can
+// override Date and Server by setting their own.
+func buildHead(b *bytes.Buffer, req *HTTPRequest, status string, header Header) {
+	headerLines := []string{"HTTP/1.1 " + status}
+	headerLines = append(headerLines, responseHeaderLines(req, header)...)
+
+	// If the client asked to close, echo that back in the headers
+	if req.Close {
+		headerLines = append(headerLines, "Connection: close")
+	} else {
+		// An HTTP/1.0 client only keeps the connection if we confirm it.
+		if req.isHTTP10() {
+			headerLines = append(headerLines, "Connection: keep-alive")
+		}
+		// Say how long the connection will be kept (RFC 2068 19.7.1.1).
+		if req.keepAlive != "" {
+			headerLines = append(headerLines, "Keep-Alive: "+req.keepAlive)
+		}
+	}
+
+	// Write the lines with CRLFs; an empty line ends the head.
+	for _, line := range headerLines {
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("\r\n")
+}
+
+// responseHeaderLines returns the handler's headers as "Name: value" lines,
+// followed by those every response gets whatever the protocol: all of
+// buildHead's but the connection management ones.
+func responseHeaderLines(req *HTTPRequest, header Header) []string {
+	headerLines := header.lines()
+
+	// HTTP/1.1 requires a Date header on every response (RFC 9110 6.6.1).
+	if !header.Has("Date") {
+		headerLines = append(headerLines, "Date: "+time.Now().UTC().Format(httpTimeFormat))
+	}
+	if !header.Has("Server") {
+		headerLines = append(headerLines, "Server: my-http-server/"+serverVersion)
+	}
+
+	// Echo the request ID so clients can quote it when reporting problems.
+	if req.ID != "" && !header.Has("X-Request-ID") {
+		headerLines = append(headerLines, "X-Request-ID: "+req.ID)
+	}
+
+	// Report any timings the handler recorded so browser devtools can show them.
+	if req.Timing != nil {
+		if timing := req.Timing.String(); timing != "" {
+			headerLines = append(headerLines, "Server-Timing: "+timing)
+		}
+	}
+
+	// Let clients and operators know the response was degraded.
+	for _, warning := range req.warnings {
+		headerLines = append(headerLines, "Warning: "+warning)
+	}
+	return headerLines
+}
+
+// statusHasNoBody reports whether responses with this status never carry a
+// body: informational (1xx), 204 No Content and 304 Not Modified.
+func statusHasNoBody(status int) bool {
+	return status < 200 || status == 204 || status == 304
+}
+
+// writeFull writes all of data to conn.
+// A single Write may send only part of the buffer (e.g. to a slow or
+// half-closed client), so we keep writing until everything is sent or an
+// error occurs.
+func writeFull(conn net.Conn, data []byte) error {
+	for len(data) > 0 {
+		n, err := conn.Write(data)
+		data = data[n:]
+		if err != nil {
+			return err
+		}
+		// A writer that accepts nothing and reports no error would loop forever.
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+	}
+	return nil
+}
+
+// withQuery returns path with rawQuery, a request's query string, appended
+// if there is one: the Location of a redirect that keeps the query. Both may
+// come from the client, so every byte that is never valid in a URL (control
+// characters such as CR and LF, spaces, non-ASCII) is percent-encoded. The
+// Location header can then neither be cut short nor followed by another.
+func withQuery(path, rawQuery string) string {
+	location := escapeUnsafeBytes(path)
+	if rawQuery != "" {
+		location += "?" + escapeUnsafeBytes(rawQuery)
+	}
+	return location
+}
+
+// escapeUnsafeBytes percent-encodes the bytes of s that may not appear in a
+// URL as they are. Escapes already in s are left alone.
+func escapeUnsafeBytes(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c > ' ' && c < 0x7f {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xf])
+	}
+	return b.String()
+}
+
+// redirect sends a 3xx response pointing the client at location.
+// The body is empty; clients follow the Location header instead.
+func redirect(w ResponseWriter, status int, location string) error {
+	if status < 300 || status > 399 {
+		return fmt.Errorf("redirect: status %d is not a 3xx code", status)
+	}
+	headers := []string{"Location: " + location}
+	return sendResponse(w, status, headers, "")
+}
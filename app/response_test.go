@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"         // Used to read responses off the wire
+	"errors"        // Used to fail writes on purpose
+	"net"           // The connections wrapped
+	"net/http"      // Used to parse dates
+	"os"            // Used to fill the served directory
+	"path/filepath" // Used to build paths in the served directory
+	"slices"        // Used to compare header values
+	"strconv"       // Used to parse statuses
+	"strings"       // Used to split requests
+	"testing"       // The test framework
+	"time"          // Used to check dates
+)
+
+// shortConn takes at most max bytes per Write, without an error, as a
+// congested or buggy connection might.
+type shortConn struct {
+	net.Conn
+	max int
+}
+
+func (c shortConn) Write(p []byte) (int, error) {
+	if len(p) > c.max {
+		p = p[:c.max]
+	}
+	return c.Conn.Write(p)
+}
+
+// failingConn fails every Write once budget bytes were written.
+type failingConn struct {
+	net.Conn
+	budget *int
+}
+
+func (c failingConn) Write(p []byte) (int, error) {
+	if len(p) > *c.budget {
+		n, _ := c.Conn.Write(p[:*c.budget])
+		*c.budget = 0
+		return n, errors.New("connection reset by peer")
+	}
+	*c.budget -= len(p)
+	return c.Conn.Write(p)
+}
+
+func TestShortWritesAreCompleted(t *testing.T) {
+	s := newTestServer(t)
+	conn, _ := dialWith(t, s, func(c net.Conn) net.Conn { return shortConn{c, 3} })
+	go conn.Write([]byte(request("GET", "/echo/first", "") + request("GET", "/echo/second", "")))
+	r := bufio.NewReader(conn)
+	for _, want := range []string{"first", "second"} {
+		resp := readResponse(t, r, "GET")
+		if resp.status != 200 || resp.body != want {
+			t.Errorf("got %d %q, want 200 %q", resp.status, resp.body, want)
+		}
+	}
+}
+
+func TestWriteErrorDropsConnection(t *testing.T) {
+	s := newTestServer(t)
+	served := 0
+	s.Router.Get("/count", func(w ResponseWriter, req *HTTPRequest) {
+		served++
+		sendResponse(w, 200, nil, "counted")
+	})
+
+	budget := 20 // Not even the first status line and headers
+	conn, done := dialWith(t, s, func(c net.Conn) net.Conn { return failingConn{c, &budget} })
+	go conn.Write([]byte(request("GET", "/count", "") + request("GET", "/count", "")))
+	r := bufio.NewReader(conn)
+	// The client gets the start of the response, then the connection ends.
+	buf := make([]byte, 100)
+	n, _ := r.Read(buf)
+	if string(buf[:n]) != "HTTP/1.1 200 OK\r\nCon" {
+		t.Errorf("received %q", buf[:n])
+	}
+	conn.Close()
+	<-done
+	if served != 1 {
+		t.Errorf("served %d requests after a failed write, want 1", served)
+	}
+}
+
+func TestDateAndServerHeaders(t *testing.T) {
+	s := newTestServer(t)
+	s.Router.Get("/custom", func(w ResponseWriter, req *HTTPRequest) {
+		sendResponse(w, 200, []string{"Date: Tue, 15 Nov 1994 08:12:31 GMT", "Server: custom/2"}, "")
+	})
+
+	tests := []struct {
+		name       string
+		target     string
+		wantDate   string // "" for the current time
+		wantServer string
+	}{
+		{"200", "/", "", "my-http-server/" + serverVersion},
+		{"404", "/nope", "", "my-http-server/" + serverVersion},
+		{"set by the handler", "/custom", "Tue, 15 Nov 1994 08:12:31 GMT", "custom/2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := get(t, s, tt.target)
+			if got := resp.header.Values("Server"); len(got) != 1 || got[0] != tt.wantServer {
+				t.Errorf("Server = %q, want %q", got, tt.wantServer)
+			}
+			dates := resp.header.Values("Date")
+			if len(dates) != 1 {
+				t.Fatalf("Date = %q, want one", dates)
+			}
+			if tt.wantDate != "" {
+				if dates[0] != tt.wantDate {
+					t.Errorf("Date = %q, want %q", dates[0], tt.wantDate)
+				}
+				return
+			}
+			date, err := time.Parse(http.TimeFormat, dates[0])
+			if err != nil {
+				t.Fatalf("Date %q: %v", dates[0], err)
+			}
+			if d := time.Since(date); d < -time.Second || d > time.Minute {
+				t.Errorf("Date = %q, %v from now", dates[0], d)
+			}
+		})
+	}
+}
+
+func TestEmptyBodyContentLength(t *testing.T) {
+	s := newTestServer(t)
+	s.Router.Get("/status/{code}", func(w ResponseWriter, req *HTTPRequest) {
+		code, _ := strconv.Atoi(req.Params["code"])
+		sendResponse(w, code, nil, "")
+	})
+	os.WriteFile(filepath.Join(s.Dir, "f.txt"), []byte("hello"), 0644)
+
+	tests := []struct {
+		name       string
+		raw        string
+		wantStatus int
+		want       []string // The Content-Length values
+	}{
+		{"200", request("GET", "/status/200", ""), 200, []string{"0"}},
+		{"201 from a handler", request("GET", "/status/201", ""), 201, []string{"0"}},
+		{"201 upload", request("POST", "/files/g.txt", "hello"), 201, []string{"0"}},
+		{"202", request("GET", "/status/202", ""), 202, []string{"0"}},
+		{"204 from a handler", request("GET", "/status/204", ""), 204, nil},
+		{"204 OPTIONS", request("OPTIONS", "/", ""), 204, nil},
+		{"304 from a handler", request("GET", "/status/304", ""), 304, nil},
+		{"304 conditional GET", request("GET", "/files/f.txt", "", "If-Modified-Since: "+time.Now().UTC().Format(httpTimeFormat)), 304, nil},
+		{"100 Continue", "PUT /files/h.txt HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n", 100, nil},
+		{"404", request("GET", "/nope", ""), 404, []string{"0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, r := send(t, s, tt.raw)
+			method, _, _ := strings.Cut(tt.raw, " ")
+			resp := readResponse(t, r, method)
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.status, tt.wantStatus)
+			}
+			if got := resp.header.Values("Content-Length"); !slices.Equal(got, tt.want) {
+				t.Errorf("Content-Length = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithQuery(t *testing.T) {
+	tests := []struct {
+		path, rawQuery, want string
+	}{
+		{"/a/", "", "/a/"},
+		{"/a/", "x=1&y=%20", "/a/?x=1&y=%20"},
+		{"/a/", "x=\r\nLocation: evil", "/a/?x=%0D%0ALocation:%20evil"},
+		{"/caf\xc3\xa9\n/", "q=\t", "/caf%C3%A9%0A/?q=%09"},
+	}
+	for _, tt := range tests {
+		if got := withQuery(tt.path, tt.rawQuery); got != tt.want {
+			t.Errorf("withQuery(%q, %q) = %q, want %q", tt.path, tt.rawQuery, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"  // Used to report invalid rules
+	"fmt"     // Used to report invalid patterns
+	"net/url" // Used to re-encode rewritten paths and parse their queries
+	"regexp"  // Rewrite rules are regular expressions
+	"strings" // Used to parse rules and split off queries
+)
+
+// A rewrite changes the path of a request before it is routed, so that
+// another route serves it, unlike a redirect the client never sees: with
+//
+//	^/v1/assets/(.*)  ->  /files/$1
+//
+// GET /v1/assets/logo.png is served as GET /files/logo.png. Logs still
+// show the path the client asked for.
+
+// RewriteRule replaces the part of a path that Pattern matches with
+// Replacement, in which $1 (or ${1}, ${name}) stands for what a group of
+// Pattern matched. Anchor Pattern with ^ and $ to match whole paths. A
+// "?query" in Replacement is added to the request's query string.
+type RewriteRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// parseRewriteRule parses a -rewrite value, "pattern=replacement", e.g.
+//
+//	^/v1/assets/(.*)$=/files/$1
+//
+// The pattern ends at the first "=", so it cannot contain one.
+func parseRewriteRule(spec string) (RewriteRule, error) {
+	pattern, replacement, ok := strings.Cut(spec, "=")
+	if !ok || !strings.HasPrefix(replacement, "/") {
+		return RewriteRule{}, errors.New(`expected "pattern=/replacement"`)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return RewriteRule{}, fmt.Errorf("invalid pattern: %w", err)
+	}
+	return RewriteRule{Pattern: re, Replacement: replacement}, nil
+}
+
+// Rewrite adds a rewrite rule (see RewriteRule). Before routing, the path
+// of each request is rewritten by the first rule whose pattern matches it,
+// in the order they were added; later rules do not see the result.
+func (r *Router) Rewrite(pattern *regexp.Regexp, replacement string) {
+	r.rewrites = append(r.rewrites, RewriteRule{Pattern: pattern, Replacement: replacement})
+}
+
+// rewritePath returns path as rewritten by the first rule that matches it,
+// with the query the rule adds, and whether any did.
+func (r *Router) rewritePath(path string) (rewritten, query string, ok bool) {
+	for _, rule := range r.rewrites {
+		if rule.Pattern.MatchString(path) {
+			rewritten, query, _ = strings.Cut(rule.Pattern.ReplaceAllString(path, rule.Replacement), "?")
+			return rewritten, query, true
+		}
+	}
+	return path, "", false
+}
+
+// rewrite applies the rewrite rules to req.
+func (r *Router) rewrite(req *HTTPRequest) {
+	path, query, ok := r.rewritePath(req.Path)
+	if !ok {
+		return
+	}
+	req.Path = path
+	req.RawPath = (&url.URL{Path: path}).EscapedPath()
+	if query != "" {
+		if req.RawQuery != "" {
+			query += "&" + req.RawQuery
+		}
+		req.RawQuery = query
+		req.Query, _ = url.ParseQuery(query)
+	}
+}
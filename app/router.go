@@ -0,0 +1,370 @@
+package main
+
+import (
+	"regexp"  // Used by regular expression routes
+	"strings" // Used to build the Allow header
+)
+
+// HandlerFunc handles a single parsed request and writes the response to w.
+type HandlerFunc func(w ResponseWriter, req *HTTPRequest)
+
+// Middleware wraps a HandlerFunc to add behaviour around it. The returned
+// handler can inspect or modify req before calling next, skip next entirely
+// to short-circuit (e.g. reply 401), or pass next a wrapping ResponseWriter
+// to decorate the response. For example:
+//
+//	func logging(next HandlerFunc) HandlerFunc {
+//		return func(w ResponseWriter, req *HTTPRequest) {
+//			start := time.Now()
+//			next(w, req)
+//			fmt.Println(req.Method, req.Path, time.Since(start))
+//		}
+//	}
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// route pairs a method and path pattern with the handler that serves it.
+type route struct {
+	method   string
+	pattern  string
+	segments []segment
+	// regex, if set, matches the path instead of segments (see HandleRegex).
+	regex   *regexp.Regexp
+	handler HandlerFunc
+	// stream is set for routes whose handler reads req.BodyReader.
+	stream bool
+	// trailingSlash overrides Router.TrailingSlash when set.
+	trailingSlash TrailingSlash
+}
+
+// match reports whether the route's pattern matches path and returns the
+// path parameters it captured (see pattern.go for the syntax).
+func (rt route) match(path string) (map[string]string, bool) {
+	if rt.regex != nil {
+		return matchRegex(rt.regex, path)
+	}
+	return matchSegments(rt.segments, path)
+}
+
+// moreSpecific reports whether rt wins over other when both match a path.
+// A regular expression route is more specific than a pattern that only
+// matches through a catch-all, and less than any other; between two
+// regular expressions, the first registered wins.
+func (rt route) moreSpecific(other route) bool {
+	switch {
+	case rt.regex != nil && other.regex != nil:
+		return false
+	case rt.regex != nil:
+		return endsInCatchAll(other.segments)
+	case other.regex != nil:
+		return !endsInCatchAll(rt.segments)
+	}
+	return compareSpecificity(rt.segments, other.segments) > 0
+}
+
+// Router dispatches requests to handlers based on method and path.
+type Router struct {
+	routes     []route
+	middleware []Middleware
+
+	// AutoHead answers HEAD requests with the matching GET handler,
+	// sending its headers without the body.
+	AutoHead bool
+	// AutoOptions answers OPTIONS requests for known paths with the list of
+	// methods registered for them in an Allow header.
+	AutoOptions bool
+	// TrailingSlash is what happens to requests whose path only matches a
+	// route with its trailing slash added or removed, for routes without a
+	// policy of their own (see SetTrailingSlash). Zero means
+	// TrailingSlashStrict.
+	TrailingSlash TrailingSlash
+	// Connect, if set, handles CONNECT requests, whose target is a
+	// "host:port" rather than a path any route could match.
+	Connect HandlerFunc
+	// NotFound, if set, handles requests no route matches instead of the
+	// bare 404, e.g. to serve a single-page app's index.html.
+	NotFound HandlerFunc
+
+	// rewrites change request paths before routing (see Rewrite).
+	rewrites []RewriteRule
+	// errorHandlers are the error pages registered with HandleError, by
+	// status; 0 is the one for every other status.
+	errorHandlers map[int]ErrorHandlerFunc
+}
+
+// NewRouter returns an empty Router with automatic HEAD and OPTIONS enabled.
+func NewRouter() *Router {
+	return &Router{AutoHead: true, AutoOptions: true}
+}
+
+// Handle registers handler for requests with the given method and path pattern.
+func (r *Router) Handle(method, pattern string, handler HandlerFunc) {
+	r.routes = append(r.routes, route{
+		method:   method,
+		pattern:  pattern,
+		segments: compilePattern(pattern),
+		handler:  handler,
+	})
+}
+
+// HandleStream is like Handle, but the handler receives the body as a stream
+// in req.BodyReader instead of whole in req.Body, so that an upload bigger
+// than memory can go straight to disk. Whatever the handler leaves unread is
+// discarded after it returns.
+func (r *Router) HandleStream(method, pattern string, handler HandlerFunc) {
+	r.Handle(method, pattern, handler)
+	r.routes[len(r.routes)-1].stream = true
+}
+
+// streamsBody reports whether the route req will be dispatched to reads the
+// body as a stream (see HandleStream).
+func (r *Router) streamsBody(req *HTTPRequest) bool {
+	path, _, _ := r.rewritePath(req.Path)
+	rt, _, found := r.find(req.Method, path)
+	if !found {
+		var policy TrailingSlash
+		rt, _, policy, found = r.findOtherSlash(req.Method, path)
+		found = found && policy == TrailingSlashMatch
+	}
+	return found && rt.stream
+}
+
+// HandleRegex registers handler for requests with the given method whose
+// path matches the regular expression pattern, for paths route patterns
+// cannot describe, e.g. "^/files/([0-9]+)\\.log$". Anchor it with ^ and $ to
+// match whole paths. The groups it captures are in req.Params, by number
+// ("1" for the first) and, for named groups ("(?P<id>[0-9]+)"), by name.
+// It panics on an invalid regular expression, since that is a programming
+// error.
+func (r *Router) HandleRegex(method, pattern string, handler HandlerFunc) {
+	r.routes = append(r.routes, route{
+		method:  method,
+		pattern: pattern,
+		regex:   regexp.MustCompile(pattern),
+		handler: handler,
+	})
+}
+
+// GetRegex registers a handler for GET requests whose path matches the
+// regular expression pattern (see HandleRegex).
+func (r *Router) GetRegex(pattern string, handler HandlerFunc) {
+	r.HandleRegex("GET", pattern, handler)
+}
+
+// RouteInfo describes a registered route.
+type RouteInfo struct {
+	Method  string `json:"method"`
+	Pattern string `json:"pattern"`
+	Regex   bool   `json:"regex,omitempty"`  // Registered with HandleRegex
+	Stream  bool   `json:"stream,omitempty"` // Registered with HandleStream
+}
+
+// Routes returns the routes registered on r, in the order they were added,
+// which is the order ties are broken in.
+func (r *Router) Routes() []RouteInfo {
+	routes := make([]RouteInfo, len(r.routes))
+	for i, rt := range r.routes {
+		routes[i] = RouteInfo{Method: rt.method, Pattern: rt.pattern, Regex: rt.regex != nil, Stream: rt.stream}
+	}
+	return routes
+}
+
+// Use adds middleware that runs on every request, before routing, in the
+// order it was added. It also sees requests that end in 404 or automatic
+// HEAD/OPTIONS responses.
+func (r *Router) Use(mw Middleware) {
+	r.middleware = append(r.middleware, mw)
+}
+
+// HandleError registers handler to write the page of the error responses
+// (4xx and 5xx) with the given status, or of every error status without a
+// page of its own for status 0. It replaces the empty body of the bare
+// responses sent by the Router, its middleware and its handlers; those with
+// a body of their own are sent as they are. Errors in requests that cannot
+// be parsed are answered before routing, without a page.
+func (r *Router) HandleError(status int, handler ErrorHandlerFunc) {
+	if r.errorHandlers == nil {
+		r.errorHandlers = make(map[int]ErrorHandlerFunc)
+	}
+	r.errorHandlers[status] = handler
+}
+
+// errorHandler returns the error page registered for status, if any.
+func (r *Router) errorHandler(status int) ErrorHandlerFunc {
+	if status < 400 {
+		return nil
+	}
+	if handler, ok := r.errorHandlers[status]; ok {
+		return handler
+	}
+	return r.errorHandlers[0]
+}
+
+// withErrorPages makes handler send the error pages registered with
+// HandleError in place of the empty error responses it writes.
+func (r *Router) withErrorPages(handler HandlerFunc) HandlerFunc {
+	if len(r.errorHandlers) == 0 {
+		return handler
+	}
+	return func(w ResponseWriter, req *HTTPRequest) {
+		handler(&errorPageWriter{ResponseWriter: w, req: req, router: r}, req)
+	}
+}
+
+// Get registers a handler for GET requests.
+func (r *Router) Get(pattern string, handler HandlerFunc) {
+	r.Handle("GET", pattern, handler)
+}
+
+// Post registers a handler for POST requests.
+func (r *Router) Post(pattern string, handler HandlerFunc) {
+	r.Handle("POST", pattern, handler)
+}
+
+// Put registers a handler for PUT requests.
+func (r *Router) Put(pattern string, handler HandlerFunc) {
+	r.Handle("PUT", pattern, handler)
+}
+
+// Delete registers a handler for DELETE requests.
+func (r *Router) Delete(pattern string, handler HandlerFunc) {
+	r.Handle("DELETE", pattern, handler)
+}
+
+// Redirect registers a GET route on path that redirects clients to target
+// with the given 3xx status (e.g. 301 for moved permanently, 302 for found).
+// It panics on a non-3xx status, since that is a programming error.
+func (r *Router) Redirect(path, target string, status int) {
+	r.Get(path, Redirect(status, target))
+}
+
+// find returns the most specific route registered for method that matches
+// path, regardless of registration order, along with its path parameters.
+// An exact match always wins over a parameter, which wins over a catch-all
+// or prefix; among prefixes the longest one wins. For example
+// "/files/readme" beats "/files/{name}", which beats "/files/", which beats "/".
+// Regular expression routes rank between parameters and catch-alls (see
+// route.moreSpecific).
+func (r *Router) find(method, path string) (route, map[string]string, bool) {
+	var best route
+	var bestParams map[string]string
+	found := false
+	for _, rt := range r.routes {
+		if rt.method != method {
+			continue
+		}
+		params, ok := rt.match(path)
+		if !ok {
+			continue
+		}
+		if !found || rt.moreSpecific(best) {
+			best, bestParams, found = rt, params, true
+		}
+	}
+	return best, bestParams, found
+}
+
+// AllowedMethods lists the methods that can be used on path, including the
+// automatically generated HEAD and OPTIONS when they are enabled. The path
+// "*" (as in "OPTIONS * HTTP/1.1") stands for the whole server: it lists
+// the methods of every route.
+func (r *Router) AllowedMethods(path string) []string {
+	var methods []string
+	seen := make(map[string]bool)
+	add := func(m string) {
+		if !seen[m] {
+			seen[m] = true
+			methods = append(methods, m)
+		}
+	}
+
+	for _, rt := range r.routes {
+		if _, ok := rt.match(path); !ok && path != "*" {
+			continue
+		}
+		add(rt.method)
+		if rt.method == "GET" && r.AutoHead {
+			add("HEAD")
+		}
+	}
+	if len(methods) > 0 && r.AutoOptions {
+		add("OPTIONS")
+	}
+	return methods
+}
+
+// ServeRequest runs req through the middleware chain and then the matching
+// handler. Requests for a path no route matches get a 404, and requests whose
+// path matches only routes for other methods get a 405.
+func (r *Router) ServeRequest(w ResponseWriter, req *HTTPRequest) {
+	// Wrap the dispatcher so the first middleware registered runs first.
+	// Error pages are sent from where the error is, so the middleware
+	// around it (logs, metrics, compression) sees the page.
+	handler := r.withErrorPages(r.dispatch)
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.withErrorPages(r.middleware[i](handler))
+	}
+	handler(w, req)
+}
+
+// dispatch finds the handler for req and runs it.
+func (r *Router) dispatch(w ResponseWriter, req *HTTPRequest) {
+	r.rewrite(req)
+
+	// 0. CONNECT names a host, not a path.
+	if req.Method == "CONNECT" && r.Connect != nil {
+		r.Connect(w, req)
+		return
+	}
+
+	// 1. Exact method match
+	if rt, params, ok := r.find(req.Method, req.Path); ok {
+		req.Params = params
+		rt.handler(w, req)
+		return
+	}
+
+	// 2. Automatic HEAD: run the GET handler, the ResponseWriter drops the body.
+	if req.Method == "HEAD" && r.AutoHead {
+		if rt, params, ok := r.find("GET", req.Path); ok {
+			req.Params = params
+			rt.handler(w, req)
+			return
+		}
+	}
+
+	// 2b. The path matches a route once its trailing slash is added or
+	// removed, and the route's policy allows that.
+	if r.serveOtherSlash(w, req) {
+		return
+	}
+
+	// 3. Automatic OPTIONS: report which methods the path supports.
+	if req.Method == "OPTIONS" && r.AutoOptions {
+		if methods := r.AllowedMethods(req.Path); len(methods) > 0 {
+			allow := strings.Join(methods, ", ")
+			headers := []string{"Allow: " + allow}
+			// A CORS preflight the CORS middleware approved, without methods
+			// of its own to allow, is told the path's.
+			if req.Header("Access-Control-Request-Method") != "" && w.Header().Has("Access-Control-Allow-Origin") {
+				headers = append(headers, "Access-Control-Allow-Methods: "+allow)
+			}
+			sendResponse(w, 204, headers, "")
+			return
+		}
+	}
+
+	// 4. The path exists but not for this method (e.g. DELETE /files/x):
+	// tell the client which methods would work (RFC 9110 15.5.6). "*" is
+	// only a path for OPTIONS.
+	if methods := r.AllowedMethods(req.Path); len(methods) > 0 && req.Path != "*" {
+		sendResponse(w, 405, []string{"Allow: " + strings.Join(methods, ", ")}, "")
+		return
+	}
+
+	// 5. Nothing matched
+	if r.NotFound != nil {
+		r.NotFound(w, req)
+		return
+	}
+	sendResponse(w, 404, nil, "")
+}
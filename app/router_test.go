@@ -0,0 +1,115 @@
+package main
+
+import (
+	"slices"  // Used to reverse registration orders
+	"testing" // The test framework
+)
+
+func TestAutoHeadAndOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		method     string
+		wantStatus int
+		wantAllow  string
+	}{
+		{"HEAD, auto-head on", nil, "HEAD", 200, ""},
+		{"HEAD, auto-head off", []string{"-auto-head=false"}, "HEAD", 405, "GET, OPTIONS"},
+		{"OPTIONS, auto-options on", nil, "OPTIONS", 204, "GET, HEAD, OPTIONS"},
+		{"OPTIONS, auto-options off", []string{"-auto-options=false"}, "OPTIONS", 405, "GET, HEAD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.args...)
+			resp := do(t, s, request(tt.method, "/user-agent", "", "User-Agent: tester"))
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.status, tt.wantStatus)
+			}
+			if got := resp.header.Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+		})
+	}
+
+	// An automatic HEAD mirrors the GET's headers, without the body.
+	s := newTestServer(t)
+	getResp := get(t, s, "/user-agent", "User-Agent: tester")
+	headResp := do(t, s, request("HEAD", "/user-agent", "", "User-Agent: tester"))
+	for _, name := range []string{"Content-Type", "Content-Length"} {
+		if headResp.header.Get(name) != getResp.header.Get(name) {
+			t.Errorf("HEAD %s = %q, GET %s = %q", name, headResp.header.Get(name), name, getResp.header.Get(name))
+		}
+	}
+	if headResp.body != "" {
+		t.Errorf("HEAD sent a body: %q", headResp.body)
+	}
+}
+
+func TestMostSpecificRouteWins(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string // Registered in this order, then in reverse
+		path     string
+		want     string
+	}{
+		{"exact beats prefix", []string{"/files/", "/files/readme"}, "/files/readme", "/files/readme"},
+		{"exact beats parameter", []string{"/files/{name}", "/files/readme"}, "/files/readme", "/files/readme"},
+		{"parameter beats prefix", []string{"/files/", "/files/{name}"}, "/files/other", "/files/{name}"},
+		{"longest prefix", []string{"/{rest...}", "/files/", "/files/docs/"}, "/files/docs/a/b", "/files/docs/"},
+		{"shorter prefix where the longer does not match", []string{"/files/", "/files/docs/"}, "/files/img/a", "/files/"},
+		{"root catch-all takes the rest", []string{"/{rest...}", "/files/"}, "/elsewhere", "/{rest...}"},
+	}
+	for _, tt := range tests {
+		for _, reversed := range []bool{false, true} {
+			patterns := slices.Clone(tt.patterns)
+			name := tt.name
+			if reversed {
+				slices.Reverse(patterns)
+				name += ", reversed"
+			}
+			t.Run(name, func(t *testing.T) {
+				s := newTestServer(t)
+				s.Router = NewRouter()
+				for _, pattern := range patterns {
+					s.Router.Get(pattern, func(w ResponseWriter, req *HTTPRequest) {
+						sendResponse(w, 200, nil, pattern)
+					})
+				}
+				if got := get(t, s, tt.path).body; got != tt.want {
+					t.Errorf("GET %s served by %q, want %q", tt.path, got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestOptionsReflectsAllowedMethods(t *testing.T) {
+	preflight := []string{"Origin: https://app.example", "Access-Control-Request-Method: GET"}
+	tests := []struct {
+		name          string
+		target        string
+		headers       []string
+		wantAllow     string
+		wantCORSAllow string
+	}{
+		{"GET-only path", "/user-agent", nil, "GET, HEAD, OPTIONS", ""},
+		{"files", "/files/f.txt", nil, "GET, HEAD, POST, PUT, DELETE, OPTIONS", ""},
+		{"GET-only path, preflight", "/user-agent", preflight, "GET, HEAD, OPTIONS", "GET, HEAD, OPTIONS"},
+		{"files, preflight", "/files/f.txt", preflight, "GET, HEAD, POST, PUT, DELETE, OPTIONS", "GET, HEAD, POST, PUT, DELETE, OPTIONS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, "-cors-origins", "https://app.example")
+			resp := do(t, s, request("OPTIONS", tt.target, "", tt.headers...))
+			if resp.status != 204 {
+				t.Fatalf("status = %d, want 204", resp.status)
+			}
+			if got := resp.header.Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if got := resp.header.Get("Access-Control-Allow-Methods"); got != tt.wantCORSAllow {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, tt.wantCORSAllow)
+			}
+		})
+	}
+}
@@ -0,0 +1,957 @@
+package main
+
+import (
+	"bufio"         // Used to read requests line by line from the connection
+	"context"       // Used to stop the listeners
+	"crypto/tls"    // Used to serve HTTPS
+	"errors"        // Used to detect a closed listener
+	"fmt"           // Used for formatted I/O (printing to console)
+	"io"            // Used to handle input/output errors like EOF
+	"log/slog"      // Used to log connection errors
+	"net"           // Used for network I/O (TCP sockets)
+	"os"            // Used for the permissions of Unix sockets
+	"runtime/debug" // Used to log the stack trace of a panicking handler
+	"strconv"       // Used to format the Keep-Alive header
+	"strings"       // Used to find the end of the request head
+	"sync/atomic"   // Used to swap in a reloaded Server
+	"time"          // Used for durations in the configuration
+)
+
+// Server holds the configuration shared by every connection.
+type Server struct {
+	// Addr is the "host:port" the server listens on, e.g. "0.0.0.0:4221".
+	Addr string
+	// Dir is the directory that /files/ reads from and writes to.
+	Dir string
+	// AllowDotfiles lets /files/ serve paths with a component starting with
+	// a dot. Off by default so secrets like .env or .git/ stay private.
+	AllowDotfiles bool
+	// FollowSymlinks lets /files/ follow symlinks inside Dir, as long as
+	// they lead to somewhere inside Dir too. Off, any path through a symlink
+	// is refused.
+	FollowSymlinks bool
+	// IndexFiles are the file names (e.g. "index.html") served for a GET of
+	// a directory below /files/ that contains one, in order of preference.
+	IndexFiles []string
+	// DirListing makes a GET for a directory below /files/ without an index
+	// file return a listing of its contents instead of 404.
+	DirListing bool
+	// SPAFallback, if set, is the file (relative to Dir, e.g. "index.html")
+	// served with 200 for a GET below /files/ that matches nothing on disk.
+	SPAFallback string
+	// ErrorPages, if set, replaces the empty body of error responses with a
+	// page, HTML or JSON depending on Accept. ErrorPagesDir may hold custom
+	// ones ("404.html", "404.json", ...); see ErrorPage.
+	ErrorPages    bool
+	ErrorPagesDir string
+	// Precompressed serves "name.br" or "name.gz", when it exists next to
+	// a file requested below /files/, to clients that accept that encoding.
+	Precompressed bool
+	// Compress compresses responses of CompressTypes larger than
+	// CompressMinSize bytes for clients that accept it (see Compress).
+	Compress        bool
+	CompressMinSize int
+	CompressTypes   []string
+	// MIMETypes maps file extensions (".md") to the Content-Type /files/
+	// serves them with, taking precedence over the built-in table.
+	MIMETypes map[string]string
+	// Mounts maps URL prefixes ("/static/") to directories served read-only
+	// under them, like Dir is under /files/.
+	Mounts map[string]string
+	// Proxies forward the requests under their prefix to their upstreams.
+	Proxies []*ReverseProxy
+	// Redirects send the requests they match elsewhere, before routing.
+	Redirects []RedirectRule
+	// Rewrites change the path of the requests they match before routing.
+	Rewrites []RewriteRule
+	// CORS, if set, lets scripts on the origins it allows call the server.
+	CORS *CORSConfig
+	// ReadyChecks are the dependencies GET /readyz checks.
+	ReadyChecks []ReadyCheck
+	// ConnectAllow, if not empty, lets CONNECT open tunnels to the host:port
+	// targets it lists, making the server a forward proxy (see ConnectProxy).
+	ConnectAllow []string
+	// H2C serves HTTP/2 on cleartext connections to clients that start with
+	// the HTTP/2 preface or ask to upgrade with "Upgrade: h2c".
+	H2C bool
+	// ProxyProtocol requires every connection to start with a PROXY protocol
+	// (v1 or v2) header, as sent by load balancers such as HAProxy or AWS NLB.
+	ProxyProtocol bool
+	// MaxRequestBytes caps the size of a single request (request line, headers
+	// and body combined). Zero means no limit.
+	MaxRequestBytes int64
+	// ReadOnly refuses every request that would modify files (POST, PUT,
+	// PATCH, DELETE) with 403.
+	ReadOnly bool
+	// AllowedMethods, if not empty, is the only set of methods the server
+	// accepts. Any other method is answered with 405 whatever the routes say.
+	AllowedMethods []string
+	// EmitWarnings adds a Warning header to responses the server had to
+	// degrade (altered content, unsupported encoding, ...).
+	EmitWarnings bool
+	// CacheTTL is how long responses of cached routes (/echo/) are kept in
+	// memory. Zero disables the cache.
+	CacheTTL time.Duration
+	// Credentials, if not empty, maps user names to passwords that HTTP
+	// Basic authentication requires before uploads (POST /files/) are accepted.
+	Credentials map[string]string
+	// JWT, if set, requires a bearer token signed with its key before uploads
+	// are accepted. It takes the place of Credentials.
+	JWT *JWTConfig
+	// RateLimit, if positive, is the number of requests per second each
+	// client IP may make on average; RateBurst is how many it may make at once.
+	RateLimit float64
+	RateBurst int
+	// AccessLog, if set, receives a line per request in the Common Log Format,
+	// or the Combined Log Format (adding Referer and User-Agent) when
+	// AccessLogCombined is set.
+	AccessLog         io.Writer
+	AccessLogCombined bool
+	// Metrics, if set, counts connections and requests. MetricsPath, if not
+	// empty, is where they are served in the Prometheus text format.
+	Metrics     *Metrics
+	MetricsPath string
+	// Debug serves runtime profiles for go tool pprof under /debug/pprof/.
+	Debug bool
+	// ReadTimeout limits how long a client may take to send a request (head
+	// and body), WriteTimeout how long handling it and writing the response
+	// may take, and IdleTimeout how long a keep-alive connection may wait for
+	// the next request. Zero means no limit.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// MaxKeepAliveRequests, if positive, is how many requests a connection
+	// may carry before the server closes it. Together with IdleTimeout it is
+	// advertised to clients in a Keep-Alive response header.
+	MaxKeepAliveRequests int
+	// MaxConnections, if positive, caps the number of connections handled at
+	// once. Further clients wait in the listen backlog until one closes, or,
+	// with RejectWhenFull, are answered 503 with Retry-After straight away.
+	MaxConnections int
+	RejectWhenFull bool
+	// Workers, if positive, switches to a fixed pool of that many goroutines
+	// handling connections, instead of one new goroutine per connection.
+	// Accepted connections wait for a free worker in a queue of QueueSize;
+	// when it is full, accepting pauses (or, with RejectWhenFull, new clients
+	// get 503). A keep-alive connection holds its worker until it closes, so
+	// Workers also caps the number of connections handled at once.
+	Workers   int
+	QueueSize int
+	// Router maps each request to the handler that serves it.
+	Router *Router
+	// live points to the Server that serves new requests, shared by every
+	// generation of a reloadable server (see Reload).
+	live *atomic.Pointer[Server]
+	// conns tracks the connections ListenAndServeAll accepted, for Shutdown.
+	conns *connSet
+	// VirtualHosts maps host names ("example.com", lower case) to the site
+	// served for requests with that Host; any other goes to Router (see
+	// NewVirtualHost).
+	VirtualHosts map[string]*Server
+	// OnReady, if set, is called by ListenAndServe once the listener is bound,
+	// with the address actually bound (useful with port 0). Callers such as
+	// scripts and tests can wait for it instead of retrying connections.
+	OnReady func(addr net.Addr)
+	// EchoInvalidUTF8 decides what /echo/ does with content that is not valid
+	// UTF-8: "replace" substitutes U+FFFD for bad bytes, "reject" returns 400.
+	EchoInvalidUTF8 string
+}
+
+// Listener is an address the server accepts connections on.
+type Listener struct {
+	// Addr is a TCP "host:port" (e.g. ":8080", "[::1]:8443") or the path of
+	// a Unix domain socket after "unix:" (e.g. "unix:/run/server.sock").
+	Addr string
+	// Bound, if set, is the listener to serve, already bound elsewhere (e.g.
+	// by systemd); Addr then only names it.
+	Bound net.Listener
+	// Mode, if not zero, is the permissions of a Unix socket file (e.g.
+	// 0660 to let only the owner and group, such as nginx's, connect).
+	Mode os.FileMode
+	// CertFile and KeyFile, if set, make the listener speak HTTPS with the
+	// certificate chain in CertFile and its private key in KeyFile (both PEM
+	// encoded).
+	CertFile string
+	KeyFile  string
+}
+
+// ListenAndServe binds to s.Addr and serves connections until the listener fails.
+func (s *Server) ListenAndServe() error {
+	return s.ListenAndServeAll(context.Background(), []Listener{{Addr: s.Addr}})
+}
+
+// ListenAndServeTLS is like ListenAndServe but speaks HTTPS: every connection
+// starts with a TLS handshake using the certificate chain in certFile and its
+// private key in keyFile (both PEM encoded).
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	return s.ListenAndServeAll(context.Background(), []Listener{{Addr: s.Addr, CertFile: certFile, KeyFile: keyFile}})
+}
+
+// ListenAndServeAll binds every one of listeners (e.g. :8080 for HTTP and
+// :8443 for HTTPS) and serves them all with the same Router, each with an
+// accept loop of its own. Nothing is served unless every listener could be
+// bound. When one of them fails the others are closed too, and its error is
+// returned. MaxConnections and Workers apply to each listener separately.
+//
+// Once ctx is done the listeners are closed, removing Unix socket files, and
+// nil is returned. Connections being served are left to finish; Shutdown
+// waits for them.
+func (s *Server) ListenAndServeAll(ctx context.Context, listeners []Listener) error {
+	if s.conns == nil {
+		s.conns = newConnSet()
+	}
+
+	// 1. Create the Listeners
+	var bound []net.Listener
+	closeAll := func() {
+		for _, l := range bound {
+			l.Close()
+		}
+	}
+	for _, ln := range listeners {
+		l, err := s.listen(ln)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		bound = append(bound, l)
+	}
+	// 'defer' ensures the listeners are closed if we return unexpectedly.
+	defer closeAll()
+
+	// 2. Serve each one until the first fails or we are told to stop
+	errs := make(chan error, len(bound))
+	for _, l := range bound {
+		// The listener is bound: connections from now on will be accepted.
+		if s.OnReady != nil {
+			s.OnReady(l.Addr())
+		}
+		go func() { errs <- s.Serve(l) }()
+	}
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// bind binds ln's socket into ln.Bound, unless it is bound already.
+func (ln *Listener) bind() error {
+	if ln.Bound != nil {
+		return nil
+	}
+	var err error
+	if path, ok := strings.CutPrefix(ln.Addr, "unix:"); ok {
+		ln.Bound, err = listenUnix(path, ln.Mode)
+	} else {
+		ln.Bound, err = net.Listen("tcp", ln.Addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to bind to %s: %w", ln.Addr, err)
+	}
+	return nil
+}
+
+// listen binds the listener for ln, wrapped in TLS if it has a certificate.
+func (s *Server) listen(ln Listener) (net.Listener, error) {
+	if err := ln.bind(); err != nil {
+		return nil, err
+	}
+	l := ln.Bound
+	if ln.CertFile == "" {
+		return l, nil
+	}
+
+	// The PROXY header arrives in clear text before the handshake, but the
+	// TLS listener would try to decrypt it.
+	if s.ProxyProtocol {
+		l.Close()
+		return nil, errors.New("the PROXY protocol cannot be combined with TLS")
+	}
+
+	cert, err := tls.LoadX509KeyPair(ln.CertFile, ln.KeyFile)
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// TLS 1.0 and 1.1 are deprecated (RFC 8996).
+		MinVersion: tls.VersionTLS12,
+		// Tell ALPN clients (browsers) that we only speak HTTP/1.1.
+		NextProtos: []string{"http/1.1"},
+	}
+
+	// The handshake happens on the first read, inside each connection's own
+	// goroutine, so a slow client cannot hold up the accept loop.
+	return tls.NewListener(l, config), nil
+}
+
+// Serve accepts connections on l and handles each one in its own goroutine,
+// or in the worker pool when Workers is set.
+func (s *Server) Serve(l net.Listener) error {
+	// slots is a semaphore with one token per connection being handled, so
+	// a flood of clients cannot spawn goroutines until we run out of memory.
+	var slots chan struct{}
+	if s.MaxConnections > 0 {
+		slots = make(chan struct{}, s.MaxConnections)
+	}
+	waitForSlot := slots != nil && !s.RejectWhenFull
+	release := func() {
+		if slots != nil {
+			<-slots
+		}
+	}
+	conns := s.conns
+	serve := func(conn net.Conn) {
+		defer release()
+		conns.add(conn)
+		defer conns.remove(conn)
+		s.current().handleConnection(conn, conns)
+	}
+
+	// The worker pool: connections are handed to the workers through queue,
+	// which is closed (stopping them) when Serve returns.
+	var queue chan net.Conn
+	if s.Workers > 0 {
+		queue = make(chan net.Conn, s.QueueSize)
+		defer close(queue)
+		for range s.Workers {
+			go func() {
+				for conn := range queue {
+					serve(conn)
+				}
+			}()
+		}
+	}
+
+	// --- THE MAIN CONNECTION LOOP ---
+	// This loop runs forever, waiting for new users to connect.
+	for {
+		// Without RejectWhenFull, stop accepting while every slot is taken:
+		// new clients queue up in the kernel's listen backlog meanwhile.
+		if waitForSlot {
+			slots <- struct{}{}
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			if waitForSlot {
+				<-slots
+			}
+			// A closed listener will never accept again, so stop instead of spinning.
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			slog.Error("accept failed", "err", err)
+			continue
+		}
+
+		if slots != nil && !waitForSlot {
+			select {
+			case slots <- struct{}{}:
+			default:
+				go rejectConnection(conn)
+				continue
+			}
+		}
+
+		if queue != nil {
+			if !s.RejectWhenFull {
+				queue <- conn
+				continue
+			}
+			select {
+			case queue <- conn:
+			default:
+				release()
+				go rejectConnection(conn)
+			}
+			continue
+		}
+
+		// Concurrency (Goroutines)
+		// The 'go' keyword spawns a lightweight thread.
+		// This allows the main loop to immediately go back to waiting for the NEXT user.
+		go serve(conn)
+	}
+}
+
+// rejectConnection answers a connection the server has no room for with 503
+// and closes it. The request is not read: whatever it is, the answer is the
+// same.
+func rejectConnection(conn net.Conn) {
+	defer conn.Close()
+	// A client that does not read its answer must not hold the goroutine.
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	w := newResponse(conn, &HTTPRequest{Close: true})
+	sendResponse(w, 503, []string{"Retry-After: 1"}, "")
+	w.finish()
+}
+
+// handleConnection manages the lifecycle of a single TCP connection.
+// It supports Persistent Connections (Keep-Alive) and Explicit Closures.
+// conns, if not nil, is told when the connection is idle between requests.
+func (s *Server) handleConnection(conn net.Conn, conns *connSet) {
+	// Ensure the connection is closed when this function finally returns.
+	defer conn.Close()
+
+	// A bug outside the handlers (parsing, reading the body, ...) must not
+	// take the whole server down: log it and drop just this connection.
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("connection panicked",
+				"remote_addr", conn.RemoteAddr().String(),
+				"panic", fmt.Sprint(r),
+				"stack", string(debug.Stack()),
+			)
+		}
+	}()
+
+	if s.Metrics != nil {
+		s.Metrics.connections.Add(1)
+		defer s.Metrics.connections.Add(-1)
+	}
+
+	// All reads go through one buffered reader for the whole connection.
+	// Whatever it buffers beyond the current request (the PROXY header's
+	// successor, or the next pipelined request arriving in the same packet)
+	// stays there for the next read, so nothing is lost between requests.
+	reader := readerPool.Get().(*bufio.Reader)
+	reader.Reset(conn)
+	defer func() {
+		reader.Reset(nil) // Do not keep the connection reachable from the pool.
+		readerPool.Put(reader)
+	}()
+
+	// clientAddr is the address of the real client. Behind a proxy this differs
+	// from conn.RemoteAddr(), which is the address of the proxy itself.
+	clientAddr := conn.RemoteAddr()
+
+	// Deadlines make a silent client fail its read instead of holding this
+	// goroutine forever. The PROXY header counts as part of the first request.
+	conn.SetReadDeadline(deadline(s.ReadTimeout))
+	if s.ProxyProtocol {
+		addr, err := readProxyHeader(reader)
+		if err != nil {
+			slog.Warn("invalid PROXY header", "remote_addr", conn.RemoteAddr().String(), "err", err)
+			return
+		}
+		// A nil address means the proxy sent LOCAL/UNKNOWN (e.g. a health check).
+		if addr != nil {
+			clientAddr = addr
+		}
+	}
+
+	// served counts the requests read on this connection, for MaxKeepAliveRequests.
+	served := 0
+
+	// --- PERSISTENT CONNECTION LOOP ---
+	// HTTP/1.1 connections stay open by default unless "Connection: close" is sent.
+	for first := true; ; first = false {
+		// 1. Read Request Data
+		// Between requests the client has IdleTimeout to start the next one;
+		// from its first byte on, ReadTimeout covers the head and body.
+		// (A pipelined request that is already buffered is peeked at once.)
+		if !first {
+			conn.SetReadDeadline(deadline(s.IdleTimeout))
+			if !conns.idle(conn) {
+				break // Shutting down
+			}
+			if _, err := reader.Peek(1); err != nil {
+				break // Closed or idle for too long: nothing to report.
+			}
+			conns.busy(conn)
+			conn.SetReadDeadline(deadline(s.ReadTimeout))
+		}
+
+		// The request has started: it is served with the settings and
+		// routes of the latest reload, whatever the connection started with.
+		s := s.current()
+
+		// The head is read line by line up to the blank line that ends it,
+		// however many packets it spans; the body stays unread for now.
+		raw, err := s.readHead(reader)
+		if err == errMalformedHead {
+			// Where this request ends, and the next one starts, is anyone's
+			// guess.
+			slog.Warn("malformed request head", "remote_addr", clientAddr.String())
+			w := newResponse(conn, &HTTPRequest{Close: true})
+			sendResponse(w, 400, nil, "")
+			w.finish()
+			break
+		}
+		if err == errHeadTooLarge {
+			// The rest of the head is still on the wire, so the connection
+			// cannot be reused.
+			slog.Warn("request head too large", "remote_addr", clientAddr.String())
+			w := newResponse(conn, &HTTPRequest{Close: true})
+			sendResponse(w, 431, nil, "")
+			w.finish()
+			break
+		}
+		if err != nil {
+			// A client that started a request but is too slow to finish it
+			// gets told why it is being hung up on.
+			if isTimeout(err) && raw != "" {
+				w := newResponse(conn, &HTTPRequest{Close: true})
+				sendResponse(w, 408, nil, "")
+				w.finish()
+			}
+			// io.EOF between requests means the client (browser/curl) has
+			// closed the connection cleanly; a connection that never sent
+			// anything (e.g. a browser's speculative preconnect) is not
+			// worth a warning either.
+			if err != io.EOF && !(isTimeout(err) && raw == "") {
+				slog.Warn("read request failed", "remote_addr", clientAddr.String(), "err", err)
+			}
+			break
+		}
+
+		// A client with prior knowledge speaks HTTP/2 from the start.
+		if first && s.H2C && raw == h2Preface {
+			s.serveH2C(conn, reader, clientAddr)
+			return
+		}
+
+		// 2. Parse the Request
+		req, err := parseRequest(raw)
+		if err != nil {
+			// A request line we cannot make sense of says nothing about
+			// where the request ends.
+			slog.Warn("malformed request", "remote_addr", clientAddr.String(), "err", err)
+			w := newResponse(conn, &HTTPRequest{Close: true})
+			sendResponse(w, 400, nil, "")
+			w.finish()
+			break
+		}
+
+		req.emitWarnings = s.EmitWarnings
+		req.RemoteAddr = clientAddr.String()
+
+		// Tell the client how long we keep the connection and for how many
+		// more requests, and hang up once it has used them all, or once the
+		// server is shutting down.
+		served++
+		req.keepAlive, req.Close = s.keepAlive(served, req.Close || conns.shuttingDown())
+
+		// From here on the clock runs for handling the request and writing
+		// the response.
+		conn.SetWriteDeadline(deadline(s.WriteTimeout))
+
+		// Count the request before routing so /health includes itself.
+		totalRequests.Add(1)
+
+		// 3. Pre-Routing Checks
+		// Some requests can be refused from the head alone. This matters for
+		// "Expect: 100-continue": the client holds the body back until we say
+		// "100 Continue", so rejecting first spares it a pointless upload.
+		w := newResponse(conn, req)
+		w.reader = reader
+		// HTTP/1.0 clients do not know 100 Continue; they send the body
+		// anyway, so the expectation is ignored (RFC 9110 10.1.1).
+		expectContinue := strings.EqualFold(req.Header("Expect"), "100-continue") && !req.isHTTP10()
+		if status, headers := s.rejectRequest(raw, req); status != 0 {
+			// The client may or may not send the body anyway, so we cannot
+			// tell where the next request would start.
+			if expectContinue || req.Header("Content-Length") != "" {
+				req.Close = true
+			}
+			sendResponse(w, status, headers, "")
+		} else {
+			streaming := s.routerFor(req).streamsBody(req)
+			if expectContinue && !streaming {
+				// Interim response: the client may now send the body.
+				if err := writeFull(conn, []byte(continueResponse)); err != nil {
+					slog.Warn("write response failed", "request_id", req.ID, "remote_addr", clientAddr.String(), "err", err)
+					break
+				}
+			}
+
+			// Read exactly the declared body; anything after it stays in
+			// reader for the next iteration. Streaming routes (uploads) get
+			// a reader over the connection instead and read it themselves.
+			read := readBody
+			if streaming {
+				read = streamBody
+			}
+			if err := read(reader, req, s.MaxRequestBytes); err != nil {
+				// The client hung up before sending Content-Length bytes (or
+				// sent a nonsense length or broken chunks). Never hand a
+				// truncated body to a handler: it would happily store a
+				// partial upload.
+				slog.Warn("read request body failed", "request_id", req.ID, "remote_addr", clientAddr.String(), "err", err)
+				req.Close = true
+				if errors.Is(err, errBodyTooLarge) {
+					sendResponse(w, 413, nil, "")
+				} else if errors.Is(err, errTrailerTooLarge) {
+					sendResponse(w, 431, nil, "")
+				} else if isTimeout(err) {
+					sendResponse(w, 408, nil, "")
+				} else {
+					sendResponse(w, 400, nil, "")
+				}
+				w.finish()
+				break
+			}
+
+			// A streaming handler may answer without reading the body (e.g.
+			// 401), so the client is only asked for it once the handler
+			// starts reading.
+			var cont *continueReader
+			if expectContinue && streaming {
+				cont = &continueReader{r: req.BodyReader, conn: conn, w: w}
+				req.BodyReader = cont
+			}
+
+			// The client offers to continue in HTTP/2. Streamed bodies are
+			// for the handler to read, so those requests stay in HTTP/1.1.
+			if s.H2C && req.BodyReader == nil {
+				if settings, ok := wantsH2C(conn, req); ok {
+					w.Hijack() // Nothing of the HTTP/1.1 response is sent
+					w.finish()
+					s.upgradeH2C(conn, reader, req, settings, clientAddr)
+					return
+				}
+			}
+
+			// 4. Routing Logic
+			// The Router picks the handler based on the method and path.
+			s.serveRequest(w, req, clientAddr)
+
+			// A handler that took over the connection (e.g. a WebSocket)
+			// is done with it once it returns.
+			if w.hijacked {
+				w.finish()
+				return
+			}
+
+			// Skip whatever a streaming handler left unread (e.g. after
+			// answering 401), so the next request starts in the right place.
+			// A client never told to continue may or may not send the body,
+			// so there is no telling where the next request would start.
+			if cont != nil && !cont.sent {
+				req.Close = true
+			} else if req.BodyReader != nil && !discardBody(req.BodyReader) {
+				req.Close = true
+			}
+		}
+
+		// Complete the response (whatever the handler left unwritten) and
+		// send it. A failed or incomplete write leaves the client with a
+		// partial response, so the connection can no longer be trusted for
+		// the next request.
+		w.finish()
+		if w.err != nil {
+			slog.Warn("write response failed", "request_id", req.ID, "remote_addr", clientAddr.String(), "err", w.err)
+			break
+		}
+
+		// --- FINAL STEP: CHECK IF WE SHOULD CLOSE ---
+		// If the "Connection: close" header was present, we break the loop.
+		// This allows 'defer conn.Close()' to run, effectively hanging up the phone.
+		if req.Close {
+			break
+		}
+	}
+}
+
+// maxDiscardBytes is how much of an unread body discardBody reads through
+// to keep the connection; for more, closing it is cheaper.
+const maxDiscardBytes = 256 << 10
+
+// continueResponse is the interim response to "Expect: 100-continue".
+const continueResponse = "HTTP/1.1 100 Continue\r\n\r\n"
+
+// continueReader sends "100 Continue" on the first read of a body the
+// client holds back until told to send it. Once the final response has
+// started it is too late for that; the client sends the body after a
+// timeout of its own anyway.
+type continueReader struct {
+	r    io.Reader
+	conn net.Conn
+	w    *response
+	sent bool
+	err  error
+}
+
+func (c *continueReader) Read(p []byte) (int, error) {
+	if !c.sent {
+		c.sent = true
+		if !c.w.wroteHeader {
+			c.err = writeFull(c.conn, []byte(continueResponse))
+		}
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// discardBody reads the rest of body and reports whether it ended within
+// maxDiscardBytes. If not, the connection has to be closed.
+func discardBody(body io.Reader) bool {
+	n, err := io.CopyN(io.Discard, body, maxDiscardBytes+1)
+	return err == io.EOF && n <= maxDiscardBytes
+}
+
+// keepAlive applies the keep-alive policy to the served-th request of a
+// connection. It returns the Keep-Alive header value to advertise (empty if
+// there is no limit to advertise) and whether the connection must close
+// after this request.
+func (s *Server) keepAlive(served int, close bool) (string, bool) {
+	if s.MaxKeepAliveRequests > 0 && served >= s.MaxKeepAliveRequests {
+		close = true
+	}
+	if close {
+		return "", true
+	}
+
+	var params []string
+	if s.IdleTimeout > 0 {
+		params = append(params, "timeout="+strconv.Itoa(int(s.IdleTimeout.Seconds())))
+	}
+	if s.MaxKeepAliveRequests > 0 {
+		params = append(params, "max="+strconv.Itoa(s.MaxKeepAliveRequests-served))
+	}
+	return strings.Join(params, ", "), false
+}
+
+// deadline returns the deadline for a timeout starting now, or the zero
+// time, which means no deadline, if timeout is 0.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// isTimeout reports whether err is a read or write deadline expiring.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// errMalformedHead is returned by readHead for a head line with a bare CR
+// or LF, or another control character.
+var errMalformedHead = errors.New("malformed request head")
+
+// maxHeadBytes caps the head of a request whatever -max-request-bytes says,
+// even 0 (no limit): the head is held in memory whole before it is parsed.
+const maxHeadBytes = 1 << 20
+
+// errHeadTooLarge is returned by readHead once more than maxHeadBytes has
+// arrived without the head ending.
+var errHeadTooLarge = errors.New("request head too large")
+
+// readHead reads the head of the next request from r: the request line and
+// headers up to and including the blank line that ends them. Nothing after
+// it is consumed, so the body (or the next pipelined request) is still in r.
+// It stops early once more than MaxRequestBytes has arrived without the head
+// ending, leaving checkRequestSize to refuse the request, and fails with
+// errHeadTooLarge past maxHeadBytes.
+func (s *Server) readHead(r *bufio.Reader) (string, error) {
+	var raw strings.Builder
+	lineStart := 0 // Where the line being read starts in raw
+	for {
+		if s.MaxRequestBytes > 0 && int64(raw.Len()) > s.MaxRequestBytes {
+			return raw.String(), nil
+		}
+		if raw.Len() > maxHeadBytes {
+			return raw.String(), errHeadTooLarge
+		}
+
+		// ReadSlice returns ErrBufferFull for a line longer than the
+		// buffer; the rest of the line simply comes with the next call.
+		line, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			raw.Write(line)
+			// A client that hangs up halfway through the head sent nothing usable.
+			if err == io.EOF && raw.Len() > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return raw.String(), err
+		}
+
+		// Empty lines before the request line, e.g. a stray CRLF a client
+		// sent after the previous body, are ignored (RFC 9112 2.2).
+		if raw.Len() == 0 && string(line) == "\r\n" {
+			continue
+		}
+		raw.Write(line)
+		if err == bufio.ErrBufferFull {
+			continue // The line goes on
+		}
+		// Lines end in CRLF. A bare LF or CR inside a line would end it
+		// for some parsers and not others, so that one request could be
+		// read as two (RFC 9112 2.2).
+		if !validHeadLine(raw.String()[lineStart:]) {
+			return raw.String(), errMalformedHead
+		}
+		lineStart = raw.Len()
+		if string(line) == "\r\n" && strings.HasSuffix(raw.String(), "\r\n\r\n") {
+			return raw.String(), nil
+		}
+	}
+}
+
+// validHeadLine reports whether line, a request line or header line with its
+// line ending, ends in CRLF and has no other control characters than HTAB.
+func validHeadLine(line string) bool {
+	content, ok := strings.CutSuffix(line, "\r\n")
+	if !ok {
+		return false
+	}
+	for i := 0; i < len(content); i++ {
+		if c := content[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// serveRequest runs the Router for req and turns a panicking handler into a
+// 500 response instead of a dropped connection. The stack trace is logged so
+// the bug can be found. The connection is closed afterwards, since the
+// handler may have left it in an unknown state.
+func (s *Server) serveRequest(w *response, req *HTTPRequest, clientAddr net.Addr) {
+	defer func() {
+		if r := recover(); r != nil {
+			// A handler gave up on its response on purpose: cut it off.
+			if r == errAborted {
+				req.Close = true
+				w.abort()
+				return
+			}
+			slog.Error("handler panicked",
+				"request_id", req.ID,
+				"method", req.Method,
+				"path", req.Path,
+				"remote_addr", clientAddr.String(),
+				"panic", fmt.Sprint(r),
+				"stack", string(debug.Stack()),
+			)
+			req.Close = true
+			// Replace whatever the handler started with a 500, unless part
+			// of it was already sent: a second status line would only corrupt
+			// it, so closing is all we can do.
+			if !w.wroteHeader || w.reset() {
+				sendResponse(w, 500, nil, "")
+			} else {
+				w.abort()
+			}
+		}
+	}()
+
+	s.routerFor(req).ServeRequest(w, req)
+}
+
+// checkRequestSize enforces MaxRequestBytes on a request whose raw start was
+// read into raw. It returns the error status to send, or 0 if the request fits:
+//   - 431 Request Header Fields Too Large when the head alone is over the cap
+//   - 413 Content Too Large when head + declared Content-Length is over the cap
+func (s *Server) checkRequestSize(raw string, req *HTTPRequest) int {
+	if s.MaxRequestBytes <= 0 {
+		return 0
+	}
+
+	// raw is the head including the blank line that ends it, or, if that
+	// never arrived, everything read before giving up.
+	headLen := int64(len(raw))
+	if headLen > s.MaxRequestBytes {
+		return 431
+	}
+
+	// Trust the declared length so we can refuse before reading the body.
+	bodyLen, _ := req.contentLength()
+	if headLen+bodyLen > s.MaxRequestBytes {
+		return 413
+	}
+
+	return 0
+}
+
+// rejectRequest runs the checks that can refuse a request before its body is
+// read or any handler runs. It returns the error status and headers to send,
+// or 0 if the request may proceed.
+func (s *Server) rejectRequest(raw string, req *HTTPRequest) (int, []string) {
+	// Oversized requests (413/431). The rest of the request is still on the
+	// wire, so the connection cannot be reused afterwards.
+	if status := s.checkRequestSize(raw, req); status != 0 {
+		req.Close = true
+		return status, nil
+	}
+
+	// Malformed percent-encoding in the path ("/echo/%zz").
+	if req.pathErr != nil {
+		return 400, nil
+	}
+
+	// A POST or PUT with neither Content-Length nor Transfer-Encoding has an
+	// empty body (RFC 9112 6.3). Should the client send one anyway, it would
+	// be read as the next request, so the connection is closed after the
+	// response. HTTP/2 frames bodies itself.
+	if (req.Method == "POST" || req.Method == "PUT") && req.Version != "HTTP/2.0" &&
+		req.Header("Content-Length") == "" && req.Header("Transfer-Encoding") == "" {
+		req.Close = true
+	}
+
+	// 100-continue is the only expectation there is (RFC 9110 10.1.1).
+	if expect := req.Header("Expect"); expect != "" && !strings.EqualFold(expect, "100-continue") {
+		req.Close = true
+		return 417, nil
+	}
+
+	// Chunked is the only transfer coding we can decode; without it we cannot
+	// find the end of the body (RFC 9112 6.1).
+	if req.Header("Transfer-Encoding") != "" {
+		if !req.isChunked() {
+			req.Close = true
+			return 501, nil
+		}
+		// Transfer-Encoding wins over Content-Length, but a request with both
+		// is a classic request smuggling attempt: never reuse the connection.
+		// Nor when an HTTP/1.0 client, which cannot know about chunking, sends
+		// it: something in between may have framed the body differently
+		// (RFC 9112 6.1).
+		if req.Header("Content-Length") != "" || req.isHTTP10() {
+			req.Close = true
+		}
+	}
+
+	// Methods outside -allowed-methods.
+	if !s.methodAllowed(req.Method) {
+		return 405, []string{"Allow: " + strings.Join(s.AllowedMethods, ", ")}
+	}
+
+	// Writes in read-only mode.
+	if s.ReadOnly && isWriteMethod(req.Method) {
+		return 403, nil
+	}
+
+	return 0, nil
+}
+
+// isWriteMethod reports whether method modifies state on the server.
+func isWriteMethod(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// methodAllowed reports whether method passes the global AllowedMethods list.
+func (s *Server) methodAllowed(method string) bool {
+	if len(s.AllowedMethods) == 0 {
+		return true
+	}
+	for _, m := range s.AllowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
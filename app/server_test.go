@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"         // Used to read responses off the wire
+	"context"       // Used to stop listeners
+	"errors"        // Used to panic with errors
+	"io"            // Used to drain connections
+	"log/slog"      // Used to silence the server's logs
+	"net"           // Connections to the server under test
+	"net/http"      // Used to parse responses
+	"os"            // Used by TestMain
+	"path/filepath" // Used to inspect the served directory
+	"strconv"       // Used to format Content-Length
+	"strings"       // Used to build requests
+	"testing"       // The test framework
+	"time"          // Used for deadlines
+)
+
+// The tests drive the server the way clients do: raw requests are written to
+// one end of a net.Pipe whose other end is served by handleConnection, and
+// the bytes that come back are parsed as HTTP responses. What is checked is
+// what goes over the wire.
+
+func TestMain(m *testing.M) {
+	// Refused requests log warnings; the tests check the responses instead.
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a Server configured by args, as on the command line,
+// with every route registered. It serves a new temporary directory unless
+// args set -directory.
+func newTestServer(t testing.TB, args ...string) *Server {
+	t.Helper()
+	cfg, err := configure(append([]string{"-directory", t.TempDir()}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.newServer(nil, nil)
+}
+
+// dial returns the client end of a connection served by s. The connection
+// is closed, and its handleConnection waited for, when the test ends.
+func dial(t testing.TB, s *Server) net.Conn {
+	t.Helper()
+	conn, _ := dialDone(t, s)
+	return conn
+}
+
+// dialDone is dial, also returning a channel closed once handleConnection
+// has returned.
+func dialDone(t testing.TB, s *Server) (net.Conn, <-chan struct{}) {
+	t.Helper()
+	return dialWith(t, s, nil)
+}
+
+// dialWith is dialDone with the server's end of the connection wrapped by
+// wrap, if not nil, e.g. to make its writes fail.
+func dialWith(t testing.TB, s *Server, wrap func(net.Conn) net.Conn) (net.Conn, <-chan struct{}) {
+	t.Helper()
+	client, server := net.Pipe()
+	if wrap != nil {
+		server = wrap(server)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleConnection(server, nil)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	return client, done
+}
+
+// testResponse is a response read off the wire.
+type testResponse struct {
+	status int
+	header http.Header
+	body   string
+	close  bool // "Connection: close", which http.ReadResponse takes out of header
+}
+
+// readResponse reads the response to a request with method from r.
+func readResponse(t testing.TB, r *bufio.Reader, method string) testResponse {
+	t.Helper()
+	resp, err := http.ReadResponse(r, &http.Request{Method: method})
+	if err != nil {
+		t.Fatalf("reading the response to %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading the body of the response to %s: %v", method, err)
+	}
+	return testResponse{status: resp.StatusCode, header: resp.Header, body: string(body), close: resp.Close}
+}
+
+// send writes writes, in separate writes, to a new connection to s and
+// returns the reader the responses are to be read from.
+func send(t testing.TB, s *Server, writes ...string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn := dial(t, s)
+	go func() {
+		for _, data := range writes {
+			if _, err := conn.Write([]byte(data)); err != nil {
+				return // The server hung up, which the test is to notice
+			}
+		}
+	}()
+	return conn, bufio.NewReader(conn)
+}
+
+// do sends the request raw on a new connection to s and returns the response.
+func do(t testing.TB, s *Server, raw string) testResponse {
+	t.Helper()
+	_, r := send(t, s, raw)
+	method, _, _ := strings.Cut(raw, " ")
+	return readResponse(t, r, method)
+}
+
+// get returns the response to a GET of target, with the extra header lines
+// given ("Name: value").
+func get(t testing.TB, s *Server, target string, headers ...string) testResponse {
+	t.Helper()
+	return do(t, s, request("GET", target, "", headers...))
+}
+
+// request formats a request with a Host header, the header lines given and,
+// if body is not empty, the body with its Content-Length.
+func request(method, target, body string, headers ...string) string {
+	var b strings.Builder
+	b.WriteString(method + " " + target + " HTTP/1.1\r\nHost: test\r\n")
+	for _, h := range headers {
+		b.WriteString(h + "\r\n")
+	}
+	if body != "" {
+		b.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n")
+	}
+	b.WriteString("\r\n" + body)
+	return b.String()
+}
+
+// closed reports whether the server hung up on conn, read through r, once
+// every response was read.
+func closed(t testing.TB, conn net.Conn, r *bufio.Reader) bool {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := r.ReadByte()
+	return err == io.EOF
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	tests := []struct {
+		name       string
+		max        string // -max-request-bytes
+		raw        string
+		wantStatus int
+	}{
+		{"fits", "256", request("POST", "/files/f.txt", strings.Repeat("a", 100)), 201},
+		{"head over the cap", "256", request("GET", "/", "", "X-Padding: "+strings.Repeat("a", 300)), 431},
+		{"head and body over the cap", "256", request("POST", "/files/f.txt", strings.Repeat("a", 200)), 413},
+		{"body declared over the cap", "256", "POST /files/f.txt HTTP/1.1\r\nHost: test\r\nContent-Length: 1000\r\n\r\n", 413},
+		// Heads are capped at maxHeadBytes whatever the flag says.
+		{"long header, no cap", "0", request("GET", "/", "", "X-Padding: "+strings.Repeat("a", maxHeadBytes)), 431},
+		{"many headers, no cap", "0", request("GET", "/", "", strings.Repeat("X-Padding: a\r\n", maxHeadBytes/14)+"X-Last: a"), 431},
+		{"long header, default cap", "10485760", request("GET", "/", "", "X-Padding: "+strings.Repeat("a", maxHeadBytes)), 431},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, "-max-request-bytes", tt.max)
+			conn, r := send(t, s, tt.raw)
+			method, _, _ := strings.Cut(tt.raw, " ")
+			resp := readResponse(t, r, method)
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.status, tt.wantStatus)
+			}
+			// The rest of a refused request is never read, so the
+			// connection cannot be reused.
+			if tt.wantStatus != 201 && !closed(t, conn, r) {
+				t.Error("connection left open after refusing the request")
+			}
+		})
+	}
+}
+
+func TestOnReady(t *testing.T) {
+	s := newTestServer(t)
+	ready := make(chan net.Addr, 2)
+	s.OnReady = func(addr net.Addr) { ready <- addr }
+
+	ctx, stop := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.ListenAndServeAll(ctx, []Listener{{Addr: "127.0.0.1:0"}, {Addr: "127.0.0.1:0"}})
+	}()
+	defer func() {
+		stop()
+		<-errs
+	}()
+
+	// Every listener is reported, and accepts at once: no retries.
+	for range 2 {
+		var addr net.Addr
+		select {
+		case addr = <-ready:
+		case err := <-errs:
+			t.Fatalf("ListenAndServeAll: %v", err)
+		}
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatalf("connecting to %s right after OnReady: %v", addr, err)
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		conn.Write([]byte(request("GET", "/", "", "Connection: close")))
+		if resp := readResponse(t, bufio.NewReader(conn), "GET"); resp.status != 200 {
+			t.Errorf("%s: status = %d, want 200", addr, resp.status)
+		}
+		conn.Close()
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowed    string
+		raw        string
+		wantStatus int
+		wantAllow  string
+	}{
+		{"GET allowed", "GET", request("GET", "/", ""), 200, ""},
+		{"POST refused", "GET", request("POST", "/files/f.txt", "hello"), 405, "GET"},
+		{"DELETE refused", "GET,HEAD", request("DELETE", "/files/f.txt", ""), 405, "GET, HEAD"},
+		{"unrouted path still 405", "GET", request("POST", "/nope", "x"), 405, "GET"},
+		{"everything allowed", "", request("POST", "/files/f.txt", "hello"), 201, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, "-allowed-methods", tt.allowed)
+			resp := do(t, s, tt.raw)
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.status, tt.wantStatus)
+			}
+			if got := resp.header.Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			// A refused write never reaches the file system.
+			if _, err := os.Stat(filepath.Join(s.Dir, "f.txt")); (err == nil) != (tt.wantStatus == 201) {
+				t.Errorf("f.txt stored: %v", err == nil)
+			}
+		})
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantStatus int // The first response, sent before the body
+	}{
+		{"read-only", []string{"-read-only"}, 403},
+		{"too large", []string{"-max-request-bytes", "85"}, 413}, // The head is 82 bytes
+		{"method not allowed", []string{"-allowed-methods", "GET"}, 405},
+		{"accepted", nil, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.args...)
+			// Only the head: the client waits for the answer before sending the body.
+			conn, r := send(t, s, "PUT /files/f.txt HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+			resp := readResponse(t, r, "PUT")
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.status, tt.wantStatus)
+			}
+			if tt.wantStatus != 100 {
+				return
+			}
+			conn.Write([]byte("hello"))
+			if resp := readResponse(t, r, "PUT"); resp.status != 201 {
+				t.Errorf("status after the body = %d, want 201", resp.status)
+			}
+		})
+	}
+}
+
+func TestPipelinedBodies(t *testing.T) {
+	next := request("GET", "/echo/next", "")
+	tests := []struct {
+		name     string
+		first    string
+		status   int
+		wantFile string // What f.txt holds afterwards
+	}{
+		{"upload", request("POST", "/files/f.txt", "hello"), 201, "hello"},
+		{"body the handler ignores", request("POST", "/echo/x", "GET /echo/smuggled HTTP/1.1\r\n\r\n"), 405, ""},
+		{"chunked upload", "POST /files/f.txt HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", 201, "hello"},
+		{"body looking like a request", request("PUT", "/files/f.txt", "GET /echo/smuggled HTTP/1.1\r\nHost: test\r\n\r\n"), 201, "GET /echo/smuggled HTTP/1.1\r\nHost: test\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			// Both requests arrive in one write, the second right after the body.
+			_, r := send(t, s, tt.first+next)
+			method, _, _ := strings.Cut(tt.first, " ")
+			if resp := readResponse(t, r, method); resp.status != tt.status {
+				t.Errorf("first status = %d, want %d", resp.status, tt.status)
+			}
+			if resp := readResponse(t, r, "GET"); resp.status != 200 || resp.body != "next" {
+				t.Errorf("second response: %d %q, want 200 %q", resp.status, resp.body, "next")
+			}
+			if data, _ := os.ReadFile(filepath.Join(s.Dir, "f.txt")); string(data) != tt.wantFile {
+				t.Errorf("f.txt = %q, want %q", data, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestBodyFraming(t *testing.T) {
+	const unframed = "POST /files/f.txt HTTP/1.1\r\nHost: test\r\n\r\n"
+	tests := []struct {
+		name       string
+		writes     []string
+		wantStatus int
+		wantFile   string // What f.txt holds afterwards
+		wantClose  bool
+	}{
+		{"unframed body with the head", []string{unframed + "hello"}, 201, "", true},
+		{"unframed body after the head", []string{unframed, "hello"}, 201, "", true},
+		{"unframed, no body at all", []string{unframed}, 201, "", true},
+		{"unframed PUT", []string{"PUT /files/f.txt HTTP/1.1\r\nHost: test\r\n\r\n", "hello"}, 201, "", true},
+		{"Content-Length: 0", []string{"POST /files/f.txt HTTP/1.1\r\nHost: test\r\nContent-Length: 0\r\n\r\n"}, 201, "", false},
+		{"Content-Length, body after the head", []string{"POST /files/f.txt HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\n\r\n", "hel", "lo"}, 201, "hello", false},
+		{"chunked, body after the head", []string{"POST /files/f.txt HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n", "5\r\nhello\r\n", "0\r\n\r\n"}, 201, "hello", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			conn, r := send(t, s, tt.writes...)
+			resp := readResponse(t, r, "POST")
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.status, tt.wantStatus)
+			}
+			if data, _ := os.ReadFile(filepath.Join(s.Dir, "f.txt")); string(data) != tt.wantFile {
+				t.Errorf("f.txt = %q, want %q", data, tt.wantFile)
+			}
+			if tt.wantClose {
+				if !closed(t, conn, r) {
+					t.Error("connection left open")
+				}
+				return
+			}
+			// The body ended where it was declared to: the connection goes on.
+			conn.Write([]byte(request("GET", "/echo/next", "")))
+			if resp := readResponse(t, r, "GET"); resp.body != "next" {
+				t.Errorf("next request: %d %q", resp.status, resp.body)
+			}
+		})
+	}
+}
+
+func TestChunkedTrailer(t *testing.T) {
+	large := strings.Repeat("X-Padding: "+strings.Repeat("a", 1000)+"\r\n", maxHeadBytes/1000)
+	tests := []struct {
+		name       string
+		head       string
+		trailer    string
+		wantStatus int
+	}{
+		{"buffered", "GET /echo/x", "Expires: 0\r\n", 200},
+		{"streamed", "POST /files/f.txt", "Expires: 0\r\n", 201},
+		// Trailers have the limit heads have, whatever -max-request-bytes says.
+		{"buffered, too large", "GET /echo/x", large, 431},
+		{"streamed, too large", "POST /files/f.txt", large, 431},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, "-max-request-bytes", "0")
+			conn, r := send(t, s, tt.head+" HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n", "5\r\nhello\r\n0\r\n", tt.trailer, "\r\n")
+			method, _, _ := strings.Cut(tt.head, " ")
+			resp := readResponse(t, r, method)
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.status, tt.wantStatus)
+			}
+			if tt.wantStatus == 431 && !closed(t, conn, r) {
+				t.Error("connection left open after refusing the trailer")
+			}
+		})
+	}
+}
+
+func TestBodyShorterThanContentLength(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		head string
+	}{
+		{"streamed", nil, "POST /files/f.txt HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\n"},
+		{"buffered", nil, "GET /echo/x HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\n"},
+		// Nothing is allocated for what the client merely declares.
+		{"a terabyte declared, no size limit", []string{"-max-request-bytes", "0"}, "GET /echo/x HTTP/1.1\r\nHost: test\r\nContent-Length: 1099511627776\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serveLoopback(t, tt.args...)
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			conn.Write([]byte(tt.head + "hello"))
+			// The client is done sending, short of the declared length.
+			conn.(*net.TCPConn).CloseWrite()
+			if resp := readResponse(t, bufio.NewReader(conn), "POST"); resp.status != 400 {
+				t.Errorf("status = %d, want 400", resp.status)
+			}
+		})
+	}
+}
+
+func TestPanickingHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler HandlerFunc
+	}{
+		{"before responding", func(w ResponseWriter, req *HTTPRequest) {
+			var m map[string]int
+			m["boom"]++
+		}},
+		{"after setting headers", func(w ResponseWriter, req *HTTPRequest) {
+			w.Header().Set("X-Half", "done")
+			panic("boom")
+		}},
+		{"with an error value", func(w ResponseWriter, req *HTTPRequest) {
+			panic(errors.New("boom"))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.Router.Get("/panic", tt.handler)
+			// The request after it is never served: the connection closes.
+			conn, r := send(t, s, request("GET", "/panic", "")+request("GET", "/", ""))
+			resp := readResponse(t, r, "GET")
+			if resp.status != 500 {
+				t.Errorf("status = %d, want 500", resp.status)
+			}
+			if !resp.close {
+				t.Error("no Connection: close")
+			}
+			if !closed(t, conn, r) {
+				t.Error("connection left open after a panic")
+			}
+
+			// The server itself carries on.
+			if resp := get(t, s, "/"); resp.status != 200 {
+				t.Errorf("status after the panic = %d, want 200", resp.status)
+			}
+		})
+	}
+}
+
+func TestMalformedHead(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		wantStatus int
+	}{
+		{"valid", "GET / HTTP/1.1\r\nHost: test\r\n\r\n", 200},
+		{"tab in a header value", "GET / HTTP/1.1\r\nHost: test\r\nX-A: a\tb\r\n\r\n", 200},
+		{"header longer than the read buffer", "GET / HTTP/1.1\r\nHost: test\r\nX-A: " + strings.Repeat("a", 10000) + "\r\n\r\n", 200},
+		{"bare LF after the request line", "GET / HTTP/1.1\nHost: test\r\n\r\n", 400},
+		{"bare LF after a header", "GET / HTTP/1.1\r\nHost: test\n\r\n", 400},
+		{"bare LF ending the head", "GET / HTTP/1.1\r\nHost: test\r\n\n", 400},
+		{"bare CR in a header", "GET / HTTP/1.1\r\nHost: test\rX-Injected: 1\r\n\r\n", 400},
+		{"bare CR in the target", "GET /echo/a\rb HTTP/1.1\r\nHost: test\r\n\r\n", 400},
+		{"NUL in a header", "GET / HTTP/1.1\r\nHost: test\r\nX-A: a\x00b\r\n\r\n", 400},
+		{"DEL in the target", "GET /echo/a\x7fb HTTP/1.1\r\nHost: test\r\n\r\n", 400},
+		{"escape in a long header", "GET / HTTP/1.1\r\nHost: test\r\nX-A: " + strings.Repeat("a", 10000) + "\x1b\r\n\r\n", 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			// What follows a malformed head is never read as a request.
+			conn, r := send(t, s, tt.raw+request("GET", "/", ""))
+			resp := readResponse(t, r, "GET")
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.status, tt.wantStatus)
+			}
+			if tt.wantStatus == 400 && (!resp.close || !closed(t, conn, r)) {
+				t.Error("connection left open after a malformed head")
+			}
+		})
+	}
+}
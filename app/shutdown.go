@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context" // Bounds how long Shutdown waits
+	"net"     // The connections being tracked
+	"sync"    // Guards the set of connections
+	"time"    // Used to poll for the connections to finish
+)
+
+// connSet tracks the open connections of a server and whether each one is
+// idle, i.e. waiting for the next request on a keep-alive connection.
+// Its methods do nothing on a nil connSet.
+type connSet struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]bool // true while idle
+	shutdown bool
+}
+
+func newConnSet() *connSet {
+	return &connSet{conns: make(map[net.Conn]bool)}
+}
+
+// add starts tracking conn, as busy: its first request is on its way.
+func (c *connSet) add(conn net.Conn) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conns[conn] = false
+}
+
+// remove stops tracking conn once it is closed.
+func (c *connSet) remove(conn net.Conn) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.conns, conn)
+}
+
+// idle marks conn as waiting for its next request. It returns false when the
+// server is shutting down, in which case conn should close instead.
+func (c *connSet) idle(conn net.Conn) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shutdown {
+		return false
+	}
+	c.conns[conn] = true
+	return true
+}
+
+// busy marks conn as serving a request.
+func (c *connSet) busy(conn net.Conn) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conns[conn] = false
+}
+
+// count returns the number of open connections and how many of them are
+// idle.
+func (c *connSet) count() (open, idle int) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, isIdle := range c.conns {
+		if isIdle {
+			idle++
+		}
+	}
+	return len(c.conns), idle
+}
+
+// shuttingDown reports whether connections should close after the request
+// they are serving.
+func (c *connSet) shuttingDown() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shutdown
+}
+
+// Shutdown closes the connections ListenAndServeAll accepted as soon as each
+// is done: idle keep-alive connections straight away, the others once their
+// response is sent (with "Connection: close"). It returns when none is left,
+// or, if ctx ends first, closes those that are left and returns ctx's error.
+// Connections taken over by a handler (WebSockets, CONNECT tunnels) and
+// HTTP/2 connections only end that way.
+//
+// Call it once ListenAndServeAll has returned and no new connections come in.
+func (s *Server) Shutdown(ctx context.Context) error {
+	draining.Store(true)
+	c := s.conns
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	c.shutdown = true
+	for conn, idle := range c.conns {
+		if idle {
+			// Wakes up the wait for the next request, which then gives up.
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	c.mu.Unlock()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		c.mu.Lock()
+		left := len(c.conns)
+		if left > 0 && ctx.Err() != nil {
+			for conn := range c.conns {
+				conn.Close()
+			}
+		}
+		c.mu.Unlock()
+		if left == 0 {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strconv" // Used to format the retry field
+	"strings" // Used to split data into lines
+	"sync"    // Used to serialise writes from the handler and the heartbeat
+	"time"    // Used for the heartbeat interval
+)
+
+// Event is one Server-Sent Event. Only Data is required.
+type Event struct {
+	ID    string        // Sent back by a reconnecting client as Last-Event-ID
+	Event string        // The event type; "message" if empty
+	Data  string        // May span several lines
+	Retry time.Duration // How long the client waits before reconnecting, if set
+}
+
+// EventStream sends Server-Sent Events (text/event-stream) to a client,
+// e.g. a browser's EventSource. Each event is flushed as soon as it is sent.
+// A comment is sent every heartbeat interval while nothing else is, which
+// keeps proxies from timing the stream out and notices a client that went
+// away even when there is nothing to send.
+//
+// The stream ends when the handler returns; Done tells it when the client
+// disconnected first:
+//
+//	es := NewEventStream(w, req, 15*time.Second)
+//	defer es.Close()
+//	for {
+//		select {
+//		case <-es.Done():
+//			return
+//		case change := <-changes:
+//			es.Send(Event{Event: "reload", Data: change})
+//		}
+//	}
+//
+// A reconnecting client says which event it saw last in the Last-Event-ID
+// request header.
+type EventStream struct {
+	w ResponseWriter
+
+	mu   sync.Mutex // Guards w and err
+	err  error      // First write error: the client is gone
+	done chan struct{}
+	once sync.Once
+
+	stop      chan struct{} // Stops the heartbeat
+	heartbeat sync.WaitGroup
+}
+
+// NewEventStream starts an event stream on w. heartbeat is the interval of
+// the keep-alive comments, 0 for none.
+func NewEventStream(w ResponseWriter, req *HTTPRequest, heartbeat time.Duration) *EventStream {
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream; charset=utf-8")
+	h.Set("Cache-Control", "no-cache")
+	// The length is unknown, so the body goes out chunked.
+	h.Del("Content-Length")
+	w.WriteHeader(200)
+
+	es := &EventStream{w: w, done: make(chan struct{}), stop: make(chan struct{})}
+	es.flush()
+
+	if heartbeat > 0 {
+		es.heartbeat.Add(1)
+		go es.beat(heartbeat)
+	}
+	return es
+}
+
+// beat sends a comment every interval until the stream is closed.
+func (es *EventStream) beat(interval time.Duration) {
+	defer es.heartbeat.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-es.stop:
+			return
+		case <-es.done:
+			return
+		case <-ticker.C:
+			es.Comment("heartbeat")
+		}
+	}
+}
+
+// Send writes ev and flushes it to the client. It returns an error once the
+// client has disconnected.
+func (es *EventStream) Send(ev Event) error {
+	var b strings.Builder
+	if ev.ID != "" {
+		b.WriteString("id: " + oneLine(ev.ID) + "\n")
+	}
+	if ev.Event != "" {
+		b.WriteString("event: " + oneLine(ev.Event) + "\n")
+	}
+	if ev.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(ev.Retry.Milliseconds(), 10) + "\n")
+	}
+	// Every line of the data gets its own field; the client joins them
+	// back with "\n".
+	data := strings.ReplaceAll(ev.Data, "\r\n", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n") // A blank line dispatches the event
+	return es.write(b.String())
+}
+
+// Comment writes a comment line, which clients ignore.
+func (es *EventStream) Comment(text string) error {
+	return es.write(": " + oneLine(text) + "\n\n")
+}
+
+// oneLine replaces line breaks, which would end a field early.
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// write sends s and flushes it, remembering the first error.
+func (es *EventStream) write(s string) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.err != nil {
+		return es.err
+	}
+	if _, err := es.w.Write([]byte(s)); err != nil {
+		es.fail(err)
+		return err
+	}
+	es.flushLocked()
+	return es.err
+}
+
+// flush sends what has been written so far.
+func (es *EventStream) flush() {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.flushLocked()
+}
+
+// flushLocked flushes w and notices, through Write's error next time at the
+// latest, a client that went away.
+func (es *EventStream) flushLocked() {
+	if f, ok := es.w.(Flusher); ok {
+		f.Flush()
+	}
+	// Flush reports no error, but the response remembers it for Write.
+	if _, err := es.w.Write(nil); err != nil {
+		es.fail(err)
+	}
+}
+
+// fail records err and signals Done.
+func (es *EventStream) fail(err error) {
+	es.err = err
+	es.once.Do(func() { close(es.done) })
+}
+
+// Done is closed when the client has disconnected (or the stream was
+// closed). The handler should stop sending and return.
+func (es *EventStream) Done() <-chan struct{} {
+	return es.done
+}
+
+// Close stops the heartbeat. Call it before the handler returns; nothing
+// may be sent afterwards.
+func (es *EventStream) Close() {
+	close(es.stop)
+	es.heartbeat.Wait()
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.err == nil {
+		es.fail(errFinished)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"     // Used to report invalid LISTEN_* variables
+	"net"     // Used to turn the file descriptors into listeners
+	"os"      // Used to read the environment and wrap the descriptors
+	"strconv" // Used to parse LISTEN_PID and LISTEN_FDS
+	"strings" // Used to split LISTEN_FDNAMES
+	"syscall" // Used to keep the descriptors from leaking into children
+)
+
+// listenFDsStart is the first file descriptor systemd passes (after stdin,
+// stdout and stderr).
+const listenFDsStart = 3
+
+// systemdListeners returns the listening sockets systemd passed to the
+// process with socket activation (sd_listen_fds(3)), or none when it was not
+// started that way. systemd binds the sockets from a .socket unit and
+// starts the service on the first connection; since it holds them across
+// restarts, no connection is refused while the server restarts.
+//
+// The LISTEN_* variables are removed so child processes do not take the
+// sockets for theirs.
+func systemdListeners() ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// The variables are meant for this very process, not one it was
+	// started by.
+	if pid == "" || fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	var listeners []net.Listener
+	for i := range n {
+		fd := listenFDsStart + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		l, err := fdListener(fd, name)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket %s from systemd: %w", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// fdListener returns the listener for the socket passed to the process as
+// file descriptor fd, which is closed on exec from then on.
+func fdListener(fd int, name string) (net.Listener, error) {
+	syscall.CloseOnExec(fd)
+	// FileListener works on a duplicate of the descriptor.
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	return net.FileListener(f)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"     // Used to format metric durations
+	"strings" // Used to build the header value
+	"sync"    // Used to guard metrics recorded from several goroutines
+	"time"    // Used to measure durations
+)
+
+// ServerTiming accumulates named metrics for the Server-Timing response header,
+// e.g. "disk;dur=1.2, gzip;dur=0.3". Browsers show these in the network tab,
+// which makes backend time visible when debugging a slow page.
+// Spec: https://www.w3.org/TR/server-timing/
+type ServerTiming struct {
+	mu      sync.Mutex
+	metrics []timingMetric
+}
+
+type timingMetric struct {
+	name     string
+	desc     string
+	duration time.Duration
+}
+
+// Add records a metric with the given name and duration.
+func (t *ServerTiming) Add(name string, d time.Duration) {
+	t.AddDesc(name, "", d)
+}
+
+// AddDesc records a metric with a human readable description.
+func (t *ServerTiming) AddDesc(name, desc string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.metrics = append(t.metrics, timingMetric{name: name, desc: desc, duration: d})
+}
+
+// Start begins timing a metric and returns a function that records it.
+// Typical use is: defer req.Timing.Start("disk")()
+func (t *ServerTiming) Start(name string) func() {
+	start := time.Now()
+	return func() {
+		t.Add(name, time.Since(start))
+	}
+}
+
+// String formats the metrics as a Server-Timing header value.
+// It returns "" when nothing was recorded.
+func (t *ServerTiming) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	parts := make([]string, 0, len(t.metrics))
+	for _, m := range t.metrics {
+		part := m.name
+		if m.desc != "" {
+			part += fmt.Sprintf(";desc=%q", m.desc)
+		}
+		// Durations are expressed in milliseconds.
+		part += fmt.Sprintf(";dur=%.1f", float64(m.duration.Microseconds())/1000)
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
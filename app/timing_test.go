@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings" // Used to check the header
+	"testing" // The test framework
+	"time"    // Used for durations
+)
+
+func TestServerTimingString(t *testing.T) {
+	tests := []struct {
+		name string
+		add  func(*ServerTiming)
+		want string
+	}{
+		{"none", func(*ServerTiming) {}, ""},
+		{"one", func(st *ServerTiming) { st.Add("db", 12300*time.Microsecond) }, "db;dur=12.3"},
+		{"description", func(st *ServerTiming) { st.AddDesc("render", "HTML page", 4100*time.Microsecond) }, `render;desc="HTML page";dur=4.1`},
+		{"several, in order", func(st *ServerTiming) {
+			st.Add("db", 12300*time.Microsecond)
+			st.Add("cache", 0)
+		}, "db;dur=12.3, cache;dur=0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var st ServerTiming
+			tt.add(&st)
+			if got := st.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerTimingHeader(t *testing.T) {
+	s := newTestServer(t)
+	s.Router.Get("/timed", func(w ResponseWriter, req *HTTPRequest) {
+		req.Timing.Add("db", 12300*time.Microsecond)
+		req.Timing.AddDesc("render", "HTML", 4100*time.Microsecond)
+		sendResponse(w, 200, nil, "")
+	})
+
+	if got := get(t, s, "/timed").header.Get("Server-Timing"); got != `db;dur=12.3, render;desc="HTML";dur=4.1` {
+		t.Errorf("Server-Timing = %q", got)
+	}
+	// Uploads time the disk.
+	resp := do(t, s, request("POST", "/files/f.txt", "hello"))
+	if got := resp.header.Get("Server-Timing"); !strings.HasPrefix(got, "disk;dur=") {
+		t.Errorf("Server-Timing of an upload = %q", got)
+	}
+	// Nothing recorded, no header.
+	if got := get(t, s, "/").header.Values("Server-Timing"); len(got) != 0 {
+		t.Errorf("Server-Timing without metrics = %q", got)
+	}
+}
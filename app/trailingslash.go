@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"     // Used to report unknown patterns and policies
+	"strings" // Used to add and remove trailing slashes
+)
+
+// TrailingSlash says what the Router does with a request whose path only
+// matches a route once a trailing slash is added or removed, e.g.
+// "/user-agent/" for the route "/user-agent".
+type TrailingSlash int
+
+const (
+	// TrailingSlashStrict answers 404: the paths are different. It is the
+	// default.
+	TrailingSlashStrict TrailingSlash = iota + 1
+	// TrailingSlashRedirect redirects to the path the route has, with 301
+	// for GET and HEAD and 308 (which keeps the method and body) otherwise.
+	TrailingSlashRedirect
+	// TrailingSlashMatch serves the request with the route as it is.
+	TrailingSlashMatch
+)
+
+// parseTrailingSlash parses a -trailing-slash value.
+func parseTrailingSlash(name string) (TrailingSlash, error) {
+	switch name {
+	case "strict":
+		return TrailingSlashStrict, nil
+	case "redirect":
+		return TrailingSlashRedirect, nil
+	case "match":
+		return TrailingSlashMatch, nil
+	}
+	return 0, fmt.Errorf(`unknown policy %q: expected "strict", "redirect" or "match"`, name)
+}
+
+// SetTrailingSlash sets the trailing slash policy of the routes registered
+// with pattern, whatever their method, overriding Router.TrailingSlash. It
+// panics if there is none, since that is a programming error.
+func (r *Router) SetTrailingSlash(pattern string, policy TrailingSlash) {
+	found := false
+	for i := range r.routes {
+		if r.routes[i].pattern == pattern {
+			r.routes[i].trailingSlash = policy
+			found = true
+		}
+	}
+	if !found {
+		panic(fmt.Sprintf("router: no route for %q", pattern))
+	}
+}
+
+// toggleSlash adds a trailing slash to path, or removes the one it has.
+// The root path has no other form.
+func toggleSlash(path string) (string, bool) {
+	switch {
+	case path == "/" || path == "":
+		return path, false
+	case strings.HasSuffix(path, "/"):
+		return strings.TrimSuffix(path, "/"), true
+	default:
+		return path + "/", true
+	}
+}
+
+// findOtherSlash is find for path with its trailing slash toggled. It only
+// returns routes whose policy lets them serve path that way, with it.
+func (r *Router) findOtherSlash(method, path string) (route, map[string]string, TrailingSlash, bool) {
+	other, ok := toggleSlash(path)
+	if !ok {
+		return route{}, nil, 0, false
+	}
+	rt, params, found := r.find(method, other)
+	if !found {
+		return route{}, nil, 0, false
+	}
+	policy := rt.trailingSlash
+	if policy == 0 {
+		policy = r.TrailingSlash
+	}
+	if policy != TrailingSlashRedirect && policy != TrailingSlashMatch {
+		return route{}, nil, 0, false
+	}
+	return rt, params, policy, true
+}
+
+// serveOtherSlash serves req according to the trailing slash policy of the
+// route its path matches with the slash toggled, and reports whether there
+// is one.
+func (r *Router) serveOtherSlash(w ResponseWriter, req *HTTPRequest) bool {
+	method := req.Method
+	rt, params, policy, ok := r.findOtherSlash(method, req.Path)
+	if !ok && method == "HEAD" && r.AutoHead {
+		rt, params, policy, ok = r.findOtherSlash("GET", req.Path)
+	}
+	if !ok {
+		return false
+	}
+
+	if policy == TrailingSlashRedirect {
+		// The path as sent, so its escapes are kept.
+		path, _ := toggleSlash(req.RawPath)
+		location := withQuery(path, req.RawQuery)
+		status := 308
+		if method == "GET" || method == "HEAD" {
+			status = 301
+		}
+		redirect(w, status, location)
+		return true
+	}
+	req.Params = params
+	rt.handler(w, req)
+	return true
+}
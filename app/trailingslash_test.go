@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"            // Used to fill the served directory
+	"path/filepath" // Used to build paths in the served directory
+	"testing"       // The test framework
+)
+
+func TestTrailingSlash(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		raw          string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"strict", "strict", request("GET", "/user-agent/", ""), 404, ""},
+		{"match", "match", request("GET", "/user-agent/", "", "User-Agent: tester"), 200, ""},
+		{"redirect GET", "redirect", request("GET", "/user-agent/", ""), 301, "/user-agent"},
+		{"redirect POST", "redirect", request("POST", "/files", "x"), 308, "/files/"},
+		{"redirect keeps the query", "redirect", request("GET", "/user-agent/?a=1&b=%20", ""), 301, "/user-agent?a=1&b=%20"},
+		{"redirect escapes the query", "redirect", request("GET", "/user-agent/?q=caf\xc3\xa9", ""), 301, "/user-agent?q=caf%C3%A9"},
+		{"redirect keeps path escapes", "redirect", request("GET", "/user%2Dagent/", ""), 301, "/user%2Dagent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, "-trailing-slash", tt.policy)
+			resp := do(t, s, tt.raw)
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.status, tt.wantStatus)
+			}
+			if got := resp.header.Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestDirectoryRedirectEscapesTheQuery(t *testing.T) {
+	s := newTestServer(t, "-enable-dir-listing")
+	os.Mkdir(filepath.Join(s.Dir, "docs"), 0755)
+	resp := get(t, s, "/files/docs?q=caf\xc3\xa9&x=1")
+	if resp.status != 301 {
+		t.Fatalf("status = %d, want 301", resp.status)
+	}
+	if got := resp.header.Get("Location"); got != "/files/docs/?q=caf%C3%A9&x=1" {
+		t.Errorf("Location = %q", got)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"  // Used to recognise a socket file nobody listens on
+	"io/fs"   // Used to check the type of an existing file
+	"net"     // Used to bind and probe Unix domain sockets
+	"os"      // Used to remove stale socket files and set permissions
+	"syscall" // Used to recognise a socket nobody listens on
+)
+
+// listenUnix binds a Unix domain socket at path, so that local clients (a
+// reverse proxy such as nginx, a sidecar) can reach the server without a
+// TCP port. A socket file left behind by a server that did not shut down
+// cleanly is replaced; one that is still in use, or any other kind of file,
+// is not. The file is removed again when the listener is closed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, errors.New("file exists and is not a socket")
+		}
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, errors.New("socket is in use")
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+		os.Remove(path) // Nobody listens on it any more
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json" // Used to pass the listeners' addresses
+	"errors"        // Used to report a new process that did not start
+	"fmt"           // Used to report sockets that cannot be handed over
+	"net"           // The listeners handed over
+	"os"            // Used to pass file descriptors and environment
+	"os/exec"       // Used to start the new process
+	"syscall"       // Used to keep the listeners non-blocking
+	"time"          // Used to bound the wait for the new process
+)
+
+// A zero-downtime upgrade replaces the running process with a new one,
+// typically after the executable was replaced by a new version, without
+// refusing a single connection:
+//
+//  1. on SIGUSR2 the server starts its executable again, with the same
+//     arguments, passing it the listening sockets (as file descriptors
+//     from 3 on) and their addresses (in upgradeEnv);
+//  2. the new process serves the sockets it inherits instead of binding
+//     them, and says it is ready by writing to a pipe passed after them;
+//  3. the old process then stops accepting and exits once the connections
+//     it has are done (see Shutdown). Meanwhile both accept on the same
+//     sockets, and connections waiting in their backlog go to the new one.
+//
+// If the new process fails to start, exits, or is not ready within
+// upgradeTimeout, the old one carries on as if nothing happened.
+//
+// Under a service manager that tracks the main PID (systemd with
+// Type=simple), use socket activation and a restart instead.
+
+// upgradeEnv is the environment variable with the addresses of the inherited
+// listeners, as a JSON list, in the order of their file descriptors.
+const upgradeEnv = "UPGRADE_LISTENERS"
+
+// upgradeTimeout is how long the old process waits for the new one.
+const upgradeTimeout = 30 * time.Second
+
+// upgrade starts the new process, hands it listeners (which must be bound)
+// and waits until it serves them.
+func upgrade(listeners []Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// 1. Collect the sockets, each with the address it is configured under
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	addrs := make([]string, 0, len(listeners))
+	for _, ln := range listeners {
+		filer, ok := ln.Bound.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("cannot hand over %s", ln.Addr)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return fmt.Errorf("cannot hand over %s: %w", ln.Addr, err)
+		}
+		files = append(files, f)
+		addrs = append(addrs, ln.Addr)
+	}
+	env, _ := json.Marshal(addrs)
+
+	// 2. Start the new process, with the write end of the ready pipe last
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+string(env))
+	cmd.ExtraFiles = append(files, readyW)
+	err = cmd.Start()
+	readyW.Close() // Only the new process may hold it, so its exit ends the wait
+	// Passing the sockets made them blocking, this process's listeners too,
+	// which share the flag with the copies: a pending Accept would then hold
+	// up their Close for good.
+	for _, f := range files {
+		if rc, err := f.SyscallConn(); err == nil {
+			rc.Control(func(fd uintptr) { syscall.SetNonblock(int(fd), true) })
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// 3. Wait for it to say it is ready. Nothing arrives if it exits first.
+	ready.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if n, _ := ready.Read(make([]byte, 1)); n == 0 {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.New("the new process did not start serving")
+	}
+	cmd.Process.Release()
+
+	// The Unix socket files now belong to the new process.
+	for _, ln := range listeners {
+		if ul, ok := ln.Bound.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
+
+// inheritedListeners returns the listeners handed over by the process this
+// one replaces (see upgrade), by address, or none when it was not started
+// that way. ready is to be called once they are all served; it tells the old
+// process to stop.
+func inheritedListeners() (listeners map[string]net.Listener, ready func(), err error) {
+	env, ok := os.LookupEnv(upgradeEnv)
+	os.Unsetenv(upgradeEnv)
+	if !ok {
+		return nil, func() {}, nil
+	}
+	var addrs []string
+	if err := json.Unmarshal([]byte(env), &addrs); err != nil {
+		return nil, nil, fmt.Errorf("invalid %s: %w", upgradeEnv, err)
+	}
+
+	listeners = make(map[string]net.Listener)
+	for i, addr := range addrs {
+		l, err := fdListener(listenFDsStart+i, addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, nil, fmt.Errorf("socket %s from the previous process: %w", addr, err)
+		}
+		// Unix socket files are removed when the listener is closed, as if
+		// this process had bound them.
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+		listeners[addr] = l
+	}
+
+	pipe := os.NewFile(uintptr(listenFDsStart+len(addrs)), "ready")
+	ready = func() {
+		pipe.Write([]byte{1})
+		pipe.Close()
+	}
+	return listeners, ready, nil
+}
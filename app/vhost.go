@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"     // Used to strip the port from the Host header
+	"strings" // Used to normalise host names
+)
+
+// Virtual hosts let one listener serve several sites: a request whose Host
+// header names one of s.VirtualHosts is served by that host's Router, with
+// its own routes and directory, while any other host (or none) falls back to
+// s.Router, the default site. The connection-level settings (timeouts, size
+// limits, TLS, ...) are the listening Server's for every host.
+
+// NewVirtualHost returns a virtual host for s that serves dir under /files/,
+// with the same settings and routes as s otherwise. Register it under its
+// host name in s.VirtualHosts.
+func (s *Server) NewVirtualHost(dir string) *Server {
+	vh := *s
+	vh.Dir = dir
+	vh.VirtualHosts = nil
+	vh.live = nil
+	vh.Router = NewRouter()
+	vh.Router.AutoHead = s.Router.AutoHead
+	vh.Router.AutoOptions = s.Router.AutoOptions
+	vh.Router.TrailingSlash = s.Router.TrailingSlash
+	vh.registerRoutes()
+	return &vh
+}
+
+// routerFor returns the Router that serves req.
+func (s *Server) routerFor(req *HTTPRequest) *Router {
+	if vh, ok := s.VirtualHosts[canonicalHost(req.Header("Host"))]; ok {
+		return vh.Router
+	}
+	return s.Router
+}
+
+// canonicalHost reduces a Host header to the name the virtual hosts are
+// registered under: "Example.COM.:8080" becomes "example.com".
+func canonicalHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"           // The connection is read and written through buffers
+	"crypto/sha1"     // Used to compute Sec-WebSocket-Accept
+	"encoding/base64" // Used to decode the key and encode the accept value
+	"encoding/binary" // Used for extended payload lengths and close codes
+	"errors"          // Used to report protocol violations
+	"io"              // Used to read frames in full
+	"strconv"         // Used to format close codes
+	"strings"         // Used to inspect the handshake headers
+	"sync"            // Used to serialise writes from several goroutines
+	"unicode/utf8"    // Text messages must be valid UTF-8
+)
+
+// websocketGUID is appended to the client's key to compute the accept value,
+// proving the server understood the handshake (RFC 6455 1.3).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// MessageType is the type of a WebSocket message.
+type MessageType int
+
+// The message types, with their frame opcodes (RFC 6455 5.2).
+const (
+	TextMessage   MessageType = 1 // UTF-8 text
+	BinaryMessage MessageType = 2 // Arbitrary bytes
+)
+
+// Frame opcodes besides the message types.
+const (
+	opContinuation = 0x0
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close codes sent when the connection ends (RFC 6455 7.4.1).
+const (
+	closeNormal       = 1000
+	closeProtocol     = 1002
+	closeInvalidData  = 1007
+	closeTooBig       = 1009
+	closeNoStatusSent = 1005 // Never sent, only reported
+)
+
+// defaultMaxMessageBytes caps a message, fragments included, unless the
+// handler sets WebSocket.MaxMessageBytes.
+const defaultMaxMessageBytes = 1 << 20
+
+// errWebSocketClosed is returned by WriteMessage after Close.
+var errWebSocketClosed = errors.New("websocket: connection closed")
+
+// CloseError is returned by ReadMessage once the client closed the
+// connection, with the code and reason it gave (1005 if it gave none).
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return "websocket: closed with code " + strconv.Itoa(e.Code) + " " + e.Reason
+}
+
+// WebSocket is a connection upgraded by UpgradeWebSocket. One goroutine may
+// read messages while others write: writes are serialised.
+type WebSocket struct {
+	rw *bufio.ReadWriter
+
+	// MaxMessageBytes caps the size of a message read; a larger one closes
+	// the connection with 1009. Zero means defaultMaxMessageBytes.
+	MaxMessageBytes int64
+
+	mu     sync.Mutex // Guards writes and closed
+	closed bool       // A close frame was sent
+}
+
+// UpgradeWebSocket accepts the WebSocket handshake of req (RFC 6455 4.2)
+// and takes over the connection. A request that is not a valid handshake is
+// answered with 400 (426 for a protocol version other than 13) and an error
+// is returned.
+//
+// The handler then exchanges messages until ReadMessage reports an error,
+// and the connection is closed when it returns:
+//
+//	ws, err := UpgradeWebSocket(w, req)
+//	if err != nil {
+//		return
+//	}
+//	for {
+//		typ, msg, err := ws.ReadMessage()
+//		if err != nil {
+//			return
+//		}
+//		ws.WriteMessage(typ, msg)
+//	}
+func UpgradeWebSocket(w ResponseWriter, req *HTTPRequest) (*WebSocket, error) {
+	// 1. Check the handshake.
+	if req.Header("Sec-WebSocket-Version") != "13" {
+		sendResponse(w, 426, []string{"Sec-WebSocket-Version: 13", "Upgrade: websocket"}, "")
+		return nil, errors.New("websocket: unsupported version " + req.Header("Sec-WebSocket-Version"))
+	}
+	key := req.Header("Sec-WebSocket-Key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if req.Method != "GET" || !hasToken(req.Header("Connection"), "upgrade") ||
+		!hasToken(req.Header("Upgrade"), "websocket") || err != nil || len(decoded) != 16 {
+		sendResponse(w, 400, nil, "")
+		return nil, errors.New("websocket: invalid handshake")
+	}
+
+	// 2. Take over the connection and switch protocols.
+	_, rw, err := hijack(w)
+	if err != nil {
+		sendResponse(w, 500, nil, "")
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return nil, err
+	}
+	return &WebSocket{rw: rw}, nil
+}
+
+// hasToken reports whether the comma-separated header value contains token,
+// compared case-insensitively (e.g. "keep-alive, Upgrade" has "upgrade").
+func hasToken(value, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message, reassembled from its
+// fragments. Pings are answered and pongs skipped along the way. Once the
+// client closes the connection the close is acknowledged and a *CloseError
+// returned; a client breaking the protocol is sent a close frame with the
+// reason and gets an error too.
+func (ws *WebSocket) ReadMessage() (MessageType, []byte, error) {
+	limit := ws.MaxMessageBytes
+	if limit <= 0 {
+		limit = defaultMaxMessageBytes
+	}
+
+	var (
+		typ     MessageType
+		message []byte
+		started bool // A fragmented message is in progress
+	)
+	for {
+		fin, opcode, payload, err := ws.readFrame(limit - int64(len(message)))
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := ws.writeFrame(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, ws.acknowledgeClose(payload)
+		case opContinuation:
+			if !started {
+				return 0, nil, ws.fail(closeProtocol, "unexpected continuation frame")
+			}
+		case int(TextMessage), int(BinaryMessage):
+			if started {
+				return 0, nil, ws.fail(closeProtocol, "expected continuation frame")
+			}
+			typ, started = MessageType(opcode), true
+		default:
+			return 0, nil, ws.fail(closeProtocol, "unknown opcode")
+		}
+
+		message = append(message, payload...)
+		if fin {
+			if typ == TextMessage && !utf8.Valid(message) {
+				return 0, nil, ws.fail(closeInvalidData, "invalid UTF-8")
+			}
+			return typ, message, nil
+		}
+	}
+}
+
+// readFrame reads one frame, whose payload may be at most limit bytes
+// unless it is a control frame (RFC 6455 5.2):
+//
+//	FIN RSV1-3 opcode(4) | MASK len(7) | [len 16 or 64 bits] | mask key(32) | payload
+func (ws *WebSocket) readFrame(limit int64) (fin bool, opcode int, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(ws.rw, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	opcode = int(head[0] & 0x0F)
+	masked := head[1]&0x80 != 0
+	length := int64(head[1] & 0x7F)
+
+	// No extensions are negotiated, so the RSV bits must be 0, and clients
+	// must mask every frame.
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, ws.fail(closeProtocol, "reserved bits set")
+	}
+	if !masked {
+		return false, 0, nil, ws.fail(closeProtocol, "frame not masked")
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+
+	// Control frames are small and never fragmented.
+	if opcode >= opClose {
+		if length > 125 || !fin {
+			return false, 0, nil, ws.fail(closeProtocol, "invalid control frame")
+		}
+	} else if length > limit {
+		return false, 0, nil, ws.fail(closeTooBig, "message too big")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.rw, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(ws.rw, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends data as a single text or binary message.
+func (ws *WebSocket) WriteMessage(typ MessageType, data []byte) error {
+	if typ != TextMessage && typ != BinaryMessage {
+		return errors.New("websocket: invalid message type")
+	}
+	return ws.writeFrame(int(typ), data)
+}
+
+// writeFrame sends one unfragmented frame. Server frames are not masked.
+func (ws *WebSocket) writeFrame(opcode int, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closed {
+		return errWebSocketClosed
+	}
+	if opcode == opClose {
+		ws.closed = true
+	}
+
+	head := []byte{0x80 | byte(opcode)}
+	switch n := len(payload); {
+	case n <= 125:
+		head = append(head, byte(n))
+	case n <= 0xFFFF:
+		head = append(head, 126)
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head = append(head, 127)
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	ws.rw.Write(head)
+	ws.rw.Write(payload)
+	return ws.rw.Flush()
+}
+
+// Close starts the closing handshake with 1000 (normal closure). The
+// connection itself is closed once the handler returns.
+func (ws *WebSocket) Close() error {
+	return ws.writeClose(closeNormal, "")
+}
+
+// writeClose sends a close frame with code and reason.
+func (ws *WebSocket) writeClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return ws.writeFrame(opClose, append(payload, reason...))
+}
+
+// acknowledgeClose answers the close frame the client sent with payload
+// (unless we sent ours first) and returns it as a *CloseError.
+func (ws *WebSocket) acknowledgeClose(payload []byte) error {
+	closeErr := &CloseError{Code: closeNoStatusSent}
+	if len(payload) >= 2 {
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+	}
+	// Echo the code back, as is customary.
+	if closeErr.Code == closeNoStatusSent {
+		ws.writeFrame(opClose, nil)
+	} else {
+		ws.writeClose(closeErr.Code, "")
+	}
+	return closeErr
+}
+
+// fail closes the connection because the client broke the protocol.
+func (ws *WebSocket) fail(code int, reason string) error {
+	ws.writeClose(code, reason)
+	return errors.New("websocket: " + reason)
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"    // Used to batch the head and small bodies into few writes
+	"errors"   // Used to report misuse of the writer
+	"fmt"      // Used to format chunk sizes
+	"io"       // Used to count what reaches the connection
+	"log/slog" // Used to log superfluous WriteHeader calls
+	"net"      // The response is written to the client's connection
+	"strconv"  // Used to read back Content-Length
+	"time"     // Used to lift the deadlines of hijacked connections
+)
+
+// ResponseWriter is how a handler builds its response.
+//
+// Set headers with Header(), then call WriteHeader with the status code and
+// Write the body in as many pieces as needed. Calling Write first implies
+// WriteHeader(200). Headers changed after WriteHeader are ignored.
+//
+// Middleware can wrap a ResponseWriter to observe or alter the response
+// (see Cached for an example).
+type ResponseWriter interface {
+	Header() Header
+	WriteHeader(status int)
+	Write(p []byte) (int, error)
+}
+
+// Flusher is implemented by ResponseWriters that can send buffered data to
+// the client immediately. Streaming handlers check for it with a type
+// assertion:
+//
+//	if f, ok := w.(Flusher); ok {
+//		f.Flush()
+//	}
+type Flusher interface {
+	Flush()
+}
+
+// Hijacker is implemented by ResponseWriters that let a handler take over
+// the connection and speak another protocol on it, e.g. a WebSocket (see
+// UpgradeWebSocket). Hijack returns the connection and a reader/writer over
+// it; the reader holds whatever the client already sent past the request.
+//
+// After Hijack the ResponseWriter must not be used again, and the server's
+// read and write deadlines no longer apply. The connection still belongs to
+// the server: it is closed once the handler returns.
+type Hijacker interface {
+	Hijack() (net.Conn, *bufio.ReadWriter, error)
+}
+
+// hijack hijacks w, or whatever middleware wrapped it.
+func hijack(w ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.(Hijacker)
+	if !ok {
+		return nil, nil, errNotHijackable
+	}
+	return h.Hijack()
+}
+
+var (
+	// errBodyNotAllowed is returned when writing a body for a status that
+	// cannot have one (1xx, 204, 304).
+	errBodyNotAllowed = errors.New("response status does not allow a body")
+	// errContentLength is returned when a handler writes more than it declared.
+	errContentLength = errors.New("wrote more than the declared Content-Length")
+	// errShortBody is recorded when a handler finishes before writing the
+	// Content-Length it declared.
+	errShortBody = errors.New("wrote less than the declared Content-Length")
+	// errFinished is returned for writes after the response was completed,
+	// e.g. from a goroutine the handler left running.
+	errFinished = errors.New("write after the response was completed")
+	// errAborted is recorded when a response is cut off on purpose (e.g. the
+	// handler panicked after part of it was sent). Handlers can panic with it
+	// to cut off a response they cannot complete, e.g. a proxied body whose
+	// upstream went away.
+	errAborted = errors.New("response aborted")
+	// errHijacked is returned for writes after the handler took over the
+	// connection with Hijack.
+	errHijacked = errors.New("connection has been hijacked")
+	// errNotHijackable is returned by hijack when the connection cannot be
+	// taken over, e.g. it was never given a reader.
+	errNotHijackable = errors.New("connection cannot be hijacked")
+)
+
+// response is the ResponseWriter handed to handlers for one request on a
+// connection. It is where the invariants every response must respect are
+// enforced, whatever the handler does:
+//   - the head is written exactly once, with Date, Server and the other
+//     per-request headers added by buildHead;
+//   - the body never exceeds the declared Content-Length, and a body shorter
+//     than it closes the connection, since the client would wait forever;
+//   - a body of unknown length is sent with "Transfer-Encoding: chunked", or
+//     ended by closing the connection for HTTP/1.0 clients, which do not
+//     understand chunks;
+//   - HEAD and 1xx/204/304 responses never carry a body.
+type response struct {
+	conn net.Conn
+	req  *HTTPRequest
+	w    *bufio.Writer
+	// out counts what actually reached conn, past the buffer.
+	out *countingWriter
+	// reader is the connection's reader, handed over by Hijack.
+	reader *bufio.Reader
+	// hijacked is set once the handler took over the connection.
+	hijacked bool
+
+	header      Header
+	status      int
+	wroteHeader bool
+
+	// contentLength is the declared body size, or -1 if unknown.
+	contentLength int64
+	written       int64
+	// chunked is set when the body is sent in chunks because its length is unknown.
+	chunked bool
+
+	// err is the first error hit while writing. Once set, the connection
+	// cannot be trusted with another response.
+	err error
+}
+
+// newResponse returns the ResponseWriter for req, writing to conn.
+func newResponse(conn net.Conn, req *HTTPRequest) *response {
+	out := &countingWriter{w: conn}
+	w := writerPool.Get().(*bufio.Writer)
+	w.Reset(out)
+	return &response{
+		conn:          conn,
+		req:           req,
+		w:             w,
+		out:           out,
+		header:        make(Header),
+		contentLength: -1,
+	}
+}
+
+// countingWriter counts the bytes written through it. A write the
+// connection takes only part of is carried on with the rest.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := c.w.Write(p[written:])
+		written += n
+		c.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		// A writer that accepts nothing and reports no error would loop forever.
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// ReadFrom copies src to the underlying writer with io.Copy, so that a
+// *net.TCPConn gets to use its own ReadFrom (sendfile for files).
+func (c *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(c.w, src)
+	c.n += n
+	return n, err
+}
+
+// writerOnly hides every method but Write, so io.Copy does not call back
+// into a ReadFrom that is falling back to plain writes.
+type writerOnly struct {
+	io.Writer
+}
+
+// abort gives up on a response that cannot be completed. The final chunk
+// is not sent, so the client can tell the body is incomplete, and the
+// connection is closed.
+func (r *response) abort() {
+	if r.err == nil {
+		r.err = errAborted
+	}
+}
+
+// reset throws away the response written so far so that another one can be
+// sent instead, e.g. a 500 after the handler panicked halfway through. That
+// is only possible while all of it is still in the buffer; once any byte has
+// reached the client it reports false.
+func (r *response) reset() bool {
+	if r.out.n > 0 || r.err != nil {
+		return false
+	}
+	r.w.Reset(r.out)
+	r.header = make(Header)
+	r.status, r.wroteHeader = 0, false
+	r.contentLength, r.written, r.chunked = -1, 0, false
+	return true
+}
+
+// Hijack hands the connection over to the handler. Anything already written
+// is sent first.
+func (r *response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	switch {
+	case r.hijacked:
+		return nil, nil, errHijacked
+	case r.reader == nil || r.w == nil:
+		return nil, nil, errNotHijackable
+	}
+	if err := r.w.Flush(); err != nil {
+		return nil, nil, err
+	}
+	r.hijacked = true
+	r.err = errHijacked
+	r.conn.SetDeadline(time.Time{})
+	return r.conn, bufio.NewReadWriter(r.reader, bufio.NewWriter(r.conn)), nil
+}
+
+// Header returns the headers that WriteHeader will send.
+func (r *response) Header() Header {
+	return r.header
+}
+
+// WriteHeader sends the status line and headers.
+func (r *response) WriteHeader(status int) {
+	if r.hijacked {
+		return
+	}
+	if r.wroteHeader {
+		slog.Warn("superfluous WriteHeader call ignored", "request_id", r.req.ID, "status", status)
+		return
+	}
+	r.wroteHeader = true
+	r.status = status
+
+	if statusHasNoBody(status) {
+		r.header.Del("Content-Length")
+	} else if n, err := strconv.ParseInt(r.header.Get("Content-Length"), 10, 64); err == nil && n >= 0 {
+		r.contentLength = n
+	} else {
+		r.header.Del("Content-Length")
+		switch {
+		case r.req.Method == "HEAD":
+			// No body follows, so there is nothing to delimit.
+		case r.req.isHTTP10():
+			// Without a length the only way to tell an HTTP/1.0 client where
+			// the body ends is to close the connection after it.
+			r.req.Close = true
+		default:
+			r.chunked = true
+			r.header.Set("Transfer-Encoding", "chunked")
+		}
+	}
+
+	head := getBuffer()
+	buildHead(head, r.req, statusLine(status), r.header)
+	if _, err := r.w.Write(head.Bytes()); err != nil && r.err == nil {
+		r.err = err
+	}
+	putBuffer(head)
+}
+
+// Write sends part of the body, sending the head first if needed.
+func (r *response) Write(p []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(200)
+	}
+	if r.w == nil {
+		return 0, errFinished
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if statusHasNoBody(r.status) {
+		return 0, errBodyNotAllowed
+	}
+	if r.contentLength >= 0 && r.written+int64(len(p)) > r.contentLength {
+		return 0, errContentLength
+	}
+
+	r.written += int64(len(p))
+	// HEAD responses describe the body without sending it.
+	if r.req.Method == "HEAD" {
+		return len(p), nil
+	}
+	if r.chunked {
+		// An empty chunk would mean "end of body", so skip empty writes.
+		if len(p) == 0 {
+			return 0, nil
+		}
+		if _, err := fmt.Fprintf(r.w, "%x\r\n", len(p)); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+	n, err := r.w.Write(p)
+	if err == nil && r.chunked {
+		_, err = r.w.WriteString("\r\n")
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// ReadFrom sends the body from src. io.Copy (and sendStream) use it instead
+// of Write when available: for a body of known length, the buffered head is
+// flushed and src is copied straight to the connection, where the kernel can
+// send an *os.File without it passing through user space at all (sendfile).
+// Other bodies (chunked, HEAD) are written through Write as usual.
+func (r *response) ReadFrom(src io.Reader) (int64, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(200)
+	}
+	if r.w == nil || r.err != nil || r.chunked || r.contentLength < 0 ||
+		r.req.Method == "HEAD" || statusHasNoBody(r.status) {
+		return io.Copy(writerOnly{r}, src)
+	}
+
+	// Never send more than the declared length. io.CopyN already passes an
+	// *io.LimitedReader; wrapping it again would hide the file from sendfile.
+	remaining := r.contentLength - r.written
+	if lr, ok := src.(*io.LimitedReader); !ok || lr.N > remaining {
+		src = io.LimitReader(src, remaining)
+	}
+
+	if err := r.w.Flush(); err != nil {
+		r.err = err
+		return 0, err
+	}
+	n, err := r.out.ReadFrom(src)
+	r.written += n
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// Flush sends everything written so far to the client right away instead of
+// waiting for the buffer to fill up or the handler to return. Streaming
+// handlers call it after each piece of data (e.g. each line of a long
+// running job's output).
+func (r *response) Flush() {
+	if !r.wroteHeader {
+		r.WriteHeader(200)
+	}
+	if r.err != nil || r.w == nil {
+		return
+	}
+	if err := r.w.Flush(); err != nil {
+		r.err = err
+	}
+}
+
+// finish completes the response once the handler has returned and pushes
+// anything still buffered to the client.
+func (r *response) finish() {
+	// A handler that wrote nothing at all answers 200 with an empty body.
+	if !r.wroteHeader && !r.hijacked {
+		if !r.header.Has("Content-Length") {
+			r.header.Set("Content-Length", "0")
+		}
+		r.WriteHeader(200)
+	}
+
+	if r.err == nil && r.req.Method != "HEAD" && r.contentLength >= 0 && r.written < r.contentLength {
+		r.err = errShortBody
+	}
+	// The zero-sized last chunk tells the client the body is complete.
+	if r.err == nil && r.chunked {
+		if _, err := r.w.WriteString("0\r\n\r\n"); err != nil {
+			r.err = err
+		}
+	}
+	// After Hijack the buffer is empty and the connection not ours to write.
+	if err := r.w.Flush(); err != nil && r.err == nil && !r.hijacked {
+		r.err = err
+	}
+
+	// The buffer goes back to the pool. Write and Flush check for nil, so a
+	// goroutine that outlives the handler cannot write into the buffer of
+	// someone else's response.
+	r.w.Reset(nil)
+	writerPool.Put(r.w)
+	r.w = nil
+}
+
+// statusWriter wraps a ResponseWriter to remember the status code and the
+// number of body bytes the handler wrote, for middleware that reports on
+// responses (access logs, metrics).
+type statusWriter struct {
+	ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader records the status before passing it on.
+func (s *statusWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the body bytes before passing them on.
+func (s *statusWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = 200
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom passes through to the wrapped writer, when it has one, so that
+// files are still sent with sendfile.
+func (s *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if s.status == 0 {
+		s.status = 200
+	}
+	rf, ok := s.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(writerOnly{s}, src)
+	}
+	n, err := rf.ReadFrom(src)
+	s.bytes += n
+	return n, err
+}
+
+// Flush passes through to the wrapped writer so streaming keeps working.
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack passes through to the wrapped writer, so WebSockets keep working.
+// The handler is about to switch protocols, which it reports as 101.
+func (s *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := hijack(s.ResponseWriter)
+	if err == nil && s.status == 0 {
+		s.status = 101
+	}
+	return conn, rw, err
+}
@@ -1,3 +1,14 @@
 module github.com/codecrafters-io/http-server-starter-go
 
 go 1.25.0
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/klauspost/compress v1.18.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	golang.org/x/net v0.57.0
+	golang.org/x/text v0.40.0 // indirect
+)